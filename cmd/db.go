@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fhenixprotocol/fheos/precompiles"
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+	"github.com/fhenixprotocol/fheos/storage"
+	fhedriver "github.com/fhenixprotocol/warp-drive/fhe-driver"
+	"github.com/spf13/cobra"
+)
+
+func setupDbListCommand() *cobra.Command {
+	var zone int32
+	var utype uint8
+	var placeholder bool
+	var olderThan time.Duration
+	var prefix string
+	var limit int
+	var countOnly bool
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the ciphertexts stored in the fheos db",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var filter types.CtFilter
+			if cmd.Flags().Changed("zone") {
+				filter.SecurityZone = &zone
+			}
+			if cmd.Flags().Changed("utype") {
+				t := fhedriver.EncryptionType(utype)
+				filter.UintType = &t
+			}
+			if cmd.Flags().Changed("placeholder") {
+				filter.Placeholder = &placeholder
+			}
+			if olderThan > 0 {
+				before := time.Now().Add(-olderThan)
+				filter.CreatedBefore = &before
+			}
+			if prefix != "" {
+				hashPrefix, err := hex.DecodeString(strings.TrimPrefix(prefix, "0x"))
+				if err != nil {
+					return fmt.Errorf("invalid hash prefix: %w", err)
+				}
+				filter.HashPrefix = hashPrefix
+			}
+
+			store, err := precompiles.OpenStorage()
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			count := 0
+			err = store.IterateCts(filter, func(m types.CtMetadata) bool {
+				count++
+				if !countOnly {
+					fmt.Printf("0x%s zone=%d utype=%d trivial=%t placeholder=%t created=%s\n",
+						hex.EncodeToString(m.Hash[:]), m.SecurityZone, m.UintType, m.TriviallyEncrypted, m.Placeholder, m.CreatedAt.Format(time.RFC3339))
+				}
+				return limit <= 0 || count < limit
+			})
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("%d ciphertexts\n", count)
+			return nil
+		},
+	}
+
+	cmd.Flags().Int32VarP(&zone, "zone", "z", 0, "only ciphertexts of this security zone")
+	cmd.Flags().Uint8VarP(&utype, "utype", "t", 0, "only ciphertexts of this uint type")
+	cmd.Flags().BoolVar(&placeholder, "placeholder", false, "only placeholders (true) or only resolved ciphertexts (false)")
+	cmd.Flags().DurationVar(&olderThan, "older-than", 0, "only ciphertexts created more than this long ago")
+	cmd.Flags().StringVar(&prefix, "prefix", "", "only ciphertexts whose hash starts with this hex prefix")
+	cmd.Flags().IntVar(&limit, "limit", 0, "stop after this many ciphertexts (0 for no limit)")
+	cmd.Flags().BoolVar(&countOnly, "count", false, "only print the number of matching ciphertexts")
+	return cmd
+}
+
+func setupDbUsageCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "usage",
+		Short: "Show how many ciphertexts and bytes every security zone and type uses",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := precompiles.OpenStorage()
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			var total types.Usage
+			err = store.IterateUsage(func(u types.Usage) bool {
+				fmt.Printf("zone=%d utype=%d count=%d bytes=%d placeholders=%d\n", u.SecurityZone, u.UintType, u.Count, u.Bytes, u.Placeholders)
+				total.Count += u.Count
+				total.Bytes += u.Bytes
+				total.Placeholders += u.Placeholders
+				return true
+			})
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("total count=%d bytes=%d placeholders=%d\n", total.Count, total.Bytes, total.Placeholders)
+			return nil
+		},
+	}
+}
+
+func printManifest(manifest types.BackupManifest) {
+	fmt.Printf("version=%d created=%s keysHash=%s\n", manifest.Version, manifest.CreatedAt.Format(time.RFC3339), manifest.KeysHash)
+	for namespace, count := range manifest.Entries {
+		fmt.Printf("%s: %d keys\n", namespace, count)
+	}
+}
+
+// requestBackup asks the admin endpoint of a running node to write a checkpoint to dir, which is a path on the node
+func requestBackup(url string, dir string) (types.BackupManifest, error) {
+	var manifest types.BackupManifest
+	body, err := json.Marshal(map[string]string{"dir": dir})
+	if err != nil {
+		return manifest, err
+	}
+
+	resp, err := http.Post(strings.TrimSuffix(url, "/")+"/Backup", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return manifest, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return manifest, fmt.Errorf("backup failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	return manifest, json.NewDecoder(resp.Body).Decode(&manifest)
+}
+
+func setupDbBackupCommand() *cobra.Command {
+	var url string
+
+	cmd := &cobra.Command{
+		Use:   "backup <dir>",
+		Short: "Write a consistent checkpoint of the fheos db to an empty directory",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var manifest types.BackupManifest
+			var err error
+			if url != "" {
+				manifest, err = requestBackup(url, args[0])
+			} else {
+				var store *storage.FheosStorage
+				if store, err = precompiles.OpenStorage(); err != nil {
+					return err
+				}
+				defer store.Close()
+				manifest, err = store.Checkpoint(args[0])
+			}
+			if err != nil {
+				return err
+			}
+
+			printManifest(manifest)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&url, "url", "", "admin url of a running node to take the checkpoint from, instead of opening the db directly")
+	return cmd
+}
+
+func setupDbRestoreCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "restore <dir>",
+		Short: "Verify a checkpoint and restore it as the fheos db, which must not exist yet",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			manifest, err := precompiles.RestoreStorage(args[0])
+			if err != nil {
+				return err
+			}
+
+			printManifest(manifest)
+			return nil
+		},
+	}
+}
+
+func setupDbScrubCommand() *cobra.Command {
+	var opts storage.ScrubOptions
+
+	cmd := &cobra.Command{
+		Use:   "scrub",
+		Short: "Verify every stored ciphertext against its checksum and report (or quarantine) the bad ones",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := precompiles.OpenStorage()
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			report, err := store.Scrub(opts)
+			for _, issue := range report.Issues {
+				fmt.Printf("0x%s: %s\n", hex.EncodeToString(issue.Hash[:]), issue.Reason)
+			}
+			fmt.Printf("scanned=%d unverified=%d bad=%d quarantined=%d\n", report.Scanned, report.Unverified, len(report.Issues), report.Quarantined)
+			return err
+		},
+	}
+
+	cmd.Flags().BoolVar(&opts.CheckMetadata, "check-metadata", false, "also check the type, security zone and trivial flag encoded in every handle")
+	cmd.Flags().BoolVar(&opts.Quarantine, "quarantine", false, "move bad records aside instead of only reporting them")
+	return cmd
+}
+
+func setupDbAliasCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "alias <hash>",
+		Short: "Show the content hash a placeholder resolved to, and every placeholder that shares it",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			hash, err := hex.DecodeString(strings.TrimPrefix(args[0], "0x"))
+			if err != nil || len(hash) != len(types.Hash{}) {
+				return fmt.Errorf("invalid hash: %s", args[0])
+			}
+
+			store, err := precompiles.OpenStorage()
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			content, placeholders, err := store.Aliases(types.Hash(hash))
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("content 0x%s\n", hex.EncodeToString(content[:]))
+			for _, placeholder := range placeholders {
+				fmt.Printf("placeholder 0x%s\n", hex.EncodeToString(placeholder[:]))
+			}
+			return nil
+		},
+	}
+}
+
+func setupDbLineageCommand() *cobra.Command {
+	var depth int
+
+	cmd := &cobra.Command{
+		Use:   "lineage <hash>",
+		Short: "Show how a ciphertext was produced, following the provenance of its inputs",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			hash, err := hex.DecodeString(strings.TrimPrefix(args[0], "0x"))
+			if err != nil || len(hash) != len(types.Hash{}) {
+				return fmt.Errorf("invalid hash: %s", args[0])
+			}
+
+			store, err := precompiles.OpenStorage()
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			lineage, err := store.Lineage(types.Hash(hash), depth, 0)
+			if err != nil {
+				return err
+			}
+
+			for _, node := range lineage.Nodes {
+				p := node.Provenance
+				if p == nil {
+					fmt.Printf("depth=%d 0x%s no provenance\n", node.Depth, hex.EncodeToString(node.Hash[:]))
+					continue
+				}
+
+				inputs := make([]string, 0, len(p.Inputs))
+				for _, input := range p.Inputs {
+					inputs = append(inputs, "0x"+hex.EncodeToString(input[:]))
+				}
+				fmt.Printf("depth=%d 0x%s op=%s inputs=[%s] contract=%s tx=%s block=%d created=%s\n", node.Depth, hex.EncodeToString(node.Hash[:]),
+					p.Operation, strings.Join(inputs, ","), p.Contract.Hex(), p.TxHash.Hex(), p.BlockNumber, p.CreatedAt.Format(time.RFC3339))
+			}
+			if lineage.Truncated {
+				fmt.Printf("truncated at depth %d\n", depth)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().IntVar(&depth, "depth", precompiles.DefaultLineageDepth, "how many operations back to follow the inputs")
+	return cmd
+}
+
+func setupDbCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "db",
+		Short: "Inspect and maintain the fheos db",
+	}
+
+	cmd.AddCommand(setupDbListCommand())
+	cmd.AddCommand(setupDbUsageCommand())
+	cmd.AddCommand(setupDbBackupCommand())
+	cmd.AddCommand(setupDbRestoreCommand())
+	cmd.AddCommand(setupDbScrubCommand())
+	cmd.AddCommand(setupDbAliasCommand())
+	cmd.AddCommand(setupDbLineageCommand())
+	return cmd
+}
@@ -113,6 +113,7 @@ func initFheos() (*precompiles.TxParams, error) {
 		GetBlockHash:    vm.GetHashFunc(nil),
 		BlockNumber:     nil,
 		ParallelTxHooks: nil,
+		SyncExecution:   true,
 	}
 
 	return &tp, err
@@ -233,6 +234,36 @@ func main() {
 		},
 	}
 
+	var dryRun bool
+	var migrate = &cobra.Command{
+		Use:   "migrate",
+		Short: "Migrate the fheos db to the current version",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			report, err := precompiles.MigrateStorage(dryRun)
+			if err != nil {
+				return err
+			}
+
+			if report.From == 0 {
+				fmt.Printf("New db, nothing to migrate (version %d)\n", report.To)
+				return nil
+			}
+
+			verb := "Applied"
+			if report.DryRun {
+				verb = "Would apply"
+			}
+			fmt.Printf("%s %d migrations from version %d to %d\n", verb, len(report.Applied), report.From, report.To)
+			for _, step := range report.Applied {
+				fmt.Printf("  %d: %s\n", step.Version, step.Description)
+			}
+			return nil
+		},
+	}
+	migrate.Flags().BoolVar(&dryRun, "dry-run", false, "only print the migrations that would run")
+
+	var db = setupDbCommand()
+
 	var add = setupOperationCommand("add", "add two numbers", precompiles.Add)
 	var sub = setupOperationCommand("sub", "subtract two numbers", precompiles.Sub)
 	var lte = setupOperationCommand("lte", "lte two numbers", precompiles.Lte)
@@ -254,7 +285,7 @@ func main() {
 	var rol = setupOperationCommand("rol", "ror two numbers", precompiles.Rol)
 	var ror = setupOperationCommand("ror", "rol two numbers", precompiles.Rol)
 
-	rootCmd.AddCommand(initDb, initState, add, sub, lte, sub, mul, lt, div, gt, gte, rem, and, or, xor, eq, ne, min, max, shl, shr, rol, ror)
+	rootCmd.AddCommand(initDb, initState, migrate, db, add, sub, lte, sub, mul, lt, div, gt, gte, rem, and, or, xor, eq, ne, min, max, shl, shr, rol, ror)
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -1,8 +1,14 @@
 package hooks
 
 import (
+	"sync"
+
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/log"
+	fheos "github.com/fhenixprotocol/fheos/precompiles"
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+	storage2 "github.com/fhenixprotocol/fheos/storage"
 )
 
 type FheOSHooks interface {
@@ -15,8 +21,31 @@ type FheOSHooks interface {
 	ContractCallReturn(isSimulation bool, callType int, caller common.Address, addr common.Address, output []byte)
 }
 
+type storageSlot struct {
+	contract common.Address
+	loc      [32]byte
+}
+
+// slotChange is the committed value of a storage slot, and the latest value written to it during the tx
+type slotChange struct {
+	original types.Hash
+	latest   types.Hash
+}
+
 type FheOSHooksImpl struct {
 	evm *vm.EVM
+	// state is the fheos state of the chain, the global fheos.State is used when it's nil
+	state       *fheos.FheosState
+	slotChanges map[storageSlot]*slotChange
+	lock        sync.Mutex
+}
+
+func (h *FheOSHooksImpl) fheosState() *fheos.FheosState {
+	if h.state != nil {
+		return h.state
+	}
+
+	return fheos.State
 }
 
 // StoreCiphertextHook The purpose of this hook is to mark the ciphertext as LTS if the tx is successful and update reference counts
@@ -24,7 +53,19 @@ type FheOSHooksImpl struct {
 // loc - the location (starting from 0) in the storage of the contract
 // committed - The previous value (ct hash) that was present in the said location
 // val - The new value that is being stored
-func (h *FheOSHooksImpl) StoreCiphertextHook(_ common.Address, _ [32]byte, _ common.Hash, _ [32]byte) error {
+// The changes are only recorded here, reference counts are updated in EvmCallEnd once we know the tx succeeded
+func (h *FheOSHooksImpl) StoreCiphertextHook(contract common.Address, loc [32]byte, committed common.Hash, val [32]byte) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	slot := storageSlot{contract: contract, loc: loc}
+	change, ok := h.slotChanges[slot]
+	if !ok {
+		change = &slotChange{original: types.Hash(committed)}
+		h.slotChanges[slot] = change
+	}
+	change.latest = types.Hash(val)
+
 	return nil
 }
 
@@ -46,7 +87,96 @@ func (h *FheOSHooksImpl) EvmCallStart() {
 	// But how do we know how to keep the context thread safe? Ugh, do we need 2 dbs now?
 }
 
+// EvmCallEnd The purpose of this hook is to end the tx-scoped ciphertext layer - ciphertexts created during a successful,
+// committed tx are flushed to the fheos db, while those of reverted txs, queries and gas estimations are dropped
 func (h *FheOSHooksImpl) EvmCallEnd(evmSuccess bool) {
+	state := h.fheosState()
+	if h.evm == nil || h.evm.CiphertextDb == nil || state == nil {
+		return
+	}
+
+	h.lock.Lock()
+	slotChanges := h.slotChanges
+	h.slotChanges = make(map[storageSlot]*slotChange)
+	h.lock.Unlock()
+
+	storage := storage2.NewMultiStore(h.evm.CiphertextDb, &state.Storage)
+	if evmSuccess && h.evm.Commit && !h.evm.GasEstimation && !h.evm.EthCall {
+		committed, err := storage.Commit()
+		if err != nil {
+			log.Error("failed to commit tx ciphertexts to fheos db", "err", err)
+		}
+
+		h.updateRefCounts(state, committed, slotChanges)
+		h.updateZoneCharges(committed, slotChanges)
+		return
+	}
+
+	if err := storage.Discard(); err != nil {
+		log.Error("failed to discard tx ciphertexts", "err", err)
+	}
+}
+
+func (h *FheOSHooksImpl) updateRefCounts(state *fheos.FheosState, committed []types.Hash, slotChanges map[storageSlot]*slotChange) {
+	var block uint64
+	if h.evm.Context.BlockNumber != nil {
+		block = h.evm.Context.BlockNumber.Uint64()
+	}
+
+	store := &state.Storage
+	if err := store.RecordBlock(block, h.evm.Context.GetHash); err != nil {
+		log.Error("failed to record block for reference counts", "err", err)
+	}
+
+	for _, hash := range committed {
+		if err := store.TrackCt(hash, block); err != nil {
+			log.Error("failed to track ciphertext reference count", "err", err)
+		}
+	}
+
+	for _, change := range slotChanges {
+		if change.original == change.latest {
+			continue
+		}
+
+		if change.latest != (types.Hash{}) {
+			if err := store.UpdateRefCount(change.latest, 1, block); err != nil {
+				log.Error("failed to increment ciphertext reference count", "err", err)
+			}
+		}
+
+		if change.original != (types.Hash{}) {
+			if err := store.UpdateRefCount(change.original, -1, block); err != nil {
+				log.Error("failed to decrement ciphertext reference count", "err", err)
+			}
+		}
+	}
+
+	if state.Collector != nil {
+		state.Collector.SetHead(block)
+	}
+}
+
+// updateZoneCharges refunds the quota charges of the ciphertexts the tx left unreferenced
+func (h *FheOSHooksImpl) updateZoneCharges(committed []types.Hash, slotChanges map[storageSlot]*slotChange) {
+	if h.evm.StateDB == nil {
+		return
+	}
+
+	var referenced, dereferenced []types.Hash
+	for _, change := range slotChanges {
+		if change.original == change.latest {
+			continue
+		}
+		if change.latest != (types.Hash{}) {
+			referenced = append(referenced, change.latest)
+		}
+		if change.original != (types.Hash{}) {
+			dereferenced = append(dereferenced, change.original)
+		}
+	}
+
+	fheos.UpdateZoneCharges(h.evm.StateDB, committed, referenced, dereferenced)
 }
 
 // ContractCall The purpose of this hook is to be able to pass ownership for a ciphertext to the contract that has been called if the caller is an owner
@@ -58,7 +188,14 @@ func (h *FheOSHooksImpl) ContractCallReturn(isSimulation bool, callType int, cal
 }
 
 func NewFheOSHooks(evm *vm.EVM) *FheOSHooksImpl {
+	return NewFheOSHooksWithState(evm, nil)
+}
+
+// NewFheOSHooksWithState creates hooks for a chain with its own fheos state
+func NewFheOSHooksWithState(evm *vm.EVM, state *fheos.FheosState) *FheOSHooksImpl {
 	return &FheOSHooksImpl{
-		evm: evm,
+		evm:         evm,
+		state:       state,
+		slotChanges: make(map[storageSlot]*slotChange),
 	}
 }
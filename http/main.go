@@ -18,7 +18,6 @@ import (
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/vm"
-	"github.com/ethereum/go-ethereum/ethdb/memorydb"
 	"github.com/fhenixprotocol/fheos/precompiles"
 	fhedriver "github.com/fhenixprotocol/warp-drive/fhe-driver"
 )
@@ -333,7 +332,7 @@ func initFheos(configDir string) (*precompiles.TxParams, error) {
 		Commit:          true,
 		GasEstimation:   false,
 		EthCall:         false,
-		CiphertextDb:    memorydb.New(),
+		CiphertextDb:    nil, // there is no tx to commit in the coprocessor, so ciphertexts go straight to the fheos db
 		ContractAddress: common.HexToAddress("0x0000000000000000000000000000000000000000"),
 		GetBlockHash:    vm.GetHashFunc(nil),
 		BlockNumber:     nil,
@@ -786,12 +785,132 @@ func GetCTHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	content, placeholders, err := precompiles.GetAliases(hash, &tp)
+	if err != nil {
+		e := fmt.Sprintf("Failed to get aliases: %+v", err)
+		fmt.Println(e)
+		http.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
 	response := GetCTResponse{
 		Data:         hex.EncodeToString(ct.Data),
 		SecurityZone: uint8(ct.SecurityZone),
 		UintType:     uint8(ct.Properties.EncryptionType),
 		Compact:      ct.Properties.Compact,
 		Gzipped:      ct.Properties.Gzipped,
+		ContentHash:  hex.EncodeToString(content[:]),
+		Aliases:      make([]string, 0, len(placeholders)),
+	}
+	for _, placeholder := range placeholders {
+		response.Aliases = append(response.Aliases, hex.EncodeToString(placeholder[:]))
+	}
+
+	responseData, err := json.Marshal(response)
+	if err != nil {
+		e := fmt.Sprintf("Failed to marshal response: %+v", err)
+		fmt.Println(e)
+		http.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseData)
+}
+
+func UsageHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Got a usage request from %s\n", r.RemoteAddr)
+
+	usage, err := precompiles.GetUsage(&tp)
+	if err != nil {
+		e := fmt.Sprintf("Failed to get storage usage: %+v", err)
+		fmt.Println(e)
+		http.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	response := UsageResponse{
+		Usage:  make([]UsageEntry, 0, len(usage)),
+		Quotas: map[string]uint64{},
+	}
+	for _, u := range usage {
+		response.Usage = append(response.Usage, UsageEntry{
+			SecurityZone: u.SecurityZone,
+			UintType:     uint8(u.UintType),
+			Count:        u.Count,
+			Bytes:        u.Bytes,
+			Placeholders: u.Placeholders,
+		})
+	}
+	for zone, quota := range precompiles.GetZoneQuotas(&tp) {
+		response.Quotas[strconv.Itoa(int(zone))] = quota
+	}
+
+	responseData, err := json.Marshal(response)
+	if err != nil {
+		e := fmt.Sprintf("Failed to marshal response: %+v", err)
+		fmt.Println(e)
+		http.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseData)
+}
+
+// LineageHandler responds with the ancestry graph of a ciphertext, built from the provenance records of its inputs
+func LineageHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Got a lineage request from %s\n", r.RemoteAddr)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req LineageRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		fmt.Printf("Failed unmarshaling request: %+v body is %+v\n", err, string(body))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hash, err := hex.DecodeString(hexOnly(req.Hash))
+	if err != nil || len(hash) != 32 {
+		e := fmt.Sprintf("Invalid hash: %s", req.Hash)
+		fmt.Println(e)
+		http.Error(w, e, http.StatusBadRequest)
+		return
+	}
+
+	lineage, err := precompiles.GetLineage(hash, req.Depth, &tp)
+	if err != nil {
+		e := fmt.Sprintf("Failed to get lineage: %+v", err)
+		fmt.Println(e)
+		http.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	response := LineageResponse{
+		Root:      hex.EncodeToString(lineage.Root[:]),
+		Nodes:     make([]LineageNode, 0, len(lineage.Nodes)),
+		Truncated: lineage.Truncated,
+	}
+	for _, node := range lineage.Nodes {
+		entry := LineageNode{
+			Hash:  hex.EncodeToString(node.Hash[:]),
+			Depth: node.Depth,
+		}
+		if p := node.Provenance; p != nil {
+			entry.Operation = p.Operation.String()
+			entry.Contract = p.Contract.Hex()
+			entry.TxHash = p.TxHash.Hex()
+			entry.BlockNumber = p.BlockNumber
+			entry.CreatedAt = p.CreatedAt.UTC().Format(time.RFC3339Nano)
+			for _, input := range p.Inputs {
+				entry.Inputs = append(entry.Inputs, hex.EncodeToString(input[:]))
+			}
+		}
+		response.Nodes = append(response.Nodes, entry)
 	}
 
 	responseData, err := json.Marshal(response)
@@ -806,6 +925,47 @@ func GetCTHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(responseData)
 }
 
+// BackupHandler writes a checkpoint of the fheos db to a directory on this node and responds with its manifest
+func BackupHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Got a backup request from %s\n", r.RemoteAddr)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req BackupRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		fmt.Printf("Failed unmarshaling request: %+v body is %+v\n", err, string(body))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Dir == "" {
+		http.Error(w, "Backup directory is required", http.StatusBadRequest)
+		return
+	}
+
+	manifest, err := precompiles.BackupStorage(req.Dir, &tp)
+	if err != nil {
+		e := fmt.Sprintf("Backup failed: %+v", err)
+		fmt.Println(e)
+		http.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	responseData, err := json.Marshal(manifest)
+	if err != nil {
+		e := fmt.Sprintf("Failed to marshal response: %+v", err)
+		fmt.Println(e)
+		http.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseData)
+}
+
 func main() {
 	configDir := flag.String("config-dir", "", "Path to config directory")
 	flag.Parse()
@@ -836,11 +996,14 @@ func main() {
 	privateMux.HandleFunc("/StoreCts", StoreCtsHandler)
 	privateMux.HandleFunc("/TrivialEncrypt", TrivialEncryptHandler)
 	privateMux.HandleFunc("/Cast", CastHandler)
+	privateMux.HandleFunc("/Backup", BackupHandler)
 
 	// Public endpoints on port 8448
 	publicMux.HandleFunc("/GetNetworkPublicKey", GetNetworkPublicKeyHandler)
 	publicMux.HandleFunc("/GetCrs", GetCrsHandler)
 	publicMux.HandleFunc("/GetCT", GetCTHandler)
+	publicMux.HandleFunc("/Usage", UsageHandler)
+	publicMux.HandleFunc("/Lineage", LineageHandler)
 	publicMux.HandleFunc("/Health", HealthHandler)
 
 	// Wrap both muxes in the CORS middleware
@@ -56,3 +56,13 @@ type GetCrsRequest struct {
 type GetCTRequest struct {
 	Hash string `json:"hash"`
 }
+
+type LineageRequest struct {
+	Hash string `json:"hash"`
+	// Depth is how many operations back to follow the inputs, the node's default is used when it is zero
+	Depth int `json:"depth"`
+}
+
+type BackupRequest struct {
+	Dir string `json:"dir"`
+}
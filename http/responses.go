@@ -28,4 +28,37 @@ type GetCTResponse struct {
 	UintType     uint8  `json:"uint_type"`
 	Compact      bool   `json:"compact"`
 	Gzipped      bool   `json:"gzipped"`
+	// ContentHash is the hash the payload is stored under, which differs from the requested hash for placeholders
+	ContentHash string   `json:"content_hash"`
+	Aliases     []string `json:"aliases"`
+}
+
+type UsageEntry struct {
+	SecurityZone int32  `json:"security_zone"`
+	UintType     uint8  `json:"uint_type"`
+	Count        uint64 `json:"count"`
+	Bytes        uint64 `json:"bytes"`
+	Placeholders uint64 `json:"placeholders"`
+}
+
+type UsageResponse struct {
+	Usage  []UsageEntry      `json:"usage"`
+	Quotas map[string]uint64 `json:"quotas"`
+}
+
+type LineageNode struct {
+	Hash        string   `json:"hash"`
+	Depth       int      `json:"depth"`
+	Operation   string   `json:"operation,omitempty"`
+	Inputs      []string `json:"inputs,omitempty"`
+	Contract    string   `json:"contract,omitempty"`
+	TxHash      string   `json:"tx_hash,omitempty"`
+	BlockNumber uint64   `json:"block_number,omitempty"`
+	CreatedAt   string   `json:"created_at,omitempty"`
+}
+
+type LineageResponse struct {
+	Root      string        `json:"root"`
+	Nodes     []LineageNode `json:"nodes"`
+	Truncated bool          `json:"truncated"`
 }
@@ -66,9 +66,18 @@ func StoreCt(utype byte, input []byte, securityZone int32, tp *TxParams, _ *Call
 	}
 
 	gas := getGasForPrecompile(functionName, uintType)
+
+	// The verifier calculates the hash of the input and sends it to cofhe.js
+	// We want to have the same algorithm here
+	// Note: Integration part with the verifier
+	inputHash := Keccak256(input)
+	hash := adjustHashForMetadata(inputHash[:], utype, securityZone, false)
+	if hash == nil {
+		return nil, 0, vm.ErrExecutionReverted
+	}
+
 	if tp.GasEstimation {
-		randomHash := State.GetEmptyKeyForGasEstimation()
-		return randomHash[:], gas, nil
+		return hash, gas, nil
 	}
 
 	ct := fhe.NewFheEncryptedFromBytes(
@@ -79,28 +88,25 @@ func StoreCt(utype byte, input []byte, securityZone int32, tp *TxParams, _ *Call
 		securityZone,
 		false,
 	)
-
-	// The verifier calculates the hash of the input and sends it to cofhe.js
-	// We want to have the same algorithm here
-	// Note: Integration part with the verifier
-	inputHash := Keccak256(input)
-	hash := adjustHashForMetadata(inputHash[:], utype, securityZone, false)
-	if hash == nil {
-		return nil, 0, vm.ErrExecutionReverted
-	}
 	copy(ct.Key.Hash[:], hash)
 
 	if shouldPrintPrecompileInfo(tp) {
 		logger.Info("Starting new precompiled contract function: " + functionName.String())
 	}
 
-	storage := storage2.NewMultiStore(tp.CiphertextDb, &State.Storage)
+	storage := storage2.NewMultiStore(tp.CiphertextDb, &tp.state().Storage)
+
+	if err := chargeZoneQuota(tp, storage, securityZone, types.Hash(ct.Key.Hash), uint64(len(input))); err != nil {
+		logger.Error(functionName.String()+" failed", "err", err)
+		return nil, 0, vm.ErrExecutionReverted
+	}
 
 	err := storeCiphertext(storage, &ct)
 	if err != nil {
 		logger.Error(functionName.String()+" failed", "err", err)
 		return nil, 0, vm.ErrExecutionReverted
 	}
+	recordProvenance(storage, tp, functionName, ct.Key.Hash)
 	logger.Debug(functionName.String()+" success", "contractAddress", tp.ContractAddress, "ctHash", ct.GetHash().Hex())
 
 	retValue := ct.GetKey().Hash
@@ -128,7 +134,19 @@ func SealOutput(utype byte, inputBz []byte, pk []byte, tp *TxParams, onResultCal
 	//}
 
 	if !tp.GasEstimation {
-		storage := storage2.NewMultiStore(tp.CiphertextDb, &State.Storage)
+		// An existing result is returned in every mode of execution, like Require does
+		key := genSealedKey(input.Hash[:], pk, functionName)
+		record, exists := tp.state().DecryptResults.Get(key)
+		if value, ok := record.Value.(string); exists && ok {
+			logger.Debug("found existing sealed output, returning..", "hash", input.Hash.Hex())
+			notifyExistingResult(tp, key)
+			return value, gas, nil
+		}
+
+		storage := storage2.NewMultiStore(tp.CiphertextDb, &tp.state().Storage)
+		if isTx(tp) {
+			return sealOutputInTx(storage, input, key, exists, pk, gas, tp, onResultCallback)
+		}
 		if onResultCallback == nil {
 			sealed, err := SealOutputHelper(storage, input.Hash, pk, tp, 0, "")
 			return sealed, gas, err
@@ -150,7 +168,48 @@ func SealOutput(utype byte, inputBz []byte, pk []byte, tp *TxParams, onResultCal
 		logger.Debug(functionName.String()+" success", "contractAddress", tp.ContractAddress, "ctHash", hex.EncodeToString(input.Hash[:]))
 	}
 
-	return "0x" + strings.Repeat("00", 370), gas, nil
+	return sealOutputPlaceholder, gas, nil
+}
+
+// sealOutputPlaceholder is returned by SealOutput while the sealed output isn't known yet
+var sealOutputPlaceholder = "0x" + strings.Repeat("00", 370)
+
+// sealOutputInTx starts sealing input for pk through the parallel tx hooks, for a tx whose result of key isn't known
+// yet, and returns sealOutputPlaceholder. Followers revert instead, see requireParallelHooks
+func sealOutputInTx(storage *storage2.MultiStore, input fhe.CiphertextKey, key types.PendingDecryption, exists bool, pk []byte, gas uint64, tp *TxParams, onResultCallback *SealOutputCallbackFunc) (string, uint64, error) {
+	functionName := types.SealOutput
+	if err := requireParallelHooks(tp, key); err != nil {
+		return "", 0, err
+	}
+
+	ct := awaitCtResult(storage, input.Hash, tp)
+	if ct == nil {
+		logger.Error(functionName.String()+" unverified ciphertext handle", "input", input.Hash.Hex())
+		return "", 0, vm.ErrExecutionReverted
+	}
+
+	pkCopy := CopySlice(pk)
+	startParallelDecryption(tp, key, exists, func() (any, error) {
+		var chainId uint64
+		var transactionHash string
+		if onResultCallback != nil {
+			chainId, transactionHash = onResultCallback.ChainId, onResultCallback.TransactionHash
+		}
+
+		sealed, err := withEngine(func() ([]byte, error) {
+			return fhe.SealOutput(*ct, pkCopy, chainId, transactionHash)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if onResultCallback != nil {
+			onResultCallback.Callback(onResultCallback.CallbackUrl, input.Hash[:], pkCopy, string(sealed), transactionHash, chainId)
+		}
+		return string(sealed), nil
+	})
+
+	logger.Debug(functionName.String()+" started", "contractAddress", tp.ContractAddress, "ctHash", input.Hash.Hex())
+	return sealOutputPlaceholder, gas, nil
 }
 
 func Decrypt(utype byte, inputBz []byte, defaultValue *big.Int, tp *TxParams, onResultCallback *DecryptCallbackFunc) (*big.Int, uint64, error) {
@@ -169,7 +228,22 @@ func Decrypt(utype byte, inputBz []byte, defaultValue *big.Int, tp *TxParams, on
 	//}
 
 	if !tp.GasEstimation {
-		storage := storage2.NewMultiStore(tp.CiphertextDb, &State.Storage)
+		// Resolved results are looked up first, so that followers use the value the sequencer included
+		key := types.PendingDecryption{
+			Hash: input.Hash,
+			Type: functionName,
+		}
+		record, exists := tp.state().DecryptResults.Get(key)
+		if value, ok := record.Value.(*big.Int); exists && ok {
+			logger.Debug("found existing decryption result, returning..", "hash", input.Hash.Hex())
+			notifyExistingResult(tp, key)
+			return value, gas, nil
+		}
+
+		storage := storage2.NewMultiStore(tp.CiphertextDb, &tp.state().Storage)
+		if isTx(tp) {
+			return decryptInTx(storage, input, key, exists, defaultValue, gas, tp, onResultCallback)
+		}
 		if onResultCallback == nil {
 			plaintext, err := DecryptHelper(storage, input.Hash, tp, defaultValue, 0, "")
 			return plaintext, gas, err
@@ -193,6 +267,43 @@ func Decrypt(utype byte, inputBz []byte, defaultValue *big.Int, tp *TxParams, on
 	return defaultValue, gas, nil
 }
 
+// decryptInTx starts decrypting input through the parallel tx hooks, for a tx whose result of key isn't known yet, and
+// returns defaultValue. Followers revert instead, see requireParallelHooks
+func decryptInTx(storage *storage2.MultiStore, input fhe.CiphertextKey, key types.PendingDecryption, exists bool, defaultValue *big.Int, gas uint64, tp *TxParams, onResultCallback *DecryptCallbackFunc) (*big.Int, uint64, error) {
+	functionName := types.Decrypt
+	if err := requireParallelHooks(tp, key); err != nil {
+		return nil, 0, err
+	}
+
+	ct := awaitCtResult(storage, input.Hash, tp)
+	if ct == nil {
+		logger.Error(functionName.String()+" unverified ciphertext handle", "input", input.Hash.Hex())
+		return nil, 0, vm.ErrExecutionReverted
+	}
+
+	startParallelDecryption(tp, key, exists, func() (any, error) {
+		var chainId uint64
+		var transactionHash string
+		if onResultCallback != nil {
+			chainId, transactionHash = onResultCallback.ChainId, onResultCallback.TransactionHash
+		}
+
+		plaintext, err := withEngine(func() (*big.Int, error) {
+			return fhe.Decrypt(*ct, chainId, transactionHash)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if onResultCallback != nil {
+			onResultCallback.Callback(onResultCallback.CallbackUrl, input.Hash[:], plaintext, transactionHash, chainId)
+		}
+		return plaintext, nil
+	})
+
+	logger.Debug(functionName.String()+" started", "contractAddress", tp.ContractAddress, "input", input.Hash.Hex())
+	return defaultValue, gas, nil
+}
+
 func Lte(utype byte, lhsHash []byte, rhsHash []byte, tp *TxParams, callback *CallbackFunc) ([]byte, uint64, error) {
 	//solgen: return ebool
 	functionName := types.Lte
@@ -280,7 +391,7 @@ func Req(utype byte, input []byte, tp *TxParams, _ *CallbackFunc) ([]byte, uint6
 	if shouldPrintPrecompileInfo(tp) {
 		logger.Info("Starting new precompiled contract function: " + functionName.String())
 	}
-	storage := storage2.NewMultiStore(tp.CiphertextDb, &State.Storage)
+	storage := storage2.NewMultiStore(tp.CiphertextDb, &tp.state().Storage)
 	uintType := fhe.EncryptionType(utype)
 	if !types.IsValidType(uintType) {
 		logger.Error("invalid ciphertext", "type", utype)
@@ -310,14 +421,11 @@ func Req(utype byte, input []byte, tp *TxParams, _ *CallbackFunc) ([]byte, uint6
 		Hash: ctHash,
 		Type: functionName,
 	}
-	record, exists := State.DecryptResults.Get(key)
+	record, exists := tp.state().DecryptResults.Get(key)
 	if value, ok := record.Value.(bool); exists && ok {
 		logger.Debug("found existing decryption result, returning..", "value", value)
 
-		// Only the sequencer need to know about this to include in the L1 message
-		if tp.ParallelTxHooks != nil {
-			tp.ParallelTxHooks.NotifyExistingRes(&key)
-		}
+		notifyExistingResult(tp, key)
 
 		if !value {
 			return nil, gas, vm.ErrExecutionReverted
@@ -345,34 +453,15 @@ func Req(utype byte, input []byte, tp *TxParams, _ *CallbackFunc) ([]byte, uint6
 				return nil, gas, vm.ErrExecutionReverted
 			}
 			return nil, gas, nil
-		} else if tp.ParallelTxHooks == nil {
-			logger.Error("no decryption result found and no parallel tx hooks were set")
-			return nil, 0, vm.ErrExecutionReverted
+		} else if err := requireParallelHooks(tp, key); err != nil {
+			return nil, 0, err
 		}
 
-		tp.ParallelTxHooks.NotifyCt(&key)
-
-		if !exists {
-			State.DecryptResults.CreateEmptyRecord(key)
-		}
-
-		go func() {
-			logger.Debug("evaluating require condition", "hash", ctHash)
+		startParallelDecryption(tp, key, exists, func() (any, error) {
 			result, err := evaluateRequire(ct)
-			if err != nil {
-				msg := functionName.String() + " error on evaluation"
-				logger.Error(msg, " err ", err)
-				return
-			}
-
 			logger.Debug("require condition result", "hash", ctHash, "value", result)
-			err = State.DecryptResults.SetValue(key, result)
-			if err != nil {
-				logger.Error("failed setting require result", "error", err)
-				return
-			}
-			tp.ParallelTxHooks.NotifyDecryptRes(&key)
-		}()
+			return result, err
+		})
 
 		logger.Debug(functionName.String()+" success", "contractAddress", tp.ContractAddress, "input", hex.EncodeToString(input))
 
@@ -396,10 +485,6 @@ func Cast(utype byte, input []byte, toType byte, tp *TxParams, callback *Callbac
 
 	castToType := fhe.EncryptionType(toType)
 	gas := getGasForPrecompile(functionName, castToType)
-	if tp.GasEstimation {
-		randomHash := State.GetEmptyKeyForGasEstimation()
-		return randomHash[:], gas, nil
-	}
 
 	keys, err := SolidityInputsToCiphertextKeys(input)
 	if err != nil {
@@ -413,16 +498,21 @@ func Cast(utype byte, input []byte, toType byte, tp *TxParams, callback *Callbac
 		return nil, 0, vm.ErrExecutionReverted
 	}
 
+	if tp.GasEstimation {
+		return fhe.SerializeCiphertextKey(placeholderCt.Key), gas, nil
+	}
+
 	if shouldPrintPrecompileInfo(tp) {
 		logger.Debug("fn", functionName.String(), "Storing async ciphertext", "placeholderKey", hex.EncodeToString(placeholderCt.Key.Hash[:]))
 	}
 
-	storage := storage2.NewMultiStore(tp.CiphertextDb, &State.Storage)
+	storage := storage2.NewMultiStore(tp.CiphertextDb, &tp.state().Storage)
 	err = storeCiphertext(storage, placeholderCt)
 	if err != nil {
 		logger.Error(functionName.String()+" failed to store async ciphertext", "err", err)
 		return nil, 0, vm.ErrExecutionReverted
 	}
+	recordProvenance(storage, tp, functionName, placeholderCt.Key.Hash, keys[0])
 	logger.Info(functionName.String(), "stored async ciphertext", "placeholderKey", hex.EncodeToString(placeholderCt.Key.Hash[:]))
 
 	if shouldPrintPrecompileInfo(tp) {
@@ -432,8 +522,7 @@ func Cast(utype byte, input []byte, toType byte, tp *TxParams, callback *Callbac
 	keyCopy := keys[0]
 	placeholderKeyCopy := placeholderCt.Key
 
-	go func(inputKey, placeholderKey fhe.CiphertextKey, toType byte) {
-		ctReady := false
+	evaluate := func(inputKey, placeholderKey fhe.CiphertextKey, toType byte) (ctReady bool) {
 		defer func() {
 			if !ctReady {
 				logger.Error(functionName.String() + ": failed, deleting placeholder ciphertext " + hex.EncodeToString(placeholderKey.Hash[:]))
@@ -441,12 +530,14 @@ func Cast(utype byte, input []byte, toType byte, tp *TxParams, callback *Callbac
 			}
 		}()
 		ct, err := blockUntilInputsAvailable(storage, tp, inputKey)
-		input := ct[0]
 		if err != nil {
 			logger.Error(functionName.String()+": input not verified, len: ", len(inputKey.Hash), " err: ", err)
 			return
 		}
-		result, err := input.Cast(castToType)
+		input := ct[0]
+		result, err := withEngineRetry(functionName, func() (*fhe.FheEncrypted, error) {
+			return input.Cast(castToType)
+		})
 		if err != nil {
 			logger.Error("failed to cast to type "+UtypeToString(toType), " err ", err)
 			return
@@ -457,7 +548,7 @@ func Cast(utype byte, input []byte, toType byte, tp *TxParams, callback *Callbac
 			return
 		}
 		result.Key = placeholderKey
-		err = storeCiphertext(storage, result)
+		err = storeResult(storage, result, realResultHash)
 		if err != nil {
 			logger.Error(functionName.String()+" failed to store result", "err", err)
 			return
@@ -469,7 +560,16 @@ func Cast(utype byte, input []byte, toType byte, tp *TxParams, callback *Callbac
 			(*callback).Callback(url, placeholderKeyCopy.Hash[:], realResultHash)
 		}
 		logger.Info(functionName.String()+" success", "contractAddress", tp.ContractAddress, "input", hex.EncodeToString(inputKey.Hash[:]), "result", hex.EncodeToString(realResultHash))
-	}(keyCopy, placeholderKeyCopy, toType)
+		return ctReady
+	}
+
+	if isSyncExecution(tp) {
+		if !evaluate(keyCopy, placeholderKeyCopy, toType) {
+			return nil, 0, vm.ErrExecutionReverted
+		}
+	} else {
+		go evaluate(keyCopy, placeholderKeyCopy, toType)
+	}
 
 	return fhe.SerializeCiphertextKey(placeholderCt.Key), gas, nil
 }
@@ -480,7 +580,7 @@ func Cast(utype byte, input []byte, toType byte, tp *TxParams, callback *Callbac
 func TrivialEncrypt(input []byte, toType byte, securityZone int32, tp *TxParams, callback *CallbackFunc) ([]byte, uint64, error) {
 	functionName := types.TrivialEncrypt
 
-	storage := storage2.NewMultiStore(tp.CiphertextDb, &State.Storage)
+	storage := storage2.NewMultiStore(tp.CiphertextDb, &tp.state().Storage)
 
 	uintType := fhe.EncryptionType(toType)
 	if !types.IsValidType(uintType) {
@@ -489,18 +589,13 @@ func TrivialEncrypt(input []byte, toType byte, securityZone int32, tp *TxParams,
 	}
 
 	gas := getGasForPrecompile(functionName, uintType)
-	if tp.GasEstimation {
-		randomHash := State.GetEmptyKeyForGasEstimation()
-		return randomHash[:], gas, nil
-	}
 
 	placeholderCt, err := createPlaceholder(toType, securityZone, functionName, input, ByteToUint256(toType), Int32ToUint256(securityZone))
-	placeholderCt.Key.IsTriviallyEncrypted = true
-
 	if err != nil {
 		logger.Error(functionName.String()+" failed to create placeholder", "err", err)
 		return nil, 0, vm.ErrExecutionReverted
 	}
+	placeholderCt.Key.IsTriviallyEncrypted = true
 
 	// Check if value is not overflowing the type
 	maxOfType := fhe.MaxOfType(uintType)
@@ -517,21 +612,31 @@ func TrivialEncrypt(input []byte, toType byte, securityZone int32, tp *TxParams,
 		return nil, gas, vm.ErrExecutionReverted
 	}
 
+	if tp.GasEstimation {
+		return fhe.SerializeCiphertextKey(placeholderCt.Key), gas, nil
+	}
+
 	if shouldPrintPrecompileInfo(tp) {
 		logger.Info("Starting new precompiled contract function: " + functionName.String())
 	}
 
+	// The size of the result isn't known until it is encrypted, so only a zone that is already full is refused
+	if err := chargeZoneQuota(tp, storage, securityZone, types.Hash(placeholderCt.Key.Hash), 0); err != nil {
+		logger.Error(functionName.String()+" failed", "err", err)
+		return nil, gas, vm.ErrExecutionReverted
+	}
+
 	err = storeCiphertext(storage, placeholderCt)
 	if err != nil {
 		logger.Error(functionName.String()+" failed to store async ciphertext", "err", err)
 		return nil, 0, vm.ErrExecutionReverted
 	}
+	recordProvenance(storage, tp, functionName, placeholderCt.Key.Hash)
 	logger.Info(functionName.String()+" stored async ciphertext", "placeholderKey", hex.EncodeToString(placeholderCt.Key.Hash[:]))
 
 	placeholderKeyCopy := placeholderCt.Key
 
-	go func(resultKey fhe.CiphertextKey, toType byte) {
-		ctReady := false
+	evaluate := func(resultKey fhe.CiphertextKey, toType byte) (ctReady bool) {
 		defer func() {
 			if !ctReady {
 				logger.Error(functionName.String() + ": failed, deleting placeholder ciphertext " + hex.EncodeToString(resultKey.Hash[:]))
@@ -540,7 +645,9 @@ func TrivialEncrypt(input []byte, toType byte, securityZone int32, tp *TxParams,
 		}()
 		// we encrypt this using the computation key not the public key. Also, compact to save space in case this gets saved directly
 		// to storage
-		result, err := fhe.EncryptPlainText(valueToEncrypt, uintType, securityZone)
+		result, err := withEngineRetry(functionName, func() (*fhe.FheEncrypted, error) {
+			return fhe.EncryptPlainText(valueToEncrypt, uintType, securityZone)
+		})
 		if err != nil {
 			logger.Error("failed to create trivial encrypted value")
 			return
@@ -553,7 +660,7 @@ func TrivialEncrypt(input []byte, toType byte, securityZone int32, tp *TxParams,
 		}
 		result.Key = resultKey
 
-		err = storeCiphertext(storage, result)
+		err = storeResult(storage, result, realResultHash)
 		if err != nil {
 			logger.Error(functionName.String()+" failed to store result", "err", err)
 			return
@@ -566,7 +673,16 @@ func TrivialEncrypt(input []byte, toType byte, securityZone int32, tp *TxParams,
 			(*callback).Callback(url, resultKey.Hash[:], realResultHash)
 		}
 		logger.Info(functionName.String()+" success", "contractAddress", tp.ContractAddress, "input", hex.EncodeToString(input), "result", hex.EncodeToString(realResultHash))
-	}(placeholderKeyCopy, toType)
+		return ctReady
+	}
+
+	if isSyncExecution(tp) {
+		if !evaluate(placeholderKeyCopy, toType) {
+			return nil, 0, vm.ErrExecutionReverted
+		}
+	} else {
+		go evaluate(placeholderKeyCopy, toType)
+	}
 
 	return fhe.SerializeCiphertextKey(placeholderCt.Key), gas, nil
 }
@@ -791,7 +907,7 @@ func Not(utype byte, value []byte, tp *TxParams, callback *CallbackFunc) ([]byte
 func Random(utype byte, seed uint64, securityZone int32, tp *TxParams, _ *CallbackFunc) ([]byte, uint64, error) {
 	functionName := types.Random
 
-	storage := storage2.NewMultiStore(tp.CiphertextDb, &State.Storage)
+	storage := storage2.NewMultiStore(tp.CiphertextDb, &tp.state().Storage)
 	uintType := fhe.EncryptionType(utype)
 	if !types.IsValidType(uintType) {
 		logger.Error("invalid random output type", "type", utype)
@@ -799,51 +915,80 @@ func Random(utype byte, seed uint64, securityZone int32, tp *TxParams, _ *Callba
 	}
 
 	gas := getGasForPrecompile(functionName, uintType)
-	if tp.GasEstimation {
-		randomHash := State.GetEmptyKeyForGasEstimation()
-		return randomHash[:], gas, nil
-	}
-
 	if shouldPrintPrecompileInfo(tp) {
 		logger.Info("Starting new precompiled contract function: " + functionName.String())
 	}
 
-	var finalSeed uint64
-	if seed != 0 {
-		finalSeed = seed
-	} else {
-		var randomCounter uint64
-		var hash common.Hash
-		if tp.Commit {
-			// We're incrementing before the request for the random number, so that queries
-			// that came before this Tx would have received a different seed.
-			randomCounter = State.IncRandomCounter()
-			hash = tp.TxContext.Hash
-		} else {
-			randomCounter = State.GetRandomCounter()
-			hash = tp.GetBlockHash(tp.BlockNumber.Uint64() - 1) // If no tx hash - use block hash
-		}
+	// The handle is derived from the seed rather than from the engine's result, so gas estimation can return the
+	// handle the tx will get without calling the engine, storing anything or consuming the counter
+	finalSeed := randomSeed(seed, tp, tp.GasEstimation)
+	key, err := randomKey(uintType, securityZone, finalSeed)
+	if err != nil {
+		logger.Error(functionName.String()+" failed", "err", err)
+		return nil, 0, vm.ErrExecutionReverted
+	}
 
-		finalSeed = GenerateSeedFromEntropy(tp.ContractAddress, hash, randomCounter)
+	if tp.GasEstimation {
+		return key.Hash[:], gas, nil
 	}
 
-	result, err := fhe.FheRandom(securityZone, uintType, finalSeed)
+	result, err := withEngine(func() (*fhe.FheEncrypted, error) {
+		return fhe.FheRandom(securityZone, uintType, finalSeed)
+	})
 	if err != nil {
 		logger.Error(functionName.String()+" failed", "err", err)
 		return nil, 0, vm.ErrExecutionReverted
 	}
+	result.Key = key
 
 	err = storeCiphertext(storage, result)
 	if err != nil {
 		logger.Error(functionName.String()+" failed", "err", err)
 		return nil, 0, vm.ErrExecutionReverted
 	}
+	recordProvenance(storage, tp, functionName, result.Key.Hash)
 
 	resultHash := result.GetHash()
 	logger.Debug(functionName.String()+" success", "contractAddress", tp.ContractAddress, "result", resultHash.Hex())
 	return resultHash[:], gas, nil
 }
 
+// randomKey returns the handle of the random ciphertext of type uintType generated from seed
+func randomKey(uintType fhe.EncryptionType, securityZone int32, seed uint64) (fhe.CiphertextKey, error) {
+	placeholderCt, err := createPlaceholder(byte(uintType), securityZone, types.Random, Uint64ToUint256(seed))
+	if err != nil {
+		return fhe.CiphertextKey{}, err
+	}
+
+	return placeholderCt.Key, nil
+}
+
+// randomSeed returns the seed of a Random call. Without an explicit seed it is derived from the contract, the tx and
+// the random counter - peek (gas estimation) returns the seed the tx would use without incrementing the counter
+func randomSeed(seed uint64, tp *TxParams, peek bool) uint64 {
+	if seed != 0 {
+		return seed
+	}
+
+	var randomCounter uint64
+	var hash common.Hash
+	switch {
+	case peek:
+		randomCounter = tp.state().GetRandomCounter() + 1
+		hash = tp.TxContext.Hash
+	case tp.Commit:
+		// We're incrementing before the request for the random number, so that queries
+		// that came before this Tx would have received a different seed.
+		randomCounter = tp.state().IncRandomCounter()
+		hash = tp.TxContext.Hash
+	default:
+		randomCounter = tp.state().GetRandomCounter()
+		hash = tp.GetBlockHash(tp.BlockNumber.Uint64() - 1) // If no tx hash - use block hash
+	}
+
+	return GenerateSeedFromEntropy(tp.ContractAddress, hash, randomCounter)
+}
+
 func GetNetworkPublicKey(securityZone int32, tp *TxParams) ([]byte, error) {
 	functionName := types.GetNetworkKey
 
@@ -851,7 +996,9 @@ func GetNetworkPublicKey(securityZone int32, tp *TxParams) ([]byte, error) {
 		logger.Info("Starting new precompiled contract function: " + functionName.String())
 	}
 
-	pk, err := fhe.PublicKey(securityZone)
+	pk, err := withEngine(func() ([]byte, error) {
+		return fhe.PublicKey(securityZone)
+	})
 	if err != nil {
 		logger.Error("could not get public key", "err", err, "securityZone", securityZone)
 		return nil, vm.ErrExecutionReverted
@@ -867,7 +1014,9 @@ func GetCrs(securityZone int32, tp *TxParams) ([]byte, error) {
 		logger.Info("Starting new precompiled contract function: " + functionName.String())
 	}
 
-	crs, err := fhe.GetCrs(securityZone)
+	crs, err := withEngine(func() ([]byte, error) {
+		return fhe.GetCrs(securityZone)
+	})
 	if err != nil {
 		logger.Error("could not get crs", "err", err, "securityZone", securityZone)
 		return nil, vm.ErrExecutionReverted
@@ -883,7 +1032,7 @@ func Square(utype byte, value []byte, tp *TxParams, callback *CallbackFunc) ([]b
 }
 
 func GetCT(hash []byte, tp *TxParams) (*bridge_types.FheEncrypted, error) {
-	storage := storage2.NewMultiStore(tp.CiphertextDb, &State.Storage)
+	storage := storage2.NewMultiStore(tp.CiphertextDb, &tp.state().Storage)
 	ctHash := fhe.Hash(hash)
 	ct, err := getCiphertext(storage, ctHash, true)
 	if err != nil {
@@ -894,10 +1043,53 @@ func GetCT(hash []byte, tp *TxParams) (*bridge_types.FheEncrypted, error) {
 		return nil, errors.New("ciphertext is a placeholder value")
 	}
 
-	bct, err := fhe.ExpandCompressedValue(ct)
+	bct, err := withEngine(func() (*bridge_types.FheEncrypted, error) {
+		return fhe.ExpandCompressedValue(ct)
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	return bct, nil
 }
+
+// GetAliases returns the content hash the ciphertext of hash (a placeholder or a content hash) is stored under, and
+// every placeholder that shares it
+func GetAliases(hash []byte, tp *TxParams) (types.Hash, []types.Hash, error) {
+	return tp.state().Storage.Aliases(types.Hash(fhe.Hash(hash)))
+}
+
+// DefaultLineageDepth is used when a lineage request doesn't ask for a depth, and MaxLineageDepth caps the ones that do.
+// Inputs are shared, so even a shallow graph can be wide: MaxLineageNodes caps the number of ciphertexts returned
+const (
+	DefaultLineageDepth = 16
+	MaxLineageDepth     = 256
+	MaxLineageNodes     = 1024
+)
+
+// GetLineage returns the ancestry graph of hash, up to depth operations back and MaxLineageNodes ciphertexts
+func GetLineage(hash []byte, depth int, tp *TxParams) (storage2.Lineage, error) {
+	if depth <= 0 {
+		depth = DefaultLineageDepth
+	}
+	if depth > MaxLineageDepth {
+		depth = MaxLineageDepth
+	}
+
+	return tp.state().Storage.Lineage(types.Hash(fhe.Hash(hash)), depth, MaxLineageNodes)
+}
+
+// GetUsage returns the usage counters of every security zone and type in the fheos db
+func GetUsage(tp *TxParams) ([]types.Usage, error) {
+	var usage []types.Usage
+	err := tp.state().Storage.IterateUsage(func(u types.Usage) bool {
+		usage = append(usage, u)
+		return true
+	})
+	return usage, err
+}
+
+// GetZoneQuotas returns the byte quota of every security zone that has one in FHEOS_ZONE_QUOTAS
+func GetZoneQuotas(tp *TxParams) map[int32]uint64 {
+	return tp.state().Quotas
+}
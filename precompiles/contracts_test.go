@@ -1,15 +1,19 @@
 package precompiles
 
 import (
+	"bytes"
 	"fmt"
 	"math/big"
 	"os"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+	storage2 "github.com/fhenixprotocol/fheos/storage"
 	fhedriver "github.com/fhenixprotocol/warp-drive/fhe-driver"
 	"github.com/stretchr/testify/assert"
 )
@@ -81,6 +85,7 @@ func init() {
 		GetBlockHash:    vm.GetHashFunc(nil),
 		BlockNumber:     nil,
 		ParallelTxHooks: nil,
+		SyncExecution:   true,
 	}
 }
 
@@ -532,3 +537,402 @@ func TestSelect(t *testing.T) {
 		expectPlaintext(t, ctResult, uintType, plaintextResult)
 	})
 }
+
+func TestGasEstimationHasNoSideEffects(t *testing.T) {
+	// A state of its own, so that no other test can have produced the results already
+	state, err := NewFheosState(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create fheos state: %v", err)
+	}
+	defer state.Close()
+
+	isolatedTp := tp
+	isolatedTp.FheosState = state
+	isolatedTp.CiphertextDb = memorydb.New()
+	estimationTp := isolatedTp
+	estimationTp.GasEstimation = true
+
+	has := func(handle []byte) bool {
+		key, err := fhedriver.DeserializeCiphertextKey(handle)
+		assert.NoError(t, err)
+		return storage2.NewMultiStore(isolatedTp.CiphertextDb, &state.Storage).Has(types.Hash(key.Hash))
+	}
+
+	uintType := uint8(fhedriver.Uint32)
+	lhs, _, err := TrivialEncrypt(big.NewInt(7).Bytes(), uintType, 0, &isolatedTp, nil)
+	assert.NoError(t, err)
+	rhs, _, err := TrivialEncrypt(big.NewInt(8).Bytes(), uintType, 0, &isolatedTp, nil)
+	assert.NoError(t, err)
+
+	estimated, gas, err := Add(uintType, lhs, rhs, &estimationTp, nil)
+	assert.NoError(t, err)
+	assert.NotZero(t, gas)
+	assert.False(t, has(estimated))
+
+	// The estimation should return the same handle as the real transaction
+	actual, _, err := Add(uintType, lhs, rhs, &isolatedTp, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, actual, estimated)
+
+	estimatedRandom, _, err := Random(uintType, 42, 0, &estimationTp, nil)
+	assert.NoError(t, err)
+	assert.False(t, has(estimatedRandom))
+	assert.Equal(t, uint64(0), state.GetRandomCounter())
+
+	actualRandom, _, err := Random(uintType, 42, 0, &isolatedTp, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, actualRandom, estimatedRandom)
+
+	// Without a seed, the estimation peeks the counter the tx is about to consume
+	isolatedTp.TxContext.Hash = common.HexToHash("0x01")
+	estimationTp.TxContext.Hash = isolatedTp.TxContext.Hash
+	estimatedRandom, _, err = Random(uintType, 0, 0, &estimationTp, nil)
+	assert.NoError(t, err)
+	assert.False(t, has(estimatedRandom))
+	assert.Equal(t, uint64(0), state.GetRandomCounter())
+
+	actualRandom, _, err = Random(uintType, 0, 0, &isolatedTp, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), state.GetRandomCounter())
+	assert.Equal(t, actualRandom, estimatedRandom)
+}
+
+type mapChainState map[common.Address]map[common.Hash]common.Hash
+
+func (m mapChainState) SetNonce(common.Address, uint64) {}
+
+func (m mapChainState) GetState(addr common.Address, key common.Hash) common.Hash {
+	return m[addr][key]
+}
+
+func (m mapChainState) SetState(addr common.Address, key common.Hash, val common.Hash) {
+	if m[addr] == nil {
+		m[addr] = map[common.Hash]common.Hash{}
+	}
+	m[addr][key] = val
+}
+
+func TestZoneQuota(t *testing.T) {
+	input := func(size int, fill byte) []byte {
+		return bytes.Repeat([]byte{fill}, size)
+	}
+
+	newQuotaTp := func(t *testing.T, quotas string) (TxParams, *FheosState) {
+		t.Setenv("FHEOS_ZONE_QUOTAS", quotas)
+		state, err := NewFheosState(t.TempDir())
+		if err != nil {
+			t.Fatalf("Failed to create fheos state: %v", err)
+		}
+		t.Cleanup(func() { state.Close() })
+
+		quotaTp := tp
+		quotaTp.CiphertextDb = memorydb.New()
+		quotaTp.FheosState = state
+		return quotaTp, state
+	}
+
+	t.Run("Disk", func(t *testing.T) {
+		// Without a tx layer ciphertexts go straight to disk, where usage is counted
+		quotaTp, state := newQuotaTp(t, "1:100")
+		quotaTp.CiphertextDb = nil
+
+		_, _, err := StoreCt(uint8(fhedriver.Uint32), input(60, 1), 1, &quotaTp, nil)
+		assert.NoError(t, err)
+
+		_, _, err = StoreCt(uint8(fhedriver.Uint32), input(60, 2), 1, &quotaTp, nil)
+		assert.ErrorIs(t, err, vm.ErrExecutionReverted)
+
+		// Other zones have no quota
+		_, _, err = StoreCt(uint8(fhedriver.Uint32), input(60, 3), 0, &quotaTp, nil)
+		assert.NoError(t, err)
+
+		_, _, err = StoreCt(uint8(fhedriver.Uint32), input(40, 4), 1, &quotaTp, nil)
+		assert.NoError(t, err)
+
+		_, _, err = TrivialEncrypt(big.NewInt(1).Bytes(), uint8(fhedriver.Uint32), 1, &quotaTp, nil)
+		assert.ErrorIs(t, err, vm.ErrExecutionReverted)
+
+		usage, err := state.Storage.ZoneUsage(1)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(2), usage.Count)
+		assert.Equal(t, uint64(100), usage.Bytes)
+	})
+
+	t.Run("TxLayer", func(t *testing.T) {
+		// Ciphertexts pending in the tx layer count before they are committed
+		quotaTp, state := newQuotaTp(t, "1:100")
+
+		_, _, err := StoreCt(uint8(fhedriver.Uint32), input(60, 1), 1, &quotaTp, nil)
+		assert.NoError(t, err)
+
+		_, _, err = StoreCt(uint8(fhedriver.Uint32), input(60, 2), 1, &quotaTp, nil)
+		assert.ErrorIs(t, err, vm.ErrExecutionReverted)
+
+		_, err = storage2.NewMultiStore(quotaTp.CiphertextDb, &state.Storage).Commit()
+		assert.NoError(t, err)
+
+		_, _, err = StoreCt(uint8(fhedriver.Uint32), input(60, 3), 1, &quotaTp, nil)
+		assert.ErrorIs(t, err, vm.ErrExecutionReverted)
+
+		_, _, err = StoreCt(uint8(fhedriver.Uint32), input(40, 4), 1, &quotaTp, nil)
+		assert.NoError(t, err)
+
+		usage, err := storage2.NewMultiStore(quotaTp.CiphertextDb, &state.Storage).ZoneUsage(1)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(2), usage.Count)
+		assert.Equal(t, uint64(100), usage.Bytes)
+	})
+
+	t.Run("ChainState", func(t *testing.T) {
+		// With chain state the charges are kept in it, the local db doesn't matter
+		quotaTp, _ := newQuotaTp(t, "1:100")
+		chain := mapChainState{}
+		quotaTp.ChainState = chain
+		storeCt := func(size int, fill byte, zone int32) (types.Hash, error) {
+			h, _, err := StoreCt(uint8(fhedriver.Uint32), input(size, fill), zone, &quotaTp, nil)
+			return types.Hash(common.BytesToHash(h)), err
+		}
+
+		_, err := storeCt(60, 1, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(0), GetChargedZoneBytes(chain, 0))
+
+		first, err := storeCt(60, 1, 1)
+		assert.NoError(t, err)
+
+		// Storing the same ciphertext again isn't charged again
+		_, err = storeCt(60, 1, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(60), GetChargedZoneBytes(chain, 1))
+
+		_, err = storeCt(60, 2, 1)
+		assert.ErrorIs(t, err, vm.ErrExecutionReverted)
+
+		second, err := storeCt(40, 3, 1)
+		assert.NoError(t, err)
+
+		_, _, err = TrivialEncrypt(big.NewInt(1).Bytes(), uint8(fhedriver.Uint32), 1, &quotaTp, nil)
+		assert.ErrorIs(t, err, vm.ErrExecutionReverted)
+		assert.Equal(t, uint64(100), GetChargedZoneBytes(chain, 1))
+
+		// The tx commits with only the first ciphertext referenced, the second is refunded
+		UpdateZoneCharges(chain, []types.Hash{first, second}, []types.Hash{first}, nil)
+		assert.Equal(t, uint64(60), GetChargedZoneBytes(chain, 1))
+
+		_, err = storeCt(40, 4, 1)
+		assert.NoError(t, err)
+
+		// Overwriting the only reference refunds the first, and referencing it again charges it again
+		UpdateZoneCharges(chain, nil, nil, []types.Hash{first})
+		assert.Equal(t, uint64(40), GetChargedZoneBytes(chain, 1))
+		UpdateZoneCharges(chain, nil, []types.Hash{first}, nil)
+		assert.Equal(t, uint64(100), GetChargedZoneBytes(chain, 1))
+	})
+
+	t.Setenv("FHEOS_ZONE_QUOTAS", "1=100")
+	_, err := getZoneQuotas()
+	assert.Error(t, err)
+}
+
+func TestProvenance(t *testing.T) {
+	state, err := NewFheosState(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create fheos state: %v", err)
+	}
+	defer state.Close()
+
+	provenanceTp := tp
+	provenanceTp.CiphertextDb = nil
+	provenanceTp.FheosState = state
+	provenanceTp.ContractAddress = common.HexToAddress("0x0000000000000000000000000000000000000042")
+	provenanceTp.BlockNumber = big.NewInt(12)
+	provenanceTp.TxContext.Hash = common.HexToHash("0x01")
+
+	hash, _, err := StoreCt(uint8(fhedriver.Uint32), []byte{1, 2, 3}, 0, &provenanceTp, nil)
+	assert.NoError(t, err)
+
+	lineage, err := GetLineage(hash, 0, &provenanceTp)
+	assert.NoError(t, err)
+	assert.Len(t, lineage.Nodes, 1)
+
+	p := lineage.Nodes[0].Provenance
+	if assert.NotNil(t, p) {
+		assert.Equal(t, types.StoreCt, p.Operation)
+		assert.Empty(t, p.Inputs)
+		assert.Equal(t, provenanceTp.ContractAddress, p.Contract)
+		assert.Equal(t, provenanceTp.TxContext.Hash, p.TxHash)
+		assert.Equal(t, uint64(12), p.BlockNumber)
+	}
+}
+
+func TestDecryptionResultsSurviveRestart(t *testing.T) {
+	// Any persistent backend will do, fs is the simplest one
+	t.Setenv("FHEOS_DB_BACKEND", "fs")
+	dir := t.TempDir()
+	state, err := NewFheosState(dir)
+	if err != nil {
+		t.Fatalf("Failed to create fheos state: %v", err)
+	}
+
+	key := types.PendingDecryption{Hash: fhedriver.Hash{1}, Type: types.Decrypt}
+	assert.NoError(t, state.DecryptResults.SetValue(key, big.NewInt(7)))
+	assert.NoError(t, state.Close())
+
+	state, err = NewFheosState(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen fheos state: %v", err)
+	}
+	defer state.Close()
+
+	record, exists := state.DecryptResults.Get(key)
+	assert.True(t, exists)
+	assert.Equal(t, big.NewInt(7), record.Value)
+}
+
+type recordingParallelHooks struct {
+	cts      chan types.PendingDecryption
+	results  chan types.PendingDecryption
+	existing chan types.PendingDecryption
+}
+
+func newRecordingParallelHooks() *recordingParallelHooks {
+	return &recordingParallelHooks{
+		cts:      make(chan types.PendingDecryption, 8),
+		results:  make(chan types.PendingDecryption, 8),
+		existing: make(chan types.PendingDecryption, 8),
+	}
+}
+
+func (h *recordingParallelHooks) NotifyCt(key *types.PendingDecryption) { h.cts <- *key }
+
+func (h *recordingParallelHooks) NotifyDecryptRes(key *types.PendingDecryption) error {
+	h.results <- *key
+	return nil
+}
+
+func (h *recordingParallelHooks) NotifyExistingRes(key *types.PendingDecryption) { h.existing <- *key }
+
+func expectNotified(t *testing.T, notifications chan types.PendingDecryption, expected types.PendingDecryption) {
+	select {
+	case key := <-notifications:
+		assert.Equal(t, expected, key)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("not notified of %s", expected.Hash.Hex())
+	}
+}
+
+func TestParallelDecryption(t *testing.T) {
+	t.Run("SealedKeysDontCollide", func(t *testing.T) {
+		// Both pairs XOR to the same bytes
+		a := genSealedKey([]byte{1, 2}, []byte{3, 4}, types.SealOutput)
+		b := genSealedKey([]byte{3, 4}, []byte{1, 2}, types.SealOutput)
+		assert.NotEqual(t, a.Hash, b.Hash)
+	})
+
+	uintType := uint8(fhedriver.Uint32)
+	ct := trivialEncrypt(t, big.NewInt(37), uintType, 0)
+	ctKey, err := fhedriver.DeserializeCiphertextKey(ct)
+	assert.NoError(t, err)
+
+	hooks := newRecordingParallelHooks()
+	parallelTp := tp
+	parallelTp.ParallelTxHooks = hooks
+
+	t.Run("Decrypt", func(t *testing.T) {
+		key := types.PendingDecryption{Hash: ctKey.Hash, Type: types.Decrypt}
+		defaultValue := big.NewInt(0)
+
+		plaintext, _, err := Decrypt(uintType, ct, defaultValue, &parallelTp, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, defaultValue, plaintext)
+		expectNotified(t, hooks.cts, key)
+		expectNotified(t, hooks.results, key)
+
+		// Once resolved, the result itself is returned
+		plaintext, _, err = Decrypt(uintType, ct, defaultValue, &parallelTp, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, big.NewInt(37), plaintext)
+		expectNotified(t, hooks.existing, key)
+	})
+
+	t.Run("SealOutput", func(t *testing.T) {
+		pk := bytes.Repeat([]byte{7}, 32)
+		key := genSealedKey(ctKey.Hash[:], pk, types.SealOutput)
+
+		sealed, _, err := SealOutput(uintType, ct, pk, &parallelTp, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, sealOutputPlaceholder, sealed)
+		expectNotified(t, hooks.cts, key)
+		expectNotified(t, hooks.results, key)
+
+		sealed, _, err = SealOutput(uintType, ct, pk, &parallelTp, nil)
+		assert.NoError(t, err)
+		assert.NotEqual(t, sealOutputPlaceholder, sealed)
+		expectNotified(t, hooks.existing, key)
+	})
+}
+
+func TestFollowerDecryption(t *testing.T) {
+	// A follower runs txs in the EVM without parallel tx hooks, the results come from the sequencer
+	followerTp := tp
+	followerTp.ChainState = mapChainState{}
+	followerTp.ParallelTxHooks = nil
+
+	uintType := uint8(fhedriver.Uint32)
+	input := fhedriver.CiphertextKey{Hash: fhedriver.Hash{0xf0, 0x11}, UintType: fhedriver.Uint32}
+	ct := types.SerializeCiphertextKey(input)
+	pk := bytes.Repeat([]byte{7}, 32)
+
+	t.Run("MissingResultReverts", func(t *testing.T) {
+		_, _, err := Decrypt(uintType, ct, big.NewInt(0), &followerTp, nil)
+		assert.ErrorIs(t, err, vm.ErrExecutionReverted)
+		_, _, err = SealOutput(uintType, ct, pk, &followerTp, nil)
+		assert.ErrorIs(t, err, vm.ErrExecutionReverted)
+	})
+
+	t.Run("UsesPreloadedResults", func(t *testing.T) {
+		decryptKey := types.PendingDecryption{Hash: input.Hash, Type: types.Decrypt}
+		sealKey := genSealedKey(input.Hash[:], pk, types.SealOutput)
+		assert.NoError(t, State.DecryptResults.SetValue(decryptKey, big.NewInt(-7)))
+		assert.NoError(t, State.DecryptResults.SetValue(sealKey, "sealed by the sequencer"))
+		defer State.DecryptResults.Remove(decryptKey)
+		defer State.DecryptResults.Remove(sealKey)
+
+		plaintext, _, err := Decrypt(uintType, ct, big.NewInt(0), &followerTp, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, big.NewInt(-7), plaintext)
+
+		sealed, _, err := SealOutput(uintType, ct, pk, &followerTp, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "sealed by the sequencer", sealed)
+	})
+}
+
+func TestDecryptionResultsPerChainState(t *testing.T) {
+	source, err := NewFheosState(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create fheos state: %v", err)
+	}
+	defer source.Close()
+	chain, err := NewFheosState(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create fheos state: %v", err)
+	}
+	defer chain.Close()
+
+	key := types.PendingDecryption{Hash: fhedriver.Hash{0xc4}, Type: types.Decrypt}
+	assert.NoError(t, source.DecryptResults.SetValue(key, big.NewInt(11)))
+	batch, err := source.SerializeMultipleResolvedDecryptions([]types.PendingDecryption{key})
+	assert.NoError(t, err)
+
+	// The batch is loaded into the chain's own state, not the global one
+	assert.NoError(t, chain.LoadMultipleResolvedDecryptions(bytes.NewReader(batch)))
+	record, exists := chain.DecryptResults.Get(key)
+	assert.True(t, exists)
+	assert.Equal(t, big.NewInt(11), record.Value)
+	_, exists = State.DecryptResults.Get(key)
+	assert.False(t, exists)
+
+	var uninitialized *FheosState
+	assert.Error(t, uninitialized.LoadMultipleResolvedDecryptions(bytes.NewReader(batch)))
+}
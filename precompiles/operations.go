@@ -123,7 +123,9 @@ func DecryptHelper(storage *storage2.MultiStore, ctHash fhe.Hash, tp *TxParams,
 		logger.Error(msg, " ctHash ", ctHash.Hex())
 		return defaultValue, vm.ErrExecutionReverted
 	}
-	plaintext, err := fhe.Decrypt(*ct, chainId, transactionHash)
+	plaintext, err := withEngine(func() (*big.Int, error) {
+		return fhe.Decrypt(*ct, chainId, transactionHash)
+	})
 	if err != nil {
 		logger.Error("decrypt failed for ciphertext", "error", err)
 		return defaultValue, vm.ErrExecutionReverted
@@ -139,7 +141,9 @@ func SealOutputHelper(storage *storage2.MultiStore, ctHash fhe.Hash, pk []byte,
 		logger.Error(msg, " ctHash ", ctHash)
 		return "", vm.ErrExecutionReverted
 	}
-	sealed, err := fhe.SealOutput(*ct, pk, chainId, transactionHash)
+	sealed, err := withEngine(func() ([]byte, error) {
+		return fhe.SealOutput(*ct, pk, chainId, transactionHash)
+	})
 	if err != nil {
 		logger.Error("sealOutput failed for ciphertext", "error", err)
 		return "", vm.ErrExecutionReverted
@@ -245,7 +249,7 @@ func getUtypeForFunctionName(functionName types.PrecompileName, currentType byte
 
 // ProcessOperation handles operations with variable number of inputs
 func ProcessOperation(functionName types.PrecompileName, operation OperationFunc, utype byte, securtiyZone int32, inputKeys []fhe.CiphertextKey, tp *TxParams, callback *CallbackFunc) ([]byte, uint64, error) {
-	storage := storage2.NewMultiStore(tp.CiphertextDb, &State.Storage)
+	storage := storage2.NewMultiStore(tp.CiphertextDb, &tp.state().Storage)
 
 	placeholderCt, err := createPlaceholder(getUtypeForFunctionName(functionName, utype), securtiyZone, functionName, keysToHashes(inputKeys)...)
 	if err != nil {
@@ -263,29 +267,30 @@ func ProcessOperation(functionName types.PrecompileName, operation OperationFunc
 		return nil, 0, vm.ErrExecutionReverted
 	}
 
-	logger.Info(functionName.String()+" storing placeholder", "utype", utype, "placeholderKey", hex.EncodeToString(placeholderCt.Key.Hash[:]))
-	if err := storeCiphertext(storage, placeholderCt); err != nil {
-		logger.Error(functionName.String()+" failed to store async ciphertext", "err", err)
-		return nil, 0, vm.ErrExecutionReverted
-	}
-
 	gas := getGasForPrecompile(functionName, uintType)
 	if tp.GasEstimation {
-		randomHash := State.GetEmptyKeyForGasEstimation()
-		return randomHash[:], gas, nil
+		// The placeholder handle is deterministic, so we can return the same handle the real tx would get
+		// without writing anything to storage
+		return types.SerializeCiphertextKey(placeholderCt.Key), gas, nil
 	}
 
 	if shouldPrintPrecompileInfo(tp) {
 		logger.Debug("fn", functionName.String(), "Storing async ciphertext", "placeholderKey", hex.EncodeToString(placeholderCt.Key.Hash[:]))
 	}
 
+	logger.Info(functionName.String()+" storing placeholder", "utype", utype, "placeholderKey", hex.EncodeToString(placeholderCt.Key.Hash[:]))
+	if err := storeCiphertext(storage, placeholderCt); err != nil {
+		logger.Error(functionName.String()+" failed to store async ciphertext", "err", err)
+		return nil, 0, vm.ErrExecutionReverted
+	}
+	recordProvenance(storage, tp, functionName, placeholderCt.Key.Hash, inputKeys...)
+
 	// Make copies for goroutine
 	copiedInputs := make([]fhe.CiphertextKey, len(inputKeys))
 	copy(copiedInputs, inputKeys)
 	placeholderKeyCopy := placeholderCt.Key
 
-	go func(inputs []fhe.CiphertextKey, resultKey fhe.CiphertextKey) {
-		ctReady := false
+	evaluate := func(inputs []fhe.CiphertextKey, resultKey fhe.CiphertextKey) (ctReady bool) {
 		defer func() {
 			if !ctReady {
 				logger.Error(functionName.String() + ": failed, deleting placeholder ciphertext " + hex.EncodeToString(resultKey.Hash[:]))
@@ -311,7 +316,9 @@ func ProcessOperation(functionName types.PrecompileName, operation OperationFunc
 			return
 		}
 
-		result, err := operation.Execute(cts)
+		result, err := withEngineRetry(functionName, func() (*fhe.FheEncrypted, error) {
+			return operation.Execute(cts)
+		})
 		if err != nil {
 			logger.Error(functionName.String()+" failed", "err", err)
 			return
@@ -325,7 +332,7 @@ func ProcessOperation(functionName types.PrecompileName, operation OperationFunc
 
 		result.Key = resultKey
 
-		err = storeCiphertext(storage, result)
+		err = storeResult(storage, result, realResultHash)
 		if err != nil {
 			logger.Error(functionName.String()+" failed", "err", err)
 			return
@@ -346,7 +353,16 @@ func ProcessOperation(functionName types.PrecompileName, operation OperationFunc
 			logFields = append(logFields, fmt.Sprintf("input%d", i), ct.GetHash().Hex())
 		}
 		logger.Info("["+functionName.String()+"]: success", logFields...)
-	}(copiedInputs, placeholderKeyCopy)
+		return ctReady
+	}
+
+	if isSyncExecution(tp) {
+		if !evaluate(copiedInputs, placeholderKeyCopy) {
+			return nil, 0, vm.ErrExecutionReverted
+		}
+	} else {
+		go evaluate(copiedInputs, placeholderKeyCopy)
+	}
 
 	return types.SerializeCiphertextKey(placeholderCt.Key), gas, nil
 }
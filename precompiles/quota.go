@@ -0,0 +1,183 @@
+package precompiles
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+	"github.com/fhenixprotocol/fheos/storage"
+)
+
+var ErrZoneQuotaExceeded = errors.New("security zone storage quota exceeded")
+
+// ChainState is the part of the EVM state db that zone charges are kept in
+type ChainState interface {
+	SetNonce(common.Address, uint64)
+	GetState(common.Address, common.Hash) common.Hash
+	SetState(common.Address, common.Hash, common.Hash)
+}
+
+// QuotaAccount is the fictional account whose storage holds what the zones that have a quota in FHEOS_ZONE_QUOTAS
+// were charged. Being part of the chain state, the charges are the same on every node and are rolled back with
+// reverted txs. Its storage is laid out as:
+//
+//	keccak("charged" | zone (4))  ->  bytes charged to zone
+//	keccak("ct" | hash)           ->  charged (1) | zone (4) | references (8) | size (8) of a stored ciphertext
+//
+// This account only changes the state root of chains that configure quotas. Since the quotas decide which txs
+// revert and what is written to it, FHEOS_ZONE_QUOTAS is chain configuration: every node of a chain must run with the
+// same value, and changing it must be coordinated like any other chain config change
+var QuotaAccount = common.HexToAddress("0xFE05FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF")
+
+func chargedSlot(zone int32) common.Hash {
+	return crypto.Keccak256Hash([]byte("charged"), binary.BigEndian.AppendUint32(nil, uint32(zone)))
+}
+
+func chargeRecordSlot(h types.Hash) common.Hash {
+	return crypto.Keccak256Hash([]byte("ct"), h[:])
+}
+
+// chargeRecord is what a stored ciphertext is charged, whether it currently is, and how many contract storage slots
+// reference it
+type chargeRecord struct {
+	charged    bool
+	zone       int32
+	references uint64
+	size       uint64
+}
+
+func getChargeRecord(state ChainState, h types.Hash) (chargeRecord, bool) {
+	val := state.GetState(QuotaAccount, chargeRecordSlot(h))
+	if val == (common.Hash{}) {
+		return chargeRecord{}, false
+	}
+
+	return chargeRecord{
+		charged:    val[11] == 1,
+		zone:       int32(binary.BigEndian.Uint32(val[12:16])),
+		references: binary.BigEndian.Uint64(val[16:24]),
+		size:       binary.BigEndian.Uint64(val[24:32]),
+	}, true
+}
+
+func setChargeRecord(state ChainState, h types.Hash, record chargeRecord) {
+	var val common.Hash
+	if record.charged {
+		val[11] = 1
+	}
+	binary.BigEndian.PutUint32(val[12:16], uint32(record.zone))
+	binary.BigEndian.PutUint64(val[16:24], record.references)
+	binary.BigEndian.PutUint64(val[24:32], record.size)
+	state.SetState(QuotaAccount, chargeRecordSlot(h), val)
+}
+
+func setChargedZoneBytes(state ChainState, zone int32, charged uint64) {
+	// Setting the nonce ensures Geth won't treat the storage as empty
+	state.SetNonce(QuotaAccount, 1)
+	state.SetState(QuotaAccount, chargedSlot(zone), common.BigToHash(new(big.Int).SetUint64(charged)))
+}
+
+// GetChargedZoneBytes returns the bytes charged to zone in the chain state. A ciphertext is charged when it is stored,
+// refunded once no contract storage references it anymore (which is when the collector is free to delete it) and
+// charged again if it is referenced again, so this is what the zone holds that can't be collected
+func GetChargedZoneBytes(state ChainState, zone int32) uint64 {
+	return state.GetState(QuotaAccount, chargedSlot(zone)).Big().Uint64()
+}
+
+// chargeZoneQuota fails if zone has a quota in FHEOS_ZONE_QUOTAS that storing size more bytes for ciphertext h would
+// exceed (or that is already reached), and otherwise charges them.
+// With chain state the charge is kept in it, and a ciphertext that was stored before isn't charged again. Calls without one (the
+// coprocessor and HTTP paths) aren't part of consensus and check against the usage of store instead, including the
+// ciphertexts still pending in its tx layer
+func chargeZoneQuota(tp *TxParams, store *storage.MultiStore, zone int32, h types.Hash, size uint64) error {
+	quota, ok := tp.state().Quotas[zone]
+	if !ok {
+		return nil
+	}
+
+	if tp.ChainState != nil {
+		if _, stored := getChargeRecord(tp.ChainState, h); stored {
+			return nil
+		}
+
+		charged := GetChargedZoneBytes(tp.ChainState, zone)
+		if charged >= quota || charged+size > quota {
+			return fmt.Errorf("%w: zone %d was charged %d of %d bytes, %d more requested", ErrZoneQuotaExceeded, zone, charged, quota, size)
+		}
+
+		if size > 0 {
+			setChargedZoneBytes(tp.ChainState, zone, charged+size)
+			setChargeRecord(tp.ChainState, h, chargeRecord{charged: true, zone: zone, size: size})
+		}
+		return nil
+	}
+
+	usage, err := store.ZoneUsage(zone)
+	if err != nil {
+		return err
+	}
+
+	if usage.Bytes >= quota || usage.Bytes+size > quota {
+		return fmt.Errorf("%w: zone %d uses %d of %d bytes, %d more requested", ErrZoneQuotaExceeded, zone, usage.Bytes, quota, size)
+	}
+
+	return nil
+}
+
+// UpdateZoneCharges follows the references of a committed tx to the stored ciphertexts, refunds the ones that end the
+// tx without any and charges the ones that are referenced again. Charging them can't fail the tx anymore, so the zone
+// may end up over its quota until enough is refunded. created are the ciphertexts the tx stored, referenced and dereferenced the values it wrote to and
+// overwrote in contract storage (once per slot). Everything it reads and writes is in the chain state, so every node
+// refunds the same bytes
+func UpdateZoneCharges(state ChainState, created []types.Hash, referenced []types.Hash, dereferenced []types.Hash) {
+	touched := make([]types.Hash, 0, len(created)+len(referenced)+len(dereferenced))
+	records := map[types.Hash]*chargeRecord{}
+	record := func(h types.Hash) *chargeRecord {
+		if r, ok := records[h]; ok {
+			return r
+		}
+
+		var r *chargeRecord
+		if found, ok := getChargeRecord(state, h); ok {
+			r = &found
+		}
+		records[h] = r
+		touched = append(touched, h)
+		return r
+	}
+
+	for _, h := range created {
+		record(h)
+	}
+	for _, h := range referenced {
+		if r := record(h); r != nil {
+			r.references++
+		}
+	}
+	for _, h := range dereferenced {
+		if r := record(h); r != nil && r.references > 0 {
+			r.references--
+		}
+	}
+
+	for _, h := range touched {
+		r := records[h]
+		if r == nil {
+			continue
+		}
+
+		charged := GetChargedZoneBytes(state, r.zone)
+		switch {
+		case r.references > 0 && !r.charged:
+			setChargedZoneBytes(state, r.zone, charged+r.size)
+		case r.references == 0 && r.charged:
+			setChargedZoneBytes(state, r.zone, charged-min(charged, r.size))
+		}
+		r.charged = r.references > 0
+		setChargeRecord(state, h, *r)
+	}
+}
@@ -0,0 +1,269 @@
+package precompiles
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+	"github.com/fhenixprotocol/warp-drive/fhe-driver"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPolicy describes how a failed call to the FHE engine is retried before the operation is given up on
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// IsRetryable decides whether an error is transient - errors that aren't retryable fail on the first attempt
+	IsRetryable func(err error) bool
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 50 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+		IsRetryable:    IsTransientEngineError,
+	}
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := float64(p.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		backoff *= p.Multiplier
+	}
+
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		return p.MaxBackoff
+	}
+	return time.Duration(backoff)
+}
+
+// transientEngineCodes are the gRPC status codes the engine fails with when it is down or overloaded
+var transientEngineCodes = map[codes.Code]bool{
+	codes.Unavailable:       true,
+	codes.DeadlineExceeded:  true,
+	codes.ResourceExhausted: true,
+	codes.Aborted:           true,
+}
+
+// transientEngineErrors are the socket level failures that reach us as plain strings, after the driver flattened the
+// underlying error
+var transientEngineErrors = []string{
+	"connection refused",
+	"connection reset",
+	"broken pipe",
+	"i/o timeout",
+}
+
+// IsTransientEngineError reports whether err looks like a transport level failure of the FHE engine
+// (as opposed to a logical failure such as a type mismatch, which would fail again on retry)
+func IsTransientEngineError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	if st, ok := status.FromError(err); ok {
+		return transientEngineCodes[st.Code()]
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, marker := range transientEngineErrors {
+		if strings.Contains(msg, marker) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// circuitBreaker counts consecutive transient engine failures and fails over to the other engine address once
+// threshold is reached. Failovers are rate limited by cooldown so that concurrent failures don't flap between engines
+type circuitBreaker struct {
+	mu           sync.Mutex
+	threshold    int
+	cooldown     time.Duration
+	failures     int
+	lastFailover time.Time
+	switching    bool
+	addresses    [2]string
+	active       int
+	failover     func(address string) error
+}
+
+func newCircuitBreaker(primary string, fallback string, threshold int, cooldown time.Duration, failover func(address string) error) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		addresses: [2]string{primary, fallback},
+		failover:  failover,
+	}
+}
+
+func (cb *circuitBreaker) ActiveAddress() string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.addresses[cb.active]
+}
+
+func (cb *circuitBreaker) recordSuccess() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.failures = 0
+}
+
+// recordFailure decides whether to fail over while holding cb.mu, but runs the failover itself (which re-initializes
+// the engine and waits for the calls in flight) without it, so that other callers reporting their outcome aren't
+// held up behind the switch. Only one failover runs at a time
+func (cb *circuitBreaker) recordFailure() {
+	cb.mu.Lock()
+	cb.failures++
+	if cb.switching || cb.failures < cb.threshold || time.Since(cb.lastFailover) < cb.cooldown {
+		cb.mu.Unlock()
+		return
+	}
+
+	cb.switching = true
+	next := 1 - cb.active
+	from, to, failures := cb.addresses[cb.active], cb.addresses[next], cb.failures
+	cb.mu.Unlock()
+
+	logger.Warn("FHE engine circuit breaker tripped, failing over", "from", from, "to", to, "failures", failures)
+	err := cb.failover(to)
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.switching = false
+	if err != nil {
+		logger.Error("failed to fail over to FHE engine", "address", to, "err", err)
+		return
+	}
+
+	if metrics.Enabled {
+		metrics.GetOrRegisterCounter("fheos/engine/failover", nil).Inc(1)
+	}
+
+	cb.active = next
+	cb.failures = 0
+	cb.lastFailover = time.Now()
+}
+
+const (
+	engineBreakerThreshold = 5
+	engineBreakerCooldown  = 30 * time.Second
+)
+
+var (
+	engineRetryPolicy = DefaultRetryPolicy()
+	engineBreaker     *circuitBreaker
+	activeFheConfig   *fhe.Config
+	// initFheDriver is the driver entry point switchFheEngine re-initializes through
+	initFheDriver = fhe.Init
+)
+
+// SetEngineRetryPolicy replaces the policy used when calling the FHE engine. Not safe to call while operations are in flight
+func SetEngineRetryPolicy(policy RetryPolicy) {
+	engineRetryPolicy = policy
+}
+
+func initEngineBreaker(fheConfig *fhe.Config) {
+	activeFheConfig = fheConfig
+	engineBreaker = nil
+
+	if fheConfig.FallbackFheEngineAddress == "" || fheConfig.FallbackFheEngineAddress == fheConfig.FheEngineAddress {
+		return
+	}
+
+	engineBreaker = newCircuitBreaker(fheConfig.FheEngineAddress, fheConfig.FallbackFheEngineAddress, engineBreakerThreshold, engineBreakerCooldown, switchFheEngine)
+}
+
+// engineLock keeps the engine from being re-initialized under calls that are in flight. Every call to the engine
+// holds it for reading, switchFheEngine takes it for writing
+var engineLock sync.RWMutex
+
+// withEngine runs a single call to the FHE engine
+func withEngine[T any](call func() (T, error)) (T, error) {
+	engineLock.RLock()
+	defer engineLock.RUnlock()
+	return call()
+}
+
+// switchFheEngine re-initializes the driver against address. fhe.Init is process wide, so it waits for the calls in
+// flight to finish and holds back new ones until the driver is ready again
+func switchFheEngine(address string) error {
+	config := *activeFheConfig
+	config.FheEngineAddress = address
+
+	engineLock.Lock()
+	defer engineLock.Unlock()
+	return initFheDriver(&config)
+}
+
+func recordEngineAttempt(functionName types.PrecompileName, attempt int, err error) {
+	if !metrics.Enabled {
+		return
+	}
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	metrics.GetOrRegisterCounter(fmt.Sprintf("%s/%s/%s/%s", "fheos", "engine", functionName.String(), result), nil).Inc(1)
+	if attempt > 1 {
+		metrics.GetOrRegisterCounter(fmt.Sprintf("%s/%s/%s/%s", "fheos", "engine", functionName.String(), "retry"), nil).Inc(1)
+	}
+}
+
+// withEngineRetry runs call (a request to the FHE engine) according to engineRetryPolicy, feeding the outcome of
+// every attempt to the circuit breaker
+func withEngineRetry[T any](functionName types.PrecompileName, call func() (T, error)) (T, error) {
+	policy := engineRetryPolicy
+	attempts := max(policy.MaxAttempts, 1)
+
+	var result T
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		result, err = withEngine(call)
+		recordEngineAttempt(functionName, attempt, err)
+		if err == nil {
+			if engineBreaker != nil {
+				engineBreaker.recordSuccess()
+			}
+			return result, nil
+		}
+
+		retryable := policy.IsRetryable != nil && policy.IsRetryable(err)
+		if retryable && engineBreaker != nil {
+			engineBreaker.recordFailure()
+		}
+
+		if !retryable || attempt == attempts {
+			break
+		}
+
+		backoff := policy.backoff(attempt)
+		logger.Warn(functionName.String()+" FHE engine call failed, retrying", "attempt", attempt, "maxAttempts", attempts, "backoff", backoff, "err", err)
+		time.Sleep(backoff)
+	}
+
+	return result, err
+}
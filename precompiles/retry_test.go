@@ -0,0 +1,219 @@
+package precompiles
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+	fhedriver "github.com/fhenixprotocol/warp-drive/fhe-driver"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeEngine stands in for the FHE engine and fails the first `failures` calls with err
+type fakeEngine struct {
+	failures int
+	err      error
+	calls    int
+	address  string
+}
+
+func (e *fakeEngine) execute() (*fhedriver.FheEncrypted, error) {
+	e.calls++
+	if e.calls <= e.failures {
+		return nil, e.err
+	}
+	return &fhedriver.FheEncrypted{Data: []byte{1}}, nil
+}
+
+func (e *fakeEngine) failover(address string) error {
+	e.address = address
+	e.failures = 0
+	return nil
+}
+
+func withTestEngineRetry(t *testing.T, policy RetryPolicy, breaker *circuitBreaker) {
+	prevPolicy, prevBreaker := engineRetryPolicy, engineBreaker
+	engineRetryPolicy, engineBreaker = policy, breaker
+	t.Cleanup(func() {
+		engineRetryPolicy, engineBreaker = prevPolicy, prevBreaker
+	})
+}
+
+func testRetryPolicy(attempts int) RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    attempts,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+		Multiplier:     2,
+		IsRetryable:    IsTransientEngineError,
+	}
+}
+
+func TestEngineRetry(t *testing.T) {
+	t.Run("RetriesTransientErrors", func(t *testing.T) {
+		engine := &fakeEngine{failures: 2, err: status.Error(codes.Unavailable, "engine unavailable")}
+		withTestEngineRetry(t, testRetryPolicy(3), nil)
+
+		ct, err := withEngineRetry(types.Add, engine.execute)
+		assert.NoError(t, err)
+		assert.NotNil(t, ct)
+		assert.Equal(t, 3, engine.calls)
+	})
+
+	t.Run("GivesUpAfterMaxAttempts", func(t *testing.T) {
+		engine := &fakeEngine{failures: 10, err: errors.New("connection refused")}
+		withTestEngineRetry(t, testRetryPolicy(3), nil)
+
+		_, err := withEngineRetry(types.Add, engine.execute)
+		assert.Error(t, err)
+		assert.Equal(t, 3, engine.calls)
+	})
+
+	t.Run("DoesNotRetryLogicalErrors", func(t *testing.T) {
+		engine := &fakeEngine{failures: 10, err: errors.New("inputs type mismatch")}
+		withTestEngineRetry(t, testRetryPolicy(3), nil)
+
+		_, err := withEngineRetry(types.Add, engine.execute)
+		assert.Error(t, err)
+		assert.Equal(t, 1, engine.calls)
+	})
+
+	t.Run("ClassifiesErrors", func(t *testing.T) {
+		for err, transient := range map[error]bool{
+			status.Error(codes.Unavailable, "engine unavailable"):                 true,
+			status.Error(codes.DeadlineExceeded, "deadline"):                      true,
+			fmt.Errorf("reading response: %w", io.ErrUnexpectedEOF):               true,
+			errors.New("dial tcp 127.0.0.1:50051: connect: connection refused"):   true,
+			status.Error(codes.InvalidArgument, "inputs type mismatch"):           false,
+			status.Error(codes.Internal, "unexpected eof while decoding payload"): false,
+			errors.New("geofence zone mismatch"):                                  false,
+		} {
+			assert.Equal(t, transient, IsTransientEngineError(err), err.Error())
+		}
+	})
+
+	t.Run("Backoff", func(t *testing.T) {
+		policy := testRetryPolicy(5)
+		assert.Equal(t, time.Millisecond, policy.backoff(1))
+		assert.Equal(t, 2*time.Millisecond, policy.backoff(2))
+		assert.Equal(t, 4*time.Millisecond, policy.backoff(3))
+		assert.Equal(t, 5*time.Millisecond, policy.backoff(4))
+	})
+}
+
+func TestEngineCircuitBreaker(t *testing.T) {
+	t.Run("FailsOverAfterThreshold", func(t *testing.T) {
+		engine := &fakeEngine{failures: 100, err: errors.New("i/o timeout")}
+		breaker := newCircuitBreaker("primary:50051", "fallback:50051", 2, 0, engine.failover)
+		withTestEngineRetry(t, testRetryPolicy(3), breaker)
+
+		ct, err := withEngineRetry(types.Cast, engine.execute)
+		assert.NoError(t, err)
+		assert.NotNil(t, ct)
+		assert.Equal(t, "fallback:50051", engine.address)
+		assert.Equal(t, "fallback:50051", breaker.ActiveAddress())
+	})
+
+	t.Run("SuccessResetsFailures", func(t *testing.T) {
+		engine := &fakeEngine{failures: 1, err: errors.New("connection reset by peer")}
+		breaker := newCircuitBreaker("primary:50051", "fallback:50051", 2, 0, engine.failover)
+		withTestEngineRetry(t, testRetryPolicy(3), breaker)
+
+		for i := 0; i < 3; i++ {
+			engine.calls = 0
+			_, err := withEngineRetry(types.TrivialEncrypt, engine.execute)
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, "", engine.address)
+		assert.Equal(t, "primary:50051", breaker.ActiveAddress())
+	})
+
+	t.Run("FailoverWaitsForCallsInFlight", func(t *testing.T) {
+		inFlight := make(chan struct{})
+		release := make(chan struct{})
+		go func() {
+			_, _ = withEngine(func() (bool, error) {
+				close(inFlight)
+				<-release
+				return true, nil
+			})
+		}()
+		<-inFlight
+
+		locked := make(chan struct{})
+		go func() {
+			engineLock.Lock()
+			close(locked)
+			engineLock.Unlock()
+		}()
+
+		select {
+		case <-locked:
+			t.Fatal("engine was switched under a call in flight")
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(release)
+		<-locked
+	})
+
+	t.Run("SwitchesDriverWithoutBlockingBreaker", func(t *testing.T) {
+		switched := make(chan string, 1)
+		release := make(chan struct{})
+		prevInit, prevConfig := initFheDriver, activeFheConfig
+		initFheDriver = func(config *fhedriver.Config) error {
+			switched <- config.FheEngineAddress
+			<-release
+			return nil
+		}
+		activeFheConfig = &fhedriver.Config{FheEngineAddress: "primary:50051", FallbackFheEngineAddress: "fallback:50051"}
+		t.Cleanup(func() {
+			initFheDriver, activeFheConfig = prevInit, prevConfig
+		})
+
+		breaker := newCircuitBreaker("primary:50051", "fallback:50051", 1, 0, switchFheEngine)
+		failedOver := make(chan struct{})
+		go func() {
+			breaker.recordFailure()
+			close(failedOver)
+		}()
+		assert.Equal(t, "fallback:50051", <-switched)
+
+		// the driver is being re-initialized - other callers still get to report to the breaker, and don't start a
+		// second switch
+		reported := make(chan struct{})
+		go func() {
+			breaker.recordSuccess()
+			breaker.recordFailure()
+			close(reported)
+		}()
+		select {
+		case <-reported:
+		case <-time.After(time.Second):
+			t.Fatal("breaker was held up behind the engine switch")
+		}
+		assert.Equal(t, "primary:50051", breaker.ActiveAddress())
+
+		close(release)
+		<-failedOver
+		assert.Equal(t, "fallback:50051", breaker.ActiveAddress())
+	})
+
+	t.Run("CooldownPreventsFlapping", func(t *testing.T) {
+		failovers := 0
+		breaker := newCircuitBreaker("primary:50051", "fallback:50051", 1, time.Hour, func(string) error {
+			failovers++
+			return nil
+		})
+
+		for i := 0; i < 5; i++ {
+			breaker.recordFailure()
+		}
+		assert.Equal(t, 1, failovers)
+		assert.Equal(t, "fallback:50051", breaker.ActiveAddress())
+	})
+}
@@ -1,12 +1,13 @@
 package precompiles
 
 import (
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/fhenixprotocol/warp-drive/fhe-driver"
 	"io"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ethereum/go-ethereum/metrics"
@@ -14,11 +15,26 @@ import (
 	storage2 "github.com/fhenixprotocol/fheos/storage"
 )
 
+// ExecutionMode controls how the async precompiles (operations, Cast and TrivialEncrypt) evaluate their result
+type ExecutionMode uint8
+
+const (
+	// AsyncExecution returns the placeholder handle immediately and evaluates the result in a background goroutine
+	AsyncExecution ExecutionMode = iota
+	// SyncExecution evaluates the result inline, in call order, before returning the (same) placeholder handle.
+	// Meant for replay, fraud-proof and test environments that can't rely on background goroutines
+	SyncExecution
+)
+
 type FheosState struct {
 	FheosVersion   uint64
 	Storage        storage2.FheosStorage
 	RandomCounter  uint64
 	DecryptResults *types.DecryptionResults
+	ExecutionMode  ExecutionMode
+	Collector      *storage2.RefCountCollector
+	// Quotas caps the bytes stored per security zone, zones without a quota are unlimited
+	Quotas map[int32]uint64
 	//MaxUintValue *big.Int // This should contain the max value of the supported uint type
 }
 
@@ -26,7 +42,7 @@ func (fs *FheosState) GetEmptyKeyForGasEstimation() []byte {
 	return types.SerializeCiphertextKey(types.GetEmptyCiphertextKey())
 }
 
-const FheosVersion = uint64(1001)
+const FheosVersion = uint64(1006)
 
 func getDbPath() string {
 	dbPath := os.Getenv("FHEOS_DB_PATH")
@@ -37,6 +53,95 @@ func getDbPath() string {
 	return dbPath
 }
 
+func getExecutionMode() ExecutionMode {
+	if os.Getenv("FHEOS_EXECUTION_MODE") == "sync" {
+		return SyncExecution
+	}
+
+	return AsyncExecution
+}
+
+// getGCConfig reads the garbage collection config from the environment. GC is disabled unless FHEOS_GC_GRACE_BLOCKS is set
+func getGCConfig() (storage2.GCConfig, bool) {
+	graceBlocks, err := strconv.ParseUint(os.Getenv("FHEOS_GC_GRACE_BLOCKS"), 10, 64)
+	if err != nil {
+		return storage2.GCConfig{}, false
+	}
+
+	interval, err := time.ParseDuration(os.Getenv("FHEOS_GC_INTERVAL"))
+	if err != nil || interval <= 0 {
+		interval = time.Minute
+	}
+
+	return storage2.GCConfig{
+		GraceBlocks: graceBlocks,
+		Interval:    interval,
+		DryRun:      os.Getenv("FHEOS_GC_DRY_RUN") == "true",
+	}, true
+}
+
+// getDecryptionResultsConfig reads the bounds of the in-memory decryption results from the environment. Resolved
+// results are kept for FHEOS_DECRYPTION_TTL, pending ones for FHEOS_DECRYPTION_PENDING_TTL and at most
+// FHEOS_DECRYPTION_MAX_ENTRIES records are kept at all. FHEOS_DECRYPTION_VERSIONED_BATCHES=true switches the batches
+// this node writes to the versioned format, once every node that loads them understands it
+func getDecryptionResultsConfig() types.DecryptionResultsConfig {
+	config := types.DecryptionResultsConfig{
+		TTL:           time.Hour,
+		PendingTTL:    6 * time.Hour,
+		MaxEntries:    1_000_000,
+		SweepInterval: time.Minute,
+	}
+
+	if ttl, err := time.ParseDuration(os.Getenv("FHEOS_DECRYPTION_TTL")); err == nil && ttl >= 0 {
+		config.TTL = ttl
+	}
+	if ttl, err := time.ParseDuration(os.Getenv("FHEOS_DECRYPTION_PENDING_TTL")); err == nil && ttl >= 0 {
+		config.PendingTTL = ttl
+	}
+	if maxEntries, err := strconv.Atoi(os.Getenv("FHEOS_DECRYPTION_MAX_ENTRIES")); err == nil && maxEntries >= 0 {
+		config.MaxEntries = maxEntries
+	}
+	if interval, err := time.ParseDuration(os.Getenv("FHEOS_DECRYPTION_SWEEP_INTERVAL")); err == nil && interval > 0 {
+		config.SweepInterval = interval
+	}
+	config.VersionedBatches = os.Getenv("FHEOS_DECRYPTION_VERSIONED_BATCHES") == "true"
+
+	if config.PendingTTL > 0 && config.PendingTTL < config.TTL {
+		logger.Warn("pending decryptions expire before resolved ones", "ttl", config.TTL, "pendingTtl", config.PendingTTL)
+	}
+	return config
+}
+
+// getZoneQuotas reads the per security zone byte quotas from FHEOS_ZONE_QUOTAS, formatted as "zone:bytes,zone:bytes".
+// On chain they are part of the chain configuration (see QuotaAccount)
+func getZoneQuotas() (map[int32]uint64, error) {
+	env := os.Getenv("FHEOS_ZONE_QUOTAS")
+	if env == "" {
+		return nil, nil
+	}
+
+	quotas := map[int32]uint64{}
+	for _, entry := range strings.Split(env, ",") {
+		zone, quota, found := strings.Cut(strings.TrimSpace(entry), ":")
+		if !found {
+			return nil, fmt.Errorf("invalid zone quota %q, expected zone:bytes", entry)
+		}
+
+		z, err := strconv.ParseInt(zone, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid security zone in quota %q: %w", entry, err)
+		}
+
+		q, err := strconv.ParseUint(quota, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid byte count in quota %q: %w", entry, err)
+		}
+		quotas[int32(z)] = q
+	}
+
+	return quotas, nil
+}
+
 var State *FheosState = nil
 
 func (fs *FheosState) GetCiphertext(hash types.Hash) (*types.FheEncrypted, error) {
@@ -78,74 +183,205 @@ func (fs *FheosState) IncRandomCounter() uint64 {
 	return fs.RandomCounter
 }
 
-func createFheosState(storage storage2.FheosStorage, version uint64) {
-	State = &FheosState{
+func createFheosState(storage storage2.FheosStorage, version uint64) *FheosState {
+	return &FheosState{
 		version,
 		storage,
 		0,
-		types.NewDecryptionResultsMap(),
+		types.NewBoundedDecryptionResults(getDecryptionResultsConfig()),
+		getExecutionMode(),
+		nil,
+		nil,
 	}
 }
 
-func InitializeFheosState() error {
-	store, err := storage2.InitStorage(getDbPath())
+// NewFheosState opens (and migrates) the fheos db at dbPath and creates an independent state for it, so that several
+// chains can be hosted in one process. It must be closed when done
+func NewFheosState(dbPath string) (*FheosState, error) {
+	quotas, err := getZoneQuotas()
+	if err != nil {
+		logger.Error("failed to read fheos zone quotas", "err", err)
+		return nil, err
+	}
+
+	store, err := storage2.InitStorage(dbPath)
 
 	if err != nil {
 		logger.Error("failed to open storage for fheos State")
-		return err
+		return nil, err
 	}
 
-	err = store.PutVersion(FheosVersion)
+	_, err = store.Migrate(storage2.Migrations, FheosVersion, false)
 	if err != nil {
-		logger.Error("failed to write version into fheos db", "err", err)
-		return errors.New("failed to write version into fheos db")
+		logger.Error("failed to migrate fheos db", "err", err)
+		_ = store.Close()
+		return nil, err
+	}
+
+	state := createFheosState(*store, FheosVersion)
+	state.Quotas = quotas
+
+	// Resolved decryptions are reloaded, so that txs waiting on them don't need them to be recomputed after a restart
+	loaded, err := state.DecryptResults.Persist(&state.Storage)
+	if err != nil {
+		logger.Error("failed to load persisted decryption results", "err", err)
+		_ = store.Close()
+		return nil, err
+	}
+	if loaded > 0 {
+		logger.Info("loaded persisted decryption results", "count", loaded)
+	}
+	state.DecryptResults.StartSweeper()
+
+	if gcConfig, ok := getGCConfig(); ok {
+		state.Collector = storage2.NewRefCountCollector(&state.Storage, gcConfig)
+		state.Collector.Start()
+	}
+
+	return state, nil
+}
+
+func (fs *FheosState) Close() error {
+	if fs.Collector != nil {
+		fs.Collector.Stop()
+	}
+	fs.DecryptResults.Stop()
+
+	return fs.Storage.Close()
+}
+
+// InitializeFheosState initializes the global State, which is used by every call that doesn't specify its own state
+func InitializeFheosState() error {
+	// The previous state may hold the same db open
+	if State != nil {
+		if err := State.Close(); err != nil {
+			logger.Warn("failed to close previous fheos state", "err", err)
+		}
+		State = nil
 	}
 
-	createFheosState(*store, FheosVersion)
+	state, err := NewFheosState(getDbPath())
+	if err != nil {
+		return err
+	}
 
+	State = state
 	return nil
 }
 
-func GetSerializedDecryptionResult(key types.PendingDecryption) ([]byte, error) {
-	if State == nil {
+// OpenStorage opens the fheos db configured by the environment on its own, for offline tools. The db isn't migrated,
+// so one written by another version is refused. It must be closed when done
+func OpenStorage() (*storage2.FheosStorage, error) {
+	store, err := storage2.InitStorage(getDbPath())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := store.CheckVersion(FheosVersion); err != nil {
+		_ = store.Close()
+		if errors.Is(err, storage2.ErrOutdatedVersion) {
+			return nil, fmt.Errorf("%w, run `fheos migrate` first", err)
+		}
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// MigrateStorage brings the fheos db up to FheosVersion without initializing the rest of the state
+func MigrateStorage(dryRun bool) (storage2.MigrationReport, error) {
+	store, err := storage2.InitStorage(getDbPath())
+	if err != nil {
+		return storage2.MigrationReport{}, err
+	}
+	defer store.Close()
+
+	return store.Migrate(storage2.Migrations, FheosVersion, dryRun)
+}
+
+func (fs *FheosState) decryptResults() (*types.DecryptionResults, error) {
+	if fs == nil {
 		return nil, errors.New("fheos state is not initialized")
 	}
 
-	if State.DecryptResults == nil {
+	if fs.DecryptResults == nil {
 		return nil, errors.New("DecryptionResults is not initialized in fheos state")
 	}
 
-	return State.DecryptResults.GetSerializedDecryptionResult(key)
+	return fs.DecryptResults, nil
 }
 
-func LoadMultipleResolvedDecryptions(reader io.Reader) error {
-	// parse the number of resolved decryptions
-	var numDecryptions int32
-	err := binary.Read(reader, binary.LittleEndian, &numDecryptions)
+func (fs *FheosState) GetSerializedDecryptionResult(key types.PendingDecryption) ([]byte, error) {
+	results, err := fs.decryptResults()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	logger.Debug("Loading resolved decryptions", "numDecryptions", numDecryptions)
+	return results.GetSerializedDecryptionResult(key)
+}
 
-	for i := int32(0); i < numDecryptions; i++ {
-		err = LoadResolvedDecryption(reader)
-		if err != nil {
-			return err
-		}
+// SerializeMultipleResolvedDecryptions serializes the resolved decryptions of keys as one batch. It is only written in
+// the versioned, checksummed format with FHEOS_DECRYPTION_VERSIONED_BATCHES, since versions that predate the format
+// load it as empty
+func (fs *FheosState) SerializeMultipleResolvedDecryptions(keys []types.PendingDecryption) ([]byte, error) {
+	results, err := fs.decryptResults()
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	return results.SerializeMultipleResolvedDecryptions(keys)
 }
 
-func LoadResolvedDecryption(reader io.Reader) error {
-	if State == nil {
-		return errors.New("fheos state is not initialized")
+// LoadMultipleResolvedDecryptions loads a batch written by SerializeMultipleResolvedDecryptions (or a legacy,
+// count prefixed one). Nothing is loaded if any part of the batch is invalid
+func (fs *FheosState) LoadMultipleResolvedDecryptions(reader io.Reader) error {
+	results, err := fs.decryptResults()
+	if err != nil {
+		return err
+	}
+
+	loaded, err := results.LoadMultipleResolvedDecryptions(reader)
+	if err != nil {
+		return err
 	}
 
-	if State.DecryptResults == nil {
-		return errors.New("fheos state is not initialized")
+	logger.Debug("Loaded resolved decryptions", "numDecryptions", loaded)
+	return nil
+}
+
+func (fs *FheosState) LoadResolvedDecryption(reader io.Reader) error {
+	results, err := fs.decryptResults()
+	if err != nil {
+		return err
 	}
 
-	return State.DecryptResults.LoadResolvedDecryption(reader)
+	return results.LoadResolvedDecryption(reader)
+}
+
+// The functions below use the global State, chains with a state of their own call the FheosState methods instead
+
+func GetSerializedDecryptionResult(key types.PendingDecryption) ([]byte, error) {
+	return State.GetSerializedDecryptionResult(key)
+}
+
+func SerializeMultipleResolvedDecryptions(keys []types.PendingDecryption) ([]byte, error) {
+	return State.SerializeMultipleResolvedDecryptions(keys)
+}
+
+func LoadMultipleResolvedDecryptions(reader io.Reader) error {
+	return State.LoadMultipleResolvedDecryptions(reader)
+}
+
+func LoadResolvedDecryption(reader io.Reader) error {
+	return State.LoadResolvedDecryption(reader)
+}
+
+// BackupStorage writes a consistent checkpoint of the fheos db in use by tp to dir, without stopping the node
+func BackupStorage(dir string, tp *TxParams) (types.BackupManifest, error) {
+	return tp.state().Storage.Checkpoint(dir)
+}
+
+// RestoreStorage restores the checkpoint in dir as the fheos db configured by the environment, which must not exist yet
+func RestoreStorage(dir string) (types.BackupManifest, error) {
+	return storage2.RestoreCheckpoint(dir, getDbPath(), FheosVersion)
 }
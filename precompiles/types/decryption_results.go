@@ -1,11 +1,16 @@
 package types
 
 import (
+	"bytes"
+	"encoding/hex"
 	"fmt"
 	"math/big"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/fhenixprotocol/warp-drive/fhe-driver"
 )
 
@@ -19,17 +24,176 @@ type DecryptionRecord struct {
 	Timestamp time.Time
 }
 
+// DecryptionResultsConfig bounds the records kept by DecryptionResults. Zero values disable the respective bound
+type DecryptionResultsConfig struct {
+	// TTL is how long a resolved record is kept after its value was set
+	TTL time.Duration
+	// PendingTTL is how long a pending record (one still waiting for its value) is kept after it was created. Pending
+	// records are protected from every kind of eviction until then, so it should be longer than TTL. Without it pending
+	// records never expire, but aren't protected from MaxEntries either
+	PendingTTL time.Duration
+	// MaxEntries caps the number of records, the oldest evictable ones are dropped first when it is exceeded
+	MaxEntries int
+	// SweepInterval is how often the background sweeper drops expired records
+	SweepInterval time.Duration
+	// VersionedBatches writes batches of resolved decryptions in the versioned, checksummed format instead of the
+	// legacy one. Versions that predate the format load such a batch as empty, so it must only be enabled once every
+	// node that loads batches was upgraded
+	VersionedBatches bool
+}
+
 type DecryptionResults struct {
-	data map[PendingDecryption]DecryptionRecord
-	mu   sync.RWMutex
+	data   map[PendingDecryption]DecryptionRecord
+	mu     sync.RWMutex
+	config DecryptionResultsConfig
+	// store is where resolved records are written through to, see Persist
+	store NamespacedStorage
+	stop  chan struct{}
+	wg    sync.WaitGroup
 }
 
 func NewDecryptionResultsMap() *DecryptionResults {
+	return NewBoundedDecryptionResults(DecryptionResultsConfig{})
+}
+
+// NewBoundedDecryptionResults creates a DecryptionResults that evicts records according to config. Expired records
+// are only dropped by Sweep, which StartSweeper runs in the background
+func NewBoundedDecryptionResults(config DecryptionResultsConfig) *DecryptionResults {
 	return &DecryptionResults{
-		data: make(map[PendingDecryption]DecryptionRecord),
+		data:   make(map[PendingDecryption]DecryptionRecord),
+		config: config,
+	}
+}
+
+// expired returns true if record outlived its TTL at now. Pending records use PendingTTL instead
+func (dr *DecryptionResults) expired(record DecryptionRecord, now time.Time) bool {
+	ttl := dr.config.TTL
+	if record.Value == nil {
+		ttl = dr.config.PendingTTL
+	}
+	return ttl > 0 && now.Sub(record.Timestamp) >= ttl
+}
+
+// evictable returns true if record may be dropped to make room, which pending records only may once they expired
+func (dr *DecryptionResults) evictable(record DecryptionRecord, now time.Time) bool {
+	return record.Value != nil || dr.config.PendingTTL <= 0 || dr.expired(record, now)
+}
+
+// inserted bounds the records after one was added or replaced. Must be called with dr.mu held
+func (dr *DecryptionResults) inserted(now time.Time) {
+	dr.updateMetrics("capacity", dr.enforceMaxEntries(now))
+}
+
+// enforceMaxEntries drops the oldest evictable records until at most MaxEntries are left, and returns how many it
+// dropped. To avoid sorting on every insert, it makes room for a tenth of MaxEntries at once. Must be called with dr.mu held
+func (dr *DecryptionResults) enforceMaxEntries(now time.Time) int {
+	if dr.config.MaxEntries <= 0 || len(dr.data) <= dr.config.MaxEntries {
+		return 0
+	}
+
+	type candidate struct {
+		key       PendingDecryption
+		timestamp time.Time
+	}
+	var candidates []candidate
+	for key, record := range dr.data {
+		if dr.evictable(record, now) {
+			candidates = append(candidates, candidate{key, record.Timestamp})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].timestamp.Before(candidates[j].timestamp)
+	})
+
+	target := dr.config.MaxEntries - dr.config.MaxEntries/10
+	evicted := 0
+	for _, c := range candidates {
+		if len(dr.data) <= target {
+			break
+		}
+		dr.remove(c.key)
+		evicted++
+	}
+
+	if len(dr.data) > dr.config.MaxEntries {
+		log.Warn("decryption results exceed their limit, the remaining records are pending", "entries", len(dr.data), "max", dr.config.MaxEntries)
+	}
+	return evicted
+}
+
+// updateMetrics reports the number of records, and evicted records that were dropped for reason. Must be called with dr.mu held
+func (dr *DecryptionResults) updateMetrics(reason string, evicted int) {
+	if !metrics.Enabled {
+		return
+	}
+
+	metrics.GetOrRegisterGauge("fheos/decryptions/entries", nil).Update(int64(len(dr.data)))
+	if evicted > 0 {
+		metrics.GetOrRegisterCounter("fheos/decryptions/evicted/"+reason, nil).Inc(int64(evicted))
 	}
 }
 
+// Sweep drops every record that expired at now and returns how many were dropped
+func (dr *DecryptionResults) Sweep(now time.Time) int {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	swept := 0
+	for key, record := range dr.data {
+		if dr.expired(record, now) {
+			dr.remove(key)
+			swept++
+		}
+	}
+
+	dr.updateMetrics("ttl", swept)
+	return swept
+}
+
+// Len returns the number of records, pending ones included
+func (dr *DecryptionResults) Len() int {
+	dr.mu.RLock()
+	defer dr.mu.RUnlock()
+	return len(dr.data)
+}
+
+// StartSweeper runs Sweep every SweepInterval until Stop is called. It does nothing if neither TTL is configured
+func (dr *DecryptionResults) StartSweeper() {
+	if dr.config.SweepInterval <= 0 || (dr.config.TTL <= 0 && dr.config.PendingTTL <= 0) {
+		return
+	}
+
+	dr.stop = make(chan struct{})
+	dr.wg.Add(1)
+
+	go func() {
+		defer dr.wg.Done()
+		ticker := time.NewTicker(dr.config.SweepInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-dr.stop:
+				return
+			case now := <-ticker.C:
+				if swept := dr.Sweep(now); swept > 0 {
+					log.Debug("swept expired decryption results", "swept", swept)
+				}
+			}
+		}
+	}()
+}
+
+func (dr *DecryptionResults) Stop() {
+	if dr.stop == nil {
+		return
+	}
+
+	close(dr.stop)
+	dr.wg.Wait()
+	dr.stop = nil
+}
+
 // CreateEmptyRecord creates a new empty record for the given PendingDecryption key
 // if it doesn't already exist in the DecryptionResults map.
 // This function is intended to be used once a parallel decryption is initiated,
@@ -40,7 +204,9 @@ func (dr *DecryptionResults) CreateEmptyRecord(key PendingDecryption) {
 	dr.mu.Lock()
 	defer dr.mu.Unlock()
 	if _, exists := dr.data[key]; !exists {
-		dr.data[key] = DecryptionRecord{Value: nil, Timestamp: time.Now()}
+		now := time.Now()
+		dr.data[key] = DecryptionRecord{Value: nil, Timestamp: now}
+		dr.inserted(now)
 	}
 }
 
@@ -53,7 +219,14 @@ func (dr *DecryptionResults) SetValue(key PendingDecryption, value any) error {
 		return err
 	}
 
-	dr.data[key] = DecryptionRecord{Value: value, Timestamp: time.Now()}
+	now := time.Now()
+	record := DecryptionRecord{Value: value, Timestamp: now}
+	if err := dr.persist(key, record); err != nil {
+		return err
+	}
+
+	dr.data[key] = record
+	dr.inserted(now)
 	return nil
 }
 
@@ -80,7 +253,44 @@ func (dr *DecryptionResults) SetRecord(key PendingDecryption, record DecryptionR
 	dr.mu.Lock()
 	defer dr.mu.Unlock()
 
+	if err := dr.persist(key, record); err != nil {
+		return err
+	}
+
 	dr.data[key] = record
+	dr.inserted(time.Now())
+	return nil
+}
+
+// setRecords sets the records of entries at once, so that either all of them or, if any can't be set, none are
+func (dr *DecryptionResults) setRecords(entries []resolvedDecryption) error {
+	for _, entry := range entries {
+		if err := assertCorrectValueType(entry.key.Type, entry.record.Value); err != nil {
+			return err
+		}
+	}
+
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	for i, entry := range entries {
+		if err := dr.persist(entry.key, entry.record); err != nil {
+			// Roll back what was written so far, so that a restart doesn't load half of the entries
+			for _, written := range entries[:i] {
+				if previous, exists := dr.data[written.key]; exists && previous.Value != nil {
+					_ = dr.persist(written.key, previous)
+				} else {
+					dr.unpersist(written.key)
+				}
+			}
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		dr.data[entry.key] = entry.record
+	}
+	dr.inserted(time.Now())
 	return nil
 }
 
@@ -107,5 +317,102 @@ func assertCorrectValueType(decryptionType PrecompileName, value any) error {
 func (dr *DecryptionResults) Remove(key PendingDecryption) {
 	dr.mu.Lock()
 	defer dr.mu.Unlock()
+	dr.remove(key)
+	dr.updateMetrics("", 0)
+}
+
+// remove drops key from memory and from the store. Must be called with dr.mu held
+func (dr *DecryptionResults) remove(key PendingDecryption) {
+	record, exists := dr.data[key]
+	if !exists {
+		return
+	}
 	delete(dr.data, key)
+
+	// Pending records are never persisted
+	if record.Value != nil {
+		dr.unpersist(key)
+	}
+}
+
+// unpersist deletes key from the store, if there is one. Must be called with dr.mu held
+func (dr *DecryptionResults) unpersist(key PendingDecryption) {
+	if dr.store == nil {
+		return
+	}
+
+	serializedKey, err := key.Serialize()
+	if err == nil {
+		err = dr.store.Delete(NamespaceDecryptionResults, serializedKey)
+	}
+	if err != nil {
+		log.Warn("failed to delete persisted decryption result", "hash", key.Hash.Hex(), "type", key.Type, "err", err)
+	}
+}
+
+// persist writes record through to the store, if there is one. Must be called with dr.mu held
+func (dr *DecryptionResults) persist(key PendingDecryption, record DecryptionRecord) error {
+	if dr.store == nil {
+		return nil
+	}
+
+	serializedKey, err := key.Serialize()
+	if err != nil {
+		return err
+	}
+	serializedRecord, err := record.Serialize(key.Type)
+	if err != nil {
+		return err
+	}
+
+	return dr.store.Put(NamespaceDecryptionResults, serializedKey, serializedRecord)
+}
+
+// Persist loads the resolved records kept in store, and from then on writes every resolved record through to it, so
+// that they survive a restart. Records that expired in the meantime, or can't be decoded, are dropped from the store.
+// Pending records are only ever kept in memory. It returns the number of loaded records
+func (dr *DecryptionResults) Persist(store NamespacedStorage) (int, error) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	now := time.Now()
+	loaded := 0
+	var stale [][]byte
+	err := store.IteratePrefix(NamespaceDecryptionResults, nil, func(k []byte, v []byte) bool {
+		var key PendingDecryption
+		var record DecryptionRecord
+		reader := bytes.NewReader(k)
+		if err := key.Deserialize(reader); err != nil || reader.Len() != 0 {
+			log.Warn("dropping undecodable persisted decryption key", "key", hex.EncodeToString(k), "err", err)
+			stale = append(stale, append([]byte{}, k...))
+			return true
+		}
+		if err := record.Deserialize(bytes.NewReader(v), key.Type); err != nil || assertCorrectValueType(key.Type, record.Value) != nil {
+			log.Warn("dropping undecodable persisted decryption result", "hash", key.Hash.Hex(), "type", key.Type, "err", err)
+			stale = append(stale, append([]byte{}, k...))
+			return true
+		}
+
+		if dr.expired(record, now) {
+			stale = append(stale, append([]byte{}, k...))
+			return true
+		}
+
+		dr.data[key] = record
+		loaded++
+		return true
+	})
+	if err != nil {
+		return loaded, err
+	}
+
+	for _, k := range stale {
+		if err := store.Delete(NamespaceDecryptionResults, k); err != nil {
+			return loaded, err
+		}
+	}
+
+	dr.store = store
+	dr.inserted(now)
+	return loaded, nil
 }
@@ -5,11 +5,86 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"math/big"
 	"time"
 )
 
+// A batch of resolved decryptions is laid out as:
+//
+//	magic (4) | version (1) | count (4) | body length (4) | body | checksum (4)
+//
+// where the body is count entries of:
+//
+//	key (36, see PendingDecryption.Serialize) | record length (4) | record (see DecryptionRecord.Serialize)
+//
+// The checksum is the CRC-32C of everything before it, and all integers are little endian like the rest of the
+// serialization. Records are length prefixed so that readers can skip result types they don't know yet.
+// Legacy batches are a bare int32 count followed by key | record pairs. The last magic byte has its high bit set, so
+// the magic read as a legacy count is negative, which this version rejects as a legacy batch.
+// Readers older than this format don't: their loop over a negative count runs zero times, so they silently load an
+// empty batch. Legacy batches are therefore still written unless DecryptionResultsConfig.VersionedBatches is set,
+// which must wait until every node that loads batches was upgraded
+var batchMagic = [4]byte{'f', 'd', 'r', 0xC7}
+
+const (
+	BatchVersion byte = 1
+
+	batchHeaderSize   = 4 + 1 + 4 + 4
+	batchChecksumSize = 4
+	pendingKeySize    = 32 + 4
+
+	// maxBatchBodySize bounds the allocation made for the body of a batch before its checksum can be verified
+	maxBatchBodySize = 64 * 1024 * 1024
+)
+
+var batchChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Decryption records come from other nodes, so every length read from them is bounded before anything is allocated
+const (
+	// MaxSealedOutputSize is far more than the sealed output of the widest type takes
+	MaxSealedOutputSize = 16 * 1024
+	// MaxDecryptedSize is the size of the widest plaintext, a uint256
+	MaxDecryptedSize = 32
+)
+
+// Negative Decrypt results (of signed types) don't fit the plain length prefixed magnitude, and are written in an
+// envelope instead:
+//
+//	decryptEnvelopeMarker (4) | envelope version (1) | sign (1) | len(magnitude) (4) | magnitude
+//
+// The marker takes the place of the length, and is a valid int32 larger than any plain length, so readers that
+// predate the envelope reject the record with their length check instead of misreading it
+const (
+	decryptEnvelopeMarker  int32 = 1 << 16
+	DecryptEnvelopeVersion byte  = 1
+
+	signPositive byte = 0
+	signNegative byte = 1
+)
+
+var (
+	ErrBatchChecksum           = errors.New("resolved decryptions batch doesn't match its checksum")
+	ErrUnsupportedBatchVersion = errors.New("unsupported resolved decryptions batch version")
+	// ErrUnknownResultType is returned for decryptions of a PrecompileName that has no result (or no result this version knows)
+	ErrUnknownResultType = errors.New("unknown decryption result type")
+	ErrResultTooLarge    = errors.New("decryption result is too large")
+	// ErrUnsupportedEnvelope is returned for a Decrypt result envelope of a version this one doesn't know
+	ErrUnsupportedEnvelope = errors.New("unsupported decryption result envelope")
+)
+
+// resolvedDecryption is an entry of a batch
+type resolvedDecryption struct {
+	key    PendingDecryption
+	record DecryptionRecord
+}
+
+// isKnownResultType returns true for the result types this version can deserialize
+func isKnownResultType(t PrecompileName) bool {
+	return t == SealOutput || t == Require || t == Decrypt
+}
+
 // GetSerializedDecryptionResult returns a byte-serialization of a decryption result.
 func (dr *DecryptionResults) GetSerializedDecryptionResult(key PendingDecryption) ([]byte, error) {
 	// The structure the encoded message is:
@@ -36,6 +111,173 @@ func (dr *DecryptionResults) GetSerializedDecryptionResult(key PendingDecryption
 	return append(serializedKey, serializedResult...), nil
 }
 
+// SerializeMultipleResolvedDecryptions serializes the resolved records of keys as a batch, in the order of keys.
+// Every key must have a resolved record. The batch is in the legacy format unless the versioned one is enabled
+func (dr *DecryptionResults) SerializeMultipleResolvedDecryptions(keys []PendingDecryption) ([]byte, error) {
+	versioned := dr.config.VersionedBatches
+	body := new(bytes.Buffer)
+	for _, key := range keys {
+		result, ok := dr.Get(key)
+		if !ok {
+			return nil, fmt.Errorf("tried to serialize result of unknown decryption %s", key.Hash.Hex())
+		}
+		if result.Value == nil {
+			return nil, fmt.Errorf("tried to serialize result of decryption %s which is still pending", key.Hash.Hex())
+		}
+
+		serializedKey, err := key.Serialize()
+		if err != nil {
+			return nil, err
+		}
+		serializedRecord, err := result.Serialize(key.Type)
+		if err != nil {
+			return nil, err
+		}
+
+		body.Write(serializedKey)
+		// Legacy batches don't length prefix their records
+		if versioned {
+			if err := binary.Write(body, binary.LittleEndian, uint32(len(serializedRecord))); err != nil {
+				return nil, err
+			}
+		}
+		body.Write(serializedRecord)
+	}
+
+	if !versioned {
+		return append(binary.LittleEndian.AppendUint32(nil, uint32(len(keys))), body.Bytes()...), nil
+	}
+	return encodeBatch(uint32(len(keys)), body.Bytes())
+}
+
+func encodeBatch(count uint32, body []byte) ([]byte, error) {
+	if len(body) > maxBatchBodySize {
+		return nil, fmt.Errorf("resolved decryptions batch of %d bytes is too large", len(body))
+	}
+
+	batch := make([]byte, batchHeaderSize, batchHeaderSize+len(body)+batchChecksumSize)
+	copy(batch[0:4], batchMagic[:])
+	batch[4] = BatchVersion
+	binary.LittleEndian.PutUint32(batch[5:9], count)
+	binary.LittleEndian.PutUint32(batch[9:13], uint32(len(body)))
+	batch = append(batch, body...)
+	return binary.LittleEndian.AppendUint32(batch, crc32.Checksum(batch, batchChecksumTable)), nil
+}
+
+// LoadMultipleResolvedDecryptions reads a batch of resolved decryptions, in either the current or the legacy format,
+// and applies it. The batch is applied entirely or, if any of it is invalid, not at all. Entries of result types this
+// version doesn't know are skipped. It returns the number of applied entries
+func (dr *DecryptionResults) LoadMultipleResolvedDecryptions(reader io.Reader) (int, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(reader, prefix[:]); err != nil {
+		return 0, err
+	}
+
+	var entries []resolvedDecryption
+	var err error
+	if prefix == batchMagic {
+		entries, err = decodeBatch(reader)
+	} else {
+		entries, err = decodeLegacyBatch(int32(binary.LittleEndian.Uint32(prefix[:])), reader)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := dr.setRecords(entries); err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+func decodeBatch(reader io.Reader) ([]resolvedDecryption, error) {
+	header := make([]byte, batchHeaderSize)
+	copy(header, batchMagic[:])
+	if _, err := io.ReadFull(reader, header[4:]); err != nil {
+		return nil, err
+	}
+
+	if header[4] != BatchVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedBatchVersion, header[4])
+	}
+	count := binary.LittleEndian.Uint32(header[5:9])
+	bodyLen := binary.LittleEndian.Uint32(header[9:13])
+	if bodyLen > maxBatchBodySize {
+		return nil, fmt.Errorf("resolved decryptions batch body of %d bytes is too large", bodyLen)
+	}
+
+	rest := make([]byte, int(bodyLen)+batchChecksumSize)
+	if _, err := io.ReadFull(reader, rest); err != nil {
+		return nil, err
+	}
+	body := rest[:bodyLen]
+	checksum := crc32.Update(crc32.Checksum(header, batchChecksumTable), batchChecksumTable, body)
+	if checksum != binary.LittleEndian.Uint32(rest[bodyLen:]) {
+		return nil, ErrBatchChecksum
+	}
+
+	entries := make([]resolvedDecryption, 0, min(int(count), len(body)/(pendingKeySize+4)))
+	bodyReader := bytes.NewReader(body)
+	for i := uint32(0); i < count; i++ {
+		var entry resolvedDecryption
+		err := entry.key.Deserialize(bodyReader)
+		unknownType := errors.Is(err, ErrUnknownResultType)
+		if err != nil && !unknownType {
+			return nil, fmt.Errorf("entry %d: %w", i, err)
+		}
+
+		var recordLen uint32
+		if err := binary.Read(bodyReader, binary.LittleEndian, &recordLen); err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i, err)
+		}
+		if uint64(recordLen) > uint64(bodyReader.Len()) {
+			return nil, fmt.Errorf("entry %d: %w", i, io.ErrUnexpectedEOF)
+		}
+		record := make([]byte, recordLen)
+		_, _ = bodyReader.Read(record)
+
+		// Written by a newer version, there is nothing this version could do with it
+		if unknownType {
+			continue
+		}
+
+		recordReader := bytes.NewReader(record)
+		if err := entry.record.Deserialize(recordReader, entry.key.Type); err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i, err)
+		}
+		if recordReader.Len() != 0 {
+			return nil, fmt.Errorf("entry %d: %d trailing bytes in record", i, recordReader.Len())
+		}
+		entries = append(entries, entry)
+	}
+
+	if bodyReader.Len() != 0 {
+		return nil, fmt.Errorf("%d trailing bytes in resolved decryptions batch", bodyReader.Len())
+	}
+	return entries, nil
+}
+
+// decodeLegacyBatch reads the count key | record pairs that follow a legacy batch count
+func decodeLegacyBatch(count int32, reader io.Reader) ([]resolvedDecryption, error) {
+	if count < 0 {
+		return nil, fmt.Errorf("invalid resolved decryptions batch: negative legacy count %d", count)
+	}
+
+	var entries []resolvedDecryption
+	for i := int32(0); i < count; i++ {
+		var entry resolvedDecryption
+		if err := entry.key.Deserialize(reader); err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i, err)
+		}
+		if err := entry.record.Deserialize(reader, entry.key.Type); err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
 func (dr *DecryptionResults) LoadResolvedDecryption(reader io.Reader) error {
 	var pendingDecryptionKey PendingDecryption
 	err := pendingDecryptionKey.Deserialize(reader)
@@ -69,7 +311,8 @@ func (p *PendingDecryption) Serialize() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// Deserialize binary data into the struct
+// Deserialize binary data into the struct. Keys of a type that has no result are rejected with ErrUnknownResultType,
+// but are still read completely so that the caller can skip their record
 func (p *PendingDecryption) Deserialize(reader io.Reader) error {
 	// Read the Hash (32 bytes)
 	if err := binary.Read(reader, binary.LittleEndian, &p.Hash); err != nil {
@@ -83,9 +326,75 @@ func (p *PendingDecryption) Deserialize(reader io.Reader) error {
 	}
 	p.Type = PrecompileName(typeVal)
 
+	if !isKnownResultType(p.Type) {
+		return fmt.Errorf("%w: %d", ErrUnknownResultType, typeVal)
+	}
 	return nil
 }
 
+// readBoundedBytes reads an int32 length prefixed byte slice of at most maxLen bytes
+func readBoundedBytes(reader io.Reader, maxLen int32) ([]byte, error) {
+	var length int32
+	if err := binary.Read(reader, binary.LittleEndian, &length); err != nil {
+		return nil, err
+	}
+	return readBytesOfLength(reader, length, maxLen)
+}
+
+// readBytesOfLength reads a byte slice whose length was read already, if it is within maxLen
+func readBytesOfLength(reader io.Reader, length int32, maxLen int32) ([]byte, error) {
+	if length < 0 {
+		return nil, fmt.Errorf("negative decryption result length %d", length)
+	}
+	if length > maxLen {
+		return nil, fmt.Errorf("%w: %d bytes, at most %d are allowed", ErrResultTooLarge, length, maxLen)
+	}
+
+	value := make([]byte, length)
+	if _, err := io.ReadFull(reader, value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// readDecryptedValue reads the result of a Decrypt, either a plain magnitude or an envelope with its sign
+func readDecryptedValue(reader io.Reader) (*big.Int, error) {
+	var length int32
+	if err := binary.Read(reader, binary.LittleEndian, &length); err != nil {
+		return nil, err
+	}
+
+	if length != decryptEnvelopeMarker {
+		magnitude, err := readBytesOfLength(reader, length, MaxDecryptedSize)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(magnitude), nil
+	}
+
+	var header [2]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != DecryptEnvelopeVersion {
+		return nil, fmt.Errorf("%w: version %d", ErrUnsupportedEnvelope, header[0])
+	}
+	if header[1] != signPositive && header[1] != signNegative {
+		return nil, fmt.Errorf("invalid sign %d in decryption result", header[1])
+	}
+
+	magnitude, err := readBoundedBytes(reader, MaxDecryptedSize)
+	if err != nil {
+		return nil, err
+	}
+
+	value := new(big.Int).SetBytes(magnitude)
+	if header[1] == signNegative {
+		value.Neg(value)
+	}
+	return value, nil
+}
+
 // Serialize a decryptionRecord into binary, based on the resultType
 func (d *DecryptionRecord) Serialize(resultType PrecompileName) ([]byte, error) {
 	// The structure the encoded message is:
@@ -96,7 +405,8 @@ func (d *DecryptionRecord) Serialize(resultType PrecompileName) ([]byte, error)
 	// if resultType == Require:
 	//    result (bool)
 	// if resultType == Decrypt:
-	//    len(result) | result (byte slice)
+	//    len(result) | result (byte slice of the absolute value), in an envelope with its sign if it is negative
+	//    (see decryptEnvelopeMarker)
 	buf := new(bytes.Buffer)
 
 	// Serialize the Value based on resultType
@@ -108,6 +418,9 @@ func (d *DecryptionRecord) Serialize(resultType PrecompileName) ([]byte, error)
 		}
 		// Convert the string to a byte slice
 		valueBytes := []byte(value)
+		if len(valueBytes) > MaxSealedOutputSize {
+			return nil, fmt.Errorf("%w: sealed output of %d bytes", ErrResultTooLarge, len(valueBytes))
+		}
 
 		// Write the length of the byte slice, then the slice itself
 		if err := binary.Write(buf, binary.LittleEndian, int32(len(valueBytes))); err != nil {
@@ -130,8 +443,18 @@ func (d *DecryptionRecord) Serialize(resultType PrecompileName) ([]byte, error)
 		if !ok {
 			return nil, fmt.Errorf("expected *big.Int for Decrypt")
 		}
-		// Write the big.Int as a byte slice
+		// Write the magnitude of the big.Int as a byte slice. Signed types decrypt to negative values, which are
+		// wrapped in an envelope, so non-negative ones are still written the way older versions read them
 		bigIntBytes := value.Bytes()
+		if len(bigIntBytes) > MaxDecryptedSize {
+			return nil, fmt.Errorf("%w: decrypted value doesn't fit 256 bits", ErrResultTooLarge)
+		}
+		if value.Sign() < 0 {
+			if err := binary.Write(buf, binary.LittleEndian, decryptEnvelopeMarker); err != nil {
+				return nil, err
+			}
+			buf.Write([]byte{DecryptEnvelopeVersion, signNegative})
+		}
 		if err := binary.Write(buf, binary.LittleEndian, int32(len(bigIntBytes))); err != nil {
 			return nil, err
 		}
@@ -156,12 +479,8 @@ func (d *DecryptionRecord) Deserialize(reader io.Reader, resultType PrecompileNa
 	// Deserialize the Value based on resultType
 	switch resultType {
 	case SealOutput:
-		var length int32
-		if err := binary.Read(reader, binary.LittleEndian, &length); err != nil {
-			return err
-		}
-		byteSlice := make([]byte, length)
-		if err := binary.Read(reader, binary.LittleEndian, &byteSlice); err != nil {
+		byteSlice, err := readBoundedBytes(reader, MaxSealedOutputSize)
+		if err != nil {
 			return err
 		}
 		d.Value = string(byteSlice)
@@ -172,17 +491,13 @@ func (d *DecryptionRecord) Deserialize(reader io.Reader, resultType PrecompileNa
 		}
 		d.Value = value
 	case Decrypt:
-		var length int32
-		if err := binary.Read(reader, binary.LittleEndian, &length); err != nil {
+		value, err := readDecryptedValue(reader)
+		if err != nil {
 			return err
 		}
-		bigIntBytes := make([]byte, length)
-		if err := binary.Read(reader, binary.LittleEndian, &bigIntBytes); err != nil {
-			return err
-		}
-		d.Value = new(big.Int).SetBytes(bigIntBytes)
+		d.Value = value
 	default:
-		return fmt.Errorf("tried to deserialize unsupported type of result")
+		return fmt.Errorf("%w: tried to deserialize result of %d", ErrUnknownResultType, resultType)
 	}
 
 	// Deserialize the Timestamp as int64 and convert to time.Time
@@ -0,0 +1,395 @@
+package types
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/fhenixprotocol/warp-drive/fhe-driver"
+	"github.com/stretchr/testify/assert"
+)
+
+func resolvedDecryptionsForTest(t *testing.T) (*DecryptionResults, []PendingDecryption) {
+	dr := NewBoundedDecryptionResults(DecryptionResultsConfig{VersionedBatches: true})
+	keys := []PendingDecryption{
+		{Hash: fhe.Hash{1}, Type: Require},
+		{Hash: fhe.Hash{2}, Type: Decrypt},
+		{Hash: fhe.Hash{3}, Type: SealOutput},
+	}
+
+	assert.NoError(t, dr.SetValue(keys[0], true))
+	assert.NoError(t, dr.SetValue(keys[1], big.NewInt(1234567)))
+	assert.NoError(t, dr.SetValue(keys[2], "sealed output"))
+	return dr, keys
+}
+
+func assertSameRecords(t *testing.T, expected *DecryptionResults, actual *DecryptionResults, keys []PendingDecryption) {
+	for _, key := range keys {
+		want, _ := expected.Get(key)
+		got, exists := actual.Get(key)
+		assert.True(t, exists, "missing %s", key.Hash.Hex())
+		assert.Equal(t, want.Value, got.Value)
+		assert.Equal(t, want.Timestamp.UnixNano(), got.Timestamp.UnixNano())
+	}
+}
+
+// failingStore is a mapStore that can't be written to
+type failingStore struct {
+	mapStore
+}
+
+func (failingStore) Put(DataType, []byte, []byte) error {
+	return errors.New("failed to write")
+}
+
+func TestResolvedDecryptionsBatch(t *testing.T) {
+	t.Run("RoundTrip", func(t *testing.T) {
+		dr, keys := resolvedDecryptionsForTest(t)
+		batch, err := dr.SerializeMultipleResolvedDecryptions(keys)
+		assert.NoError(t, err)
+
+		loaded := NewDecryptionResultsMap()
+		n, err := loaded.LoadMultipleResolvedDecryptions(bytes.NewReader(batch))
+		assert.NoError(t, err)
+		assert.Equal(t, len(keys), n)
+		assertSameRecords(t, dr, loaded, keys)
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		batch, err := NewDecryptionResultsMap().SerializeMultipleResolvedDecryptions(nil)
+		assert.NoError(t, err)
+
+		n, err := NewDecryptionResultsMap().LoadMultipleResolvedDecryptions(bytes.NewReader(batch))
+		assert.NoError(t, err)
+		assert.Equal(t, 0, n)
+	})
+
+	t.Run("PendingCantBeSerialized", func(t *testing.T) {
+		dr, keys := resolvedDecryptionsForTest(t)
+		pending := PendingDecryption{Hash: fhe.Hash{4}, Type: Decrypt}
+		dr.CreateEmptyRecord(pending)
+
+		_, err := dr.SerializeMultipleResolvedDecryptions(append(keys, pending))
+		assert.Error(t, err)
+	})
+
+	t.Run("SkipsUnknownTypes", func(t *testing.T) {
+		dr, keys := resolvedDecryptionsForTest(t)
+		known, err := dr.SerializeMultipleResolvedDecryptions(keys)
+		assert.NoError(t, err)
+
+		// A newer version adds an entry of a result type this one doesn't know, in between the known ones
+		body := append([]byte{}, known[batchHeaderSize:len(known)-batchChecksumSize]...)
+		unknownKey, err := (&PendingDecryption{Hash: fhe.Hash{9}, Type: PrecompileName(200)}).Serialize()
+		assert.NoError(t, err)
+		unknown := append(unknownKey, binary.LittleEndian.AppendUint32(nil, 5)...)
+		unknown = append(unknown, 1, 2, 3, 4, 5)
+		body = append(unknown, body...)
+
+		batch, err := encodeBatch(uint32(len(keys)+1), body)
+		assert.NoError(t, err)
+
+		loaded := NewDecryptionResultsMap()
+		n, err := loaded.LoadMultipleResolvedDecryptions(bytes.NewReader(batch))
+		assert.NoError(t, err)
+		assert.Equal(t, len(keys), n)
+		assertSameRecords(t, dr, loaded, keys)
+	})
+
+	t.Run("ChecksumMismatchAppliesNothing", func(t *testing.T) {
+		dr, keys := resolvedDecryptionsForTest(t)
+		batch, err := dr.SerializeMultipleResolvedDecryptions(keys)
+		assert.NoError(t, err)
+		batch[batchHeaderSize+pendingKeySize+4] ^= 1
+
+		loaded := NewDecryptionResultsMap()
+		_, err = loaded.LoadMultipleResolvedDecryptions(bytes.NewReader(batch))
+		assert.ErrorIs(t, err, ErrBatchChecksum)
+		assert.Equal(t, 0, loaded.Len())
+	})
+
+	t.Run("TruncatedAppliesNothing", func(t *testing.T) {
+		dr, keys := resolvedDecryptionsForTest(t)
+		batch, err := dr.SerializeMultipleResolvedDecryptions(keys)
+		assert.NoError(t, err)
+
+		for _, size := range []int{2, batchHeaderSize - 1, batchHeaderSize + 10, len(batch) - 1} {
+			loaded := NewDecryptionResultsMap()
+			_, err = loaded.LoadMultipleResolvedDecryptions(bytes.NewReader(batch[:size]))
+			assert.Error(t, err, "size %d", size)
+			assert.Equal(t, 0, loaded.Len())
+		}
+	})
+
+	t.Run("InvalidEntryAppliesNothing", func(t *testing.T) {
+		dr, keys := resolvedDecryptionsForTest(t)
+		batch, err := dr.SerializeMultipleResolvedDecryptions(keys)
+		assert.NoError(t, err)
+
+		// Claim one more entry than there is, with a valid checksum
+		body := batch[batchHeaderSize : len(batch)-batchChecksumSize]
+		batch, err = encodeBatch(uint32(len(keys)+1), body)
+		assert.NoError(t, err)
+
+		loaded := NewDecryptionResultsMap()
+		_, err = loaded.LoadMultipleResolvedDecryptions(bytes.NewReader(batch))
+		assert.Error(t, err)
+		assert.Equal(t, 0, loaded.Len())
+	})
+
+	t.Run("UnsupportedVersion", func(t *testing.T) {
+		dr, keys := resolvedDecryptionsForTest(t)
+		batch, err := dr.SerializeMultipleResolvedDecryptions(keys)
+		assert.NoError(t, err)
+		batch[4] = BatchVersion + 1
+
+		_, err = NewDecryptionResultsMap().LoadMultipleResolvedDecryptions(bytes.NewReader(batch))
+		assert.ErrorIs(t, err, ErrUnsupportedBatchVersion)
+	})
+
+	t.Run("Legacy", func(t *testing.T) {
+		dr, keys := resolvedDecryptionsForTest(t)
+		legacy := binary.LittleEndian.AppendUint32(nil, uint32(len(keys)))
+		for _, key := range keys {
+			serialized, err := dr.GetSerializedDecryptionResult(key)
+			assert.NoError(t, err)
+			legacy = append(legacy, serialized...)
+		}
+
+		loaded := NewDecryptionResultsMap()
+		n, err := loaded.LoadMultipleResolvedDecryptions(bytes.NewReader(legacy))
+		assert.NoError(t, err)
+		assert.Equal(t, len(keys), n)
+		assertSameRecords(t, dr, loaded, keys)
+
+		// A legacy batch that breaks off doesn't apply its first entries either
+		loaded = NewDecryptionResultsMap()
+		_, err = loaded.LoadMultipleResolvedDecryptions(bytes.NewReader(legacy[:len(legacy)-1]))
+		assert.Error(t, err)
+		assert.Equal(t, 0, loaded.Len())
+
+		// A negative count is corrupt, not an empty batch
+		negative := binary.LittleEndian.AppendUint32(nil, uint32(0xffffff00))
+		_, err = NewDecryptionResultsMap().LoadMultipleResolvedDecryptions(bytes.NewReader(negative))
+		assert.Error(t, err)
+	})
+
+	t.Run("LegacyUnlessVersioned", func(t *testing.T) {
+		dr, keys := resolvedDecryptionsForTest(t)
+		legacyWriter := NewDecryptionResultsMap()
+		for _, key := range keys {
+			record, _ := dr.Get(key)
+			assert.NoError(t, legacyWriter.SetValue(key, record.Value))
+		}
+
+		batch, err := legacyWriter.SerializeMultipleResolvedDecryptions(keys)
+		assert.NoError(t, err)
+
+		// A reader that predates the versioned format reads the count and the entries that follow it
+		reader := bytes.NewReader(batch)
+		var count int32
+		assert.NoError(t, binary.Read(reader, binary.LittleEndian, &count))
+		assert.Equal(t, int32(len(keys)), count)
+		for i := int32(0); i < count; i++ {
+			var entry resolvedDecryption
+			assert.NoError(t, entry.key.Deserialize(reader))
+			assert.NoError(t, entry.record.Deserialize(reader, entry.key.Type))
+		}
+		assert.Zero(t, reader.Len())
+
+		loaded := NewDecryptionResultsMap()
+		n, err := loaded.LoadMultipleResolvedDecryptions(bytes.NewReader(batch))
+		assert.NoError(t, err)
+		assert.Equal(t, len(keys), n)
+		assertSameRecords(t, legacyWriter, loaded, keys)
+	})
+
+	t.Run("FailedApplyLoadsNothing", func(t *testing.T) {
+		dr, keys := resolvedDecryptionsForTest(t)
+		batch, err := dr.SerializeMultipleResolvedDecryptions(keys)
+		assert.NoError(t, err)
+
+		loaded := NewBoundedDecryptionResults(DecryptionResultsConfig{TTL: time.Hour})
+		_, err = loaded.Persist(failingStore{mapStore{}})
+		assert.NoError(t, err)
+		n, err := loaded.LoadMultipleResolvedDecryptions(bytes.NewReader(batch))
+		assert.Error(t, err)
+		assert.Zero(t, n)
+		assert.Equal(t, 0, loaded.Len())
+	})
+
+	t.Run("PersistsAllEntries", func(t *testing.T) {
+		dr, keys := resolvedDecryptionsForTest(t)
+		batch, err := dr.SerializeMultipleResolvedDecryptions(keys)
+		assert.NoError(t, err)
+
+		store := mapStore{}
+		loaded := NewBoundedDecryptionResults(DecryptionResultsConfig{TTL: time.Hour})
+		_, err = loaded.Persist(store)
+		assert.NoError(t, err)
+		_, err = loaded.LoadMultipleResolvedDecryptions(bytes.NewReader(batch))
+		assert.NoError(t, err)
+		assert.Len(t, store, len(keys))
+	})
+}
+
+func TestDecryptionRecordBounds(t *testing.T) {
+	withLength := func(length int32, payload ...byte) []byte {
+		return append(binary.LittleEndian.AppendUint32(nil, uint32(length)), payload...)
+	}
+	envelope := func(version byte, sign byte, length int32, payload ...byte) []byte {
+		return withLength(decryptEnvelopeMarker, append([]byte{version, sign}, withLength(length, payload...)...)...)
+	}
+
+	for name, tc := range map[string]struct {
+		resultType PrecompileName
+		data       []byte
+	}{
+		"NegativeSealOutputLength": {SealOutput, withLength(-1)},
+		"HugeSealOutputLength":     {SealOutput, withLength(1 << 30)},
+		"NegativeDecryptLength":    {Decrypt, withLength(-5)},
+		"MinInt32DecryptLength":    {Decrypt, withLength(math.MinInt32)},
+		"DecryptWiderThanUint256":  {Decrypt, withLength(MaxDecryptedSize+1, make([]byte, MaxDecryptedSize+1)...)},
+		"DecryptBelowInt256":       {Decrypt, envelope(DecryptEnvelopeVersion, signNegative, MaxDecryptedSize+1, make([]byte, MaxDecryptedSize+1)...)},
+		"UnknownEnvelopeVersion":   {Decrypt, envelope(DecryptEnvelopeVersion+1, signNegative, 1, 1)},
+		"InvalidSign":              {Decrypt, envelope(DecryptEnvelopeVersion, 2, 1, 1)},
+		"UnknownType":              {PrecompileName(99), withLength(1, 1)},
+		"TruncatedPayload":         {SealOutput, withLength(10, 1, 2, 3)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var record DecryptionRecord
+			assert.Error(t, record.Deserialize(bytes.NewReader(tc.data), tc.resultType))
+		})
+	}
+
+	t.Run("SerializeRejectsOversizedValues", func(t *testing.T) {
+		_, err := (&DecryptionRecord{Value: new(big.Int).Lsh(big.NewInt(1), 256)}).Serialize(Decrypt)
+		assert.ErrorIs(t, err, ErrResultTooLarge)
+		_, err = (&DecryptionRecord{Value: string(make([]byte, MaxSealedOutputSize+1))}).Serialize(SealOutput)
+		assert.ErrorIs(t, err, ErrResultTooLarge)
+	})
+
+	t.Run("SignedDecryptRoundTrip", func(t *testing.T) {
+		minInt256 := new(big.Int).Neg(new(big.Int).Lsh(big.NewInt(1), 255))
+		for _, value := range []*big.Int{big.NewInt(-1), big.NewInt(-128), big.NewInt(0), big.NewInt(127), minInt256} {
+			record := DecryptionRecord{Value: value, Timestamp: time.Unix(0, 42)}
+			serialized, err := record.Serialize(Decrypt)
+			assert.NoError(t, err)
+
+			var loaded DecryptionRecord
+			assert.NoError(t, loaded.Deserialize(bytes.NewReader(serialized), Decrypt))
+			assert.Equal(t, 0, value.Cmp(loaded.Value.(*big.Int)), "%s round-tripped to %s", value, loaded.Value)
+		}
+
+		// A negative result is persisted, so the decryption is resolved instead of waiting forever
+		dr := NewDecryptionResultsMap()
+		key := PendingDecryption{Hash: fhe.Hash{9}, Type: Decrypt}
+		assert.NoError(t, dr.SetValue(key, big.NewInt(-5)))
+		batch, err := dr.SerializeMultipleResolvedDecryptions([]PendingDecryption{key})
+		assert.NoError(t, err)
+		loaded := NewDecryptionResultsMap()
+		_, err = loaded.LoadMultipleResolvedDecryptions(bytes.NewReader(batch))
+		assert.NoError(t, err)
+		assertSameRecords(t, dr, loaded, []PendingDecryption{key})
+	})
+
+	t.Run("SignedDecryptCompatibility", func(t *testing.T) {
+		timestamp := binary.LittleEndian.AppendUint64(nil, 42)
+
+		// Records written before the envelope still decode
+		old := append(withLength(3, 0x12, 0xd6, 0x87), timestamp...)
+		var record DecryptionRecord
+		assert.NoError(t, record.Deserialize(bytes.NewReader(old), Decrypt))
+		assert.Equal(t, 0, big.NewInt(1234567).Cmp(record.Value.(*big.Int)))
+
+		// Non-negative results are still written that way
+		serialized, err := (&DecryptionRecord{Value: big.NewInt(1234567), Timestamp: time.Unix(0, 42)}).Serialize(Decrypt)
+		assert.NoError(t, err)
+		assert.Equal(t, old, serialized)
+
+		// A reader that predates the envelope reads its marker as the length, which its length check rejects
+		serialized, err = (&DecryptionRecord{Value: big.NewInt(-5), Timestamp: time.Unix(0, 42)}).Serialize(Decrypt)
+		assert.NoError(t, err)
+		_, err = readBoundedBytes(bytes.NewReader(serialized), MaxDecryptedSize)
+		assert.ErrorIs(t, err, ErrResultTooLarge)
+	})
+
+	t.Run("UnknownKeyTypeIsRejectedEarly", func(t *testing.T) {
+		serialized, err := (&PendingDecryption{Hash: fhe.Hash{1}, Type: Add}).Serialize()
+		assert.NoError(t, err)
+
+		// The record that would follow is never read
+		err = NewDecryptionResultsMap().LoadResolvedDecryption(bytes.NewReader(serialized))
+		assert.ErrorIs(t, err, ErrUnknownResultType)
+	})
+}
+
+func FuzzPendingDecryptionDeserialize(f *testing.F) {
+	for _, key := range []PendingDecryption{
+		{Hash: fhe.Hash{1}, Type: Require},
+		{Hash: fhe.Hash{2}, Type: Decrypt},
+		{Hash: fhe.Hash{3}, Type: SealOutput},
+		{Hash: fhe.Hash{4}, Type: Add},
+	} {
+		serialized, err := key.Serialize()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(serialized)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var key PendingDecryption
+		if err := key.Deserialize(bytes.NewReader(data)); err != nil {
+			return
+		}
+
+		serialized, err := key.Serialize()
+		if err != nil {
+			t.Fatalf("failed to serialize a deserialized key: %v", err)
+		}
+		if !bytes.Equal(serialized, data[:len(serialized)]) {
+			t.Fatalf("key doesn't round trip: %x != %x", serialized, data[:len(serialized)])
+		}
+	})
+}
+
+func FuzzDecryptionRecordDeserialize(f *testing.F) {
+	for _, seed := range []struct {
+		resultType PrecompileName
+		value      any
+	}{
+		{Require, true},
+		{Decrypt, big.NewInt(1234567)},
+		{Decrypt, new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))},
+		{SealOutput, "sealed output"},
+	} {
+		serialized, err := (&DecryptionRecord{Value: seed.value, Timestamp: time.Unix(1700000000, 0)}).Serialize(seed.resultType)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(int32(seed.resultType), serialized)
+	}
+	f.Add(int32(SealOutput), []byte{0xff, 0xff, 0xff, 0xff})
+	f.Add(int32(Decrypt), []byte{0xff, 0xff, 0xff, 0x7f})
+	f.Add(int32(Decrypt), []byte{0x00, 0x00, 0x01, 0x00, DecryptEnvelopeVersion, signNegative, 0x01, 0x00, 0x00, 0x00, 0x05})
+
+	f.Fuzz(func(t *testing.T, resultType int32, data []byte) {
+		var record DecryptionRecord
+		if err := record.Deserialize(bytes.NewReader(data), PrecompileName(resultType)); err != nil {
+			return
+		}
+
+		// Whatever was accepted must be a valid result that can be written again
+		if err := assertCorrectValueType(PrecompileName(resultType), record.Value); err != nil {
+			t.Fatalf("deserialized an invalid value: %v", err)
+		}
+		if _, err := record.Serialize(PrecompileName(resultType)); err != nil {
+			t.Fatalf("failed to serialize a deserialized record: %v", err)
+		}
+	})
+}
@@ -2,6 +2,7 @@ package types
 
 import (
 	"math/big"
+	"sort"
 	"testing"
 	"time"
 
@@ -151,3 +152,160 @@ func TestDecryptionResults(t *testing.T) {
 		// No race condition should occur
 	})
 }
+
+func TestDecryptionResultsBounds(t *testing.T) {
+	now := time.Now()
+	requireKey := func(i byte) PendingDecryption {
+		return PendingDecryption{Hash: fhe.Hash{i}, Type: Require}
+	}
+	setAged := func(dr *DecryptionResults, key PendingDecryption, value any, age time.Duration) {
+		dr.mu.Lock()
+		defer dr.mu.Unlock()
+		dr.data[key] = DecryptionRecord{Value: value, Timestamp: now.Add(-age)}
+	}
+
+	t.Run("Sweep", func(t *testing.T) {
+		dr := NewBoundedDecryptionResults(DecryptionResultsConfig{TTL: time.Minute, PendingTTL: time.Hour})
+		setAged(dr, requireKey(1), true, 2*time.Minute)
+		setAged(dr, requireKey(2), true, time.Second)
+		setAged(dr, requireKey(3), nil, 2*time.Minute)
+		setAged(dr, requireKey(4), nil, 2*time.Hour)
+
+		assert.Equal(t, 2, dr.Sweep(now))
+		_, exists := dr.Get(requireKey(1))
+		assert.False(t, exists, "expired result should be swept")
+		_, exists = dr.Get(requireKey(2))
+		assert.True(t, exists)
+		_, exists = dr.Get(requireKey(3))
+		assert.True(t, exists, "pending record should outlive the result TTL")
+		_, exists = dr.Get(requireKey(4))
+		assert.False(t, exists, "pending record should expire after the pending TTL")
+	})
+
+	t.Run("MaxEntriesEvictsOldestFirst", func(t *testing.T) {
+		dr := NewBoundedDecryptionResults(DecryptionResultsConfig{MaxEntries: 10, PendingTTL: time.Hour})
+		// The oldest record is pending, so the oldest results go first
+		setAged(dr, requireKey(0), nil, time.Hour-time.Minute)
+		for i := byte(1); i < 10; i++ {
+			setAged(dr, requireKey(i), true, time.Duration(20-i)*time.Minute)
+		}
+
+		assert.NoError(t, dr.SetValue(requireKey(10), true))
+		assert.Equal(t, 9, dr.Len())
+		for i := byte(0); i <= 10; i++ {
+			_, exists := dr.Get(requireKey(i))
+			assert.Equal(t, i == 0 || i >= 3, exists, "record %d", i)
+		}
+	})
+
+	t.Run("PendingRecordsCanExceedMaxEntries", func(t *testing.T) {
+		dr := NewBoundedDecryptionResults(DecryptionResultsConfig{MaxEntries: 2, PendingTTL: time.Hour})
+		for i := byte(0); i < 3; i++ {
+			dr.CreateEmptyRecord(requireKey(i))
+		}
+		assert.Equal(t, 3, dr.Len())
+
+		// Once expired, pending records are evictable too
+		setAged(dr, requireKey(0), nil, 2*time.Hour)
+		dr.CreateEmptyRecord(requireKey(3))
+		_, exists := dr.Get(requireKey(0))
+		assert.False(t, exists)
+	})
+
+	t.Run("Sweeper", func(t *testing.T) {
+		dr := NewBoundedDecryptionResults(DecryptionResultsConfig{TTL: time.Millisecond, SweepInterval: time.Millisecond})
+		assert.NoError(t, dr.SetValue(requireKey(1), true))
+
+		dr.StartSweeper()
+		defer dr.Stop()
+		assert.Eventually(t, func() bool { return dr.Len() == 0 }, time.Second, time.Millisecond)
+	})
+}
+
+// mapStore is an in-memory NamespacedStorage
+type mapStore map[string][]byte
+
+func (m mapStore) key(t DataType, key []byte) string {
+	return string(append([]byte{byte(t)}, key...))
+}
+
+func (m mapStore) Put(t DataType, key []byte, val []byte) error {
+	m[m.key(t, key)] = append([]byte{}, val...)
+	return nil
+}
+
+func (m mapStore) Get(t DataType, key []byte) ([]byte, error) {
+	return m[m.key(t, key)], nil
+}
+
+func (m mapStore) Delete(t DataType, key []byte) error {
+	delete(m, m.key(t, key))
+	return nil
+}
+
+func (m mapStore) IteratePrefix(t DataType, prefix []byte, fn func(key []byte, val []byte) bool) error {
+	var keys []string
+	for k := range m {
+		if len(k) > 0 && k[0] == byte(t) && len(k)-1 >= len(prefix) && k[1:1+len(prefix)] == string(prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !fn([]byte(k[1:]), m[k]) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestDecryptionResultsPersist(t *testing.T) {
+	store := mapStore{}
+	dr := NewBoundedDecryptionResults(DecryptionResultsConfig{TTL: time.Hour})
+	loaded, err := dr.Persist(store)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, loaded)
+
+	requireKey := PendingDecryption{Hash: fhe.Hash{1}, Type: Require}
+	decryptKey := PendingDecryption{Hash: fhe.Hash{2}, Type: Decrypt}
+	sealKey := PendingDecryption{Hash: fhe.Hash{3}, Type: SealOutput}
+	pendingKey := PendingDecryption{Hash: fhe.Hash{4}, Type: Decrypt}
+	expiredKey := PendingDecryption{Hash: fhe.Hash{5}, Type: Require}
+	removedKey := PendingDecryption{Hash: fhe.Hash{6}, Type: Require}
+
+	assert.NoError(t, dr.SetValue(requireKey, true))
+	assert.NoError(t, dr.SetValue(decryptKey, big.NewInt(42)))
+	assert.NoError(t, dr.SetRecord(sealKey, DecryptionRecord{Value: "sealed", Timestamp: time.Now()}))
+	assert.NoError(t, dr.SetRecord(expiredKey, DecryptionRecord{Value: false, Timestamp: time.Now().Add(-2 * time.Hour)}))
+	assert.NoError(t, dr.SetValue(removedKey, true))
+	dr.CreateEmptyRecord(pendingKey)
+	dr.Remove(removedKey)
+	assert.Len(t, store, 4, "pending and removed records should not be persisted")
+
+	// Undecodable records are dropped on load
+	assert.NoError(t, store.Put(NamespaceDecryptionResults, []byte{1, 2, 3}, []byte{4}))
+
+	restarted := NewBoundedDecryptionResults(DecryptionResultsConfig{TTL: time.Hour})
+	loaded, err = restarted.Persist(store)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, loaded)
+	assert.Len(t, store, 3, "expired and undecodable records should be dropped from the store")
+
+	record, exists := restarted.Get(requireKey)
+	assert.True(t, exists)
+	assert.Equal(t, true, record.Value)
+	record, exists = restarted.Get(decryptKey)
+	assert.True(t, exists)
+	assert.Equal(t, big.NewInt(42), record.Value)
+	record, exists = restarted.Get(sealKey)
+	assert.True(t, exists)
+	assert.Equal(t, "sealed", record.Value)
+	for _, key := range []PendingDecryption{pendingKey, expiredKey, removedKey} {
+		_, exists = restarted.Get(key)
+		assert.False(t, exists)
+	}
+
+	// Swept records are deleted from the store as well
+	assert.Equal(t, 3, restarted.Sweep(time.Now().Add(2*time.Hour)))
+	assert.Empty(t, store)
+}
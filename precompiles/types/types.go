@@ -1,11 +1,55 @@
 package types
 
 import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/fhenixprotocol/warp-drive/fhe-driver"
 )
 
+// DataType is the namespace of a key in the fheos db - every key is stored prefixed with its DataType
 type DataType uint64
 
+const (
+	NamespaceCiphertexts DataType = iota + 1
+	NamespaceMetadata
+	NamespaceIndexes
+	NamespaceDecryptionResults
+	NamespaceJournal
+	NamespacePayloads
+)
+
+func (t DataType) String() string {
+	switch t {
+	case NamespaceCiphertexts:
+		return "ciphertexts"
+	case NamespaceMetadata:
+		return "metadata"
+	case NamespaceIndexes:
+		return "indexes"
+	case NamespaceDecryptionResults:
+		return "decryption-results"
+	case NamespaceJournal:
+		return "journal"
+	case NamespacePayloads:
+		return "payloads"
+	default:
+		return fmt.Sprintf("namespace-%d", uint64(t))
+	}
+}
+
+// BackupManifest describes a backup of the fheos db, so that a restore can check it is complete and compatible
+type BackupManifest struct {
+	Version   uint64    `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Entries is the number of keys in every namespace
+	Entries map[string]uint64 `json:"entries"`
+	// KeysHash is the sha256 over every key, in order
+	KeysHash string `json:"keysHash"`
+}
+
 type Hash fhe.Hash
 type FheEncrypted fhe.FheEncrypted
 
@@ -25,12 +69,48 @@ func IsValidType(t fhe.EncryptionType) bool {
 }
 
 type Storage interface {
-	// don't really need these
-	// Put(t types.DataType, key []byte, val []byte) error
-	// Get(t types.DataType, key []byte) ([]byte, error)
+	// Close releases the backend, it must not be used afterwards
+	Close() error
 	GetVersion() (uint64, error)
 	PutVersion(v uint64) error
 	FheCipherTextStorage
+	RefCountStorage
+	NamespacedStorage
+	CiphertextIndex
+}
+
+// CiphertextIndex enumerates the stored ciphertexts
+type CiphertextIndex interface {
+	// IterateCts calls fn with the metadata of every stored ciphertext matching filter, until fn returns false
+	IterateCts(filter CtFilter, fn func(m CtMetadata) bool) error
+	// IterateUsage calls fn with the usage counters of every security zone and type, until fn returns false
+	IterateUsage(fn func(u Usage) bool) error
+}
+
+// NamespacedStorage is raw access to the keys of a namespace. Ciphertexts should still be written through
+// FheCipherTextStorage, which takes care of encoding and caching them
+type NamespacedStorage interface {
+	Put(t DataType, key []byte, val []byte) error
+	Get(t DataType, key []byte) ([]byte, error)
+	Delete(t DataType, key []byte) error
+	// IteratePrefix calls fn for every key in namespace t that starts with prefix, in key order, until fn returns false.
+	// The keys passed to fn don't include the namespace
+	IteratePrefix(t DataType, prefix []byte, fn func(key []byte, val []byte) bool) error
+}
+
+// RefCount is the number of contract storage slots referencing a ciphertext.
+// ZeroSince is the block at which Count dropped to (or was created at) zero, and is meaningless while Count > 0
+type RefCount struct {
+	Count     uint64
+	ZeroSince uint64
+}
+
+type RefCountStorage interface {
+	GetRefCount(h Hash) (RefCount, error)
+	PutRefCount(h Hash, rc RefCount) error
+	DeleteRefCount(h Hash) error
+	// IterateRefCounts calls fn for every stored reference count until fn returns false
+	IterateRefCounts(fn func(h Hash, rc RefCount) bool) error
 }
 
 type FheCipherTextStorage interface {
@@ -42,6 +122,22 @@ type FheCipherTextStorage interface {
 	DeleteCt(h Hash) error
 }
 
+// PayloadStorage is implemented by backends that cache and tier the shared payloads in NamespacePayloads the way they
+// do ciphertexts. Backends that don't are accessed through NamespacedStorage, with records encoded by codec.EncodeCt
+type PayloadStorage interface {
+	PutPayload(h Hash, cipher *FheEncrypted) error
+	GetPayload(h Hash) (*FheEncrypted, error)
+	HasPayload(h Hash) bool
+	DeletePayload(h Hash) error
+}
+
+// BatchStorage is implemented by backends that can apply several writes atomically
+type BatchStorage interface {
+	// Batch calls fn with a view of the backend whose writes are held back, and applies all of them together once fn
+	// returns nil. Reads through the view see its own writes, iterating doesn't
+	Batch(fn func(s Storage) error) error
+}
+
 type PrecompileName int
 
 // NOTE: If you add a type here you MUST to change ICofhe.sol!
@@ -171,3 +267,63 @@ const (
 	TypeMask                  = 0x7f
 	TrivialEncryptFlag        = 0x80
 )
+
+// CtMetadata describes a stored ciphertext. Everything but Placeholder, CreatedAt and Size is decoded from its handle
+type CtMetadata struct {
+	Hash               Hash
+	SecurityZone       int32
+	UintType           fhe.EncryptionType
+	TriviallyEncrypted bool
+	Placeholder        bool
+	CreatedAt          time.Time
+	// Size is the length of the ciphertext data in bytes, zero for ciphertexts indexed before sizes were tracked
+	Size uint64
+}
+
+func NewCtMetadata(h Hash, placeholder bool, createdAt time.Time) CtMetadata {
+	return CtMetadata{
+		Hash:               h,
+		SecurityZone:       int32(h[SecurityZoneByte]),
+		UintType:           fhe.EncryptionType(h[TrivialEncryptAndTypeByte] & TypeMask),
+		TriviallyEncrypted: h[TrivialEncryptAndTypeByte]&TrivialEncryptFlag != 0,
+		Placeholder:        placeholder,
+		CreatedAt:          createdAt,
+	}
+}
+
+// CtFilter selects ciphertexts by their metadata, nil fields match everything
+type CtFilter struct {
+	HashPrefix    []byte
+	SecurityZone  *int32
+	UintType      *fhe.EncryptionType
+	Placeholder   *bool
+	CreatedBefore *time.Time
+}
+
+// Usage counts the ciphertexts stored for a security zone and type
+type Usage struct {
+	SecurityZone int32
+	UintType     fhe.EncryptionType
+	Count        uint64
+	Bytes        uint64
+	Placeholders uint64
+}
+
+// Provenance records how a ciphertext was produced: by which operation on which input handles, in which
+// contract, transaction and block
+type Provenance struct {
+	Operation   PrecompileName
+	Inputs      []Hash
+	Contract    common.Address
+	TxHash      common.Hash
+	BlockNumber uint64
+	CreatedAt   time.Time
+}
+
+func (f CtFilter) Matches(m CtMetadata) bool {
+	return bytes.HasPrefix(m.Hash[:], f.HashPrefix) &&
+		(f.SecurityZone == nil || *f.SecurityZone == m.SecurityZone) &&
+		(f.UintType == nil || *f.UintType == m.UintType) &&
+		(f.Placeholder == nil || *f.Placeholder == m.Placeholder) &&
+		(f.CreatedBefore == nil || m.CreatedAt.Before(*f.CreatedBefore))
+}
@@ -3,6 +3,7 @@ package precompiles
 import (
 	"context"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"math/big"
@@ -53,13 +54,32 @@ type TxParams struct {
 	GetBlockHash    vm.GetHashFunc
 	BlockNumber     *big.Int
 	ParallelTxHooks types.ParallelTxProcessingHook
+	// SyncExecution forces inline evaluation for this call, regardless of State.ExecutionMode
+	SyncExecution bool
+	// FheosState is the state of the chain this call runs on, the global State is used when it's nil
+	FheosState *FheosState
+	// ChainState is the state db of the chain, where zone quotas are kept. Calls that don't run in the EVM leave it nil
+	ChainState ChainState
 	vm.TxContext
 }
 
+func (tp *TxParams) state() *FheosState {
+	if tp.FheosState != nil {
+		return tp.FheosState
+	}
+
+	return State
+}
+
 func shouldPrintPrecompileInfo(tp *TxParams) bool {
 	return tp.Commit && !tp.GasEstimation
 }
 
+func isSyncExecution(tp *TxParams) bool {
+	state := tp.state()
+	return tp.SyncExecution || (state != nil && state.ExecutionMode == SyncExecution)
+}
+
 type GasBurner interface {
 	Burn(amount uint64) error
 	Burned() uint64
@@ -74,6 +94,7 @@ func TxParamsFromEVM(evm *vm.EVM, callerContract common.Address) TxParams {
 	tp.ContractAddress = callerContract
 	tp.BlockNumber = evm.Context.BlockNumber
 	tp.GetBlockHash = evm.Context.GetHash
+	tp.ChainState = evm.StateDB
 
 	// If this is running in a sequencer, this should not be nil
 	if parallelHook, ok := evm.ProcessingHook.(types.ParallelTxProcessingHook); ok {
@@ -118,6 +139,8 @@ func InitFheConfig(fheConfig *fhe.Config) error {
 		return err
 	}
 
+	initEngineBreaker(fheConfig)
+
 	logger.Info("Successfully initialized fhe config", "config", fheConfig)
 
 	return nil
@@ -253,6 +276,41 @@ func storeCiphertext(storage *storage.MultiStore, ct *fhe.FheEncrypted) error {
 	return nil
 }
 
+// recordProvenance records which operation produced the ciphertext h out of inputs, in the contract and tx of tp.
+// The record is only used for debugging and audits, so failing to write it doesn't fail the operation
+func recordProvenance(storage *storage.MultiStore, tp *TxParams, functionName types.PrecompileName, h fhe.Hash, inputs ...fhe.CiphertextKey) {
+	p := types.Provenance{
+		Operation: functionName,
+		Contract:  tp.ContractAddress,
+		TxHash:    tp.TxContext.Hash,
+		CreatedAt: time.Now(),
+	}
+	if tp.BlockNumber != nil {
+		p.BlockNumber = tp.BlockNumber.Uint64()
+	}
+	for _, input := range inputs {
+		p.Inputs = append(p.Inputs, types.Hash(input.Hash))
+	}
+
+	if err := storage.PutProvenance(types.Hash(h), p); err != nil {
+		logger.Error(functionName.String()+" failed to record provenance", "hash", hex.EncodeToString(h[:]), "err", err)
+	}
+}
+
+// storeResult stores the result of an async operation in place of its placeholder (result.Key is the placeholder key).
+// contentHash is the hash the engine computed for the result, which identical results share
+func storeResult(storage *storage.MultiStore, result *fhe.FheEncrypted, contentHash []byte) error {
+	var content types.Hash
+	copy(content[:], contentHash)
+	err := storage.ResolvePlaceholder(types.Hash(result.GetHash()), (*types.FheEncrypted)(result), content)
+	if err != nil {
+		logger.Error("failed storing result in place of placeholder: ", err)
+		return err
+	}
+
+	return nil
+}
+
 func deleteCiphertext(storage *storage.MultiStore, ciphertextHash fhe.Hash) {
 	hash := types.Hash(ciphertextHash)
 	if storage.Has(hash) {
@@ -271,6 +329,12 @@ func ByteToUint256(b byte) []byte {
 	return uint256[:]
 }
 
+func Uint64ToUint256(i uint64) []byte {
+	var uint256 [32]byte
+	binary.BigEndian.PutUint64(uint256[24:], i)
+	return uint256[:]
+}
+
 func Int32ToUint256(i int32) []byte {
 	var uint256 [32]byte
 
@@ -285,7 +349,9 @@ func Int32ToUint256(i int32) []byte {
 }
 
 func evaluateRequire(ct *fhe.FheEncrypted) (bool, error) {
-	return fhe.Require(ct)
+	return withEngine(func() (bool, error) {
+		return fhe.Require(ct)
+	})
 }
 
 func GenerateSeedFromEntropy(contractAddress common.Address, hash common.Hash, randomCounter uint64) uint64 {
@@ -310,18 +376,63 @@ func CopySlice(original []byte) []byte {
 	return copied
 }
 
-// SAFETY NOTE: this function assumes input length validity (i.e. that ctHash and pk are 32 bytes long)
-// since the SealOutput precompile is doing these checks before calling this function. Be extra careful
-// when using this function in other places.
+// genSealedKey returns the key of the result of sealing ctHash for pk. Both are hashed together, so that different
+// pairs can't end up with the same key
 func genSealedKey(ctHash, pk []byte, functionName types.PrecompileName) types.PendingDecryption {
-	var hash [32]byte
-	for i := 0; i < 32; i++ {
-		// Assumes input length validity
-		hash[i] = ctHash[i] ^ pk[i]
-	}
-
 	return types.PendingDecryption{
-		Hash: hash,
+		Hash: fhe.Hash(crypto.Keccak256Hash(ctHash, pk)),
 		Type: functionName,
 	}
 }
+
+// isTx returns true for calls within a tx that runs in the EVM, as opposed to queries, gas estimation and the
+// coprocessor, which decrypt on their own
+func isTx(tp *TxParams) bool {
+	return !tp.EthCall && !tp.GasEstimation && (tp.ParallelTxHooks != nil || tp.ChainState != nil)
+}
+
+// notifyExistingResult tells the sequencer that a tx used the result of key. Only the sequencer needs to know about
+// it, to include the result in the L1 message
+func notifyExistingResult(tp *TxParams, key types.PendingDecryption) {
+	if tp.ParallelTxHooks != nil {
+		tp.ParallelTxHooks.NotifyExistingRes(&key)
+	}
+}
+
+// requireParallelHooks fails a tx that needs the result of key when it isn't known yet and there are no parallel tx
+// hooks to evaluate it, i.e. on a follower. Followers never evaluate decryptions of a tx on their own: sealing is
+// randomized, so they would diverge from the sequencer
+func requireParallelHooks(tp *TxParams, key types.PendingDecryption) error {
+	if tp.ParallelTxHooks != nil {
+		return nil
+	}
+
+	logger.Error("no decryption result found and no parallel tx hooks were set", "type", key.Type.String(), "hash", key.Hash.Hex())
+	return vm.ErrExecutionReverted
+}
+
+// startParallelDecryption evaluates the result of key in the background, for a decryption within a tx. The sequencer
+// includes the result in the L1 message once it is notified of it, and followers load it from there before they run
+// the tx: they only ever use that value (see requireParallelHooks)
+func startParallelDecryption(tp *TxParams, key types.PendingDecryption, exists bool, evaluate func() (any, error)) {
+	tp.ParallelTxHooks.NotifyCt(&key)
+
+	if !exists {
+		tp.state().DecryptResults.CreateEmptyRecord(key)
+	}
+
+	go func() {
+		logger.Debug("evaluating "+key.Type.String()+" result", "hash", key.Hash.Hex())
+		result, err := evaluate()
+		if err != nil {
+			logger.Error(key.Type.String()+" error on evaluation", "err", err)
+			return
+		}
+
+		if err := tp.state().DecryptResults.SetValue(key, result); err != nil {
+			logger.Error("failed setting "+key.Type.String()+" result", "error", err)
+			return
+		}
+		tp.ParallelTxHooks.NotifyDecryptRes(&key)
+	}()
+}
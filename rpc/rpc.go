@@ -2,8 +2,12 @@ package rpc
 
 import (
 	"encoding/hex"
+	"errors"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/fhenixprotocol/fheos/precompiles"
 	"github.com/fhenixprotocol/warp-drive/fhe-driver"
 )
 
@@ -28,6 +32,32 @@ func (s *FhenixAPI) GetCrs() (string, error) {
 	return "0x" + hex.EncodeToString(crs), nil
 }
 
+type CiphertextAliases struct {
+	ContentHash  string   `json:"contentHash"`
+	Placeholders []string `json:"placeholders"`
+}
+
+// Get the content hash the ciphertext of a placeholder (or content hash) is stored under, and every placeholder sharing it
+func (s *FhenixAPI) GetCiphertextAliases(hash hexutil.Bytes) (*CiphertextAliases, error) {
+	if len(hash) != common.HashLength {
+		return nil, errors.New("invalid ciphertext hash")
+	}
+
+	content, placeholders, err := precompiles.GetAliases(hash, &precompiles.TxParams{})
+	if err != nil {
+		return nil, err
+	}
+
+	aliases := &CiphertextAliases{
+		ContentHash:  "0x" + hex.EncodeToString(content[:]),
+		Placeholders: make([]string, 0, len(placeholders)),
+	}
+	for _, placeholder := range placeholders {
+		aliases.Placeholders = append(aliases.Placeholders, "0x"+hex.EncodeToString(placeholder[:]))
+	}
+	return aliases, nil
+}
+
 func GetRpcApis() rpc.API {
 	return rpc.API{
 		Namespace: "fhenix",
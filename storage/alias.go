@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+	"github.com/fhenixprotocol/fheos/storage/codec"
+	"github.com/fhenixprotocol/fheos/storage/index"
+	"github.com/fhenixprotocol/warp-drive/fhe-driver"
+)
+
+// When an async operation completes, its result is stored once in NamespacePayloads, under the content hash the
+// engine computed for it, and the placeholder is kept as an alias of it. Identical results of different operations
+// share the stored payload. The content hash isn't a handle, so the payload itself isn't in the ciphertext index:
+// every placeholder keeps its own entry, under its own security zone and type, with the size of the result.
+// Both directions are indexed:
+//
+//	NamespaceIndexes | "alias/p/" | placeholder                ->  content hash
+//	NamespaceIndexes | "alias/c/" | content hash | placeholder  ->  (empty)
+var (
+	placeholderAliasPrefix = []byte("alias/p/")
+	contentAliasPrefix     = []byte("alias/c/")
+)
+
+func placeholderAliasKey(placeholder types.Hash) []byte {
+	return append(append([]byte{}, placeholderAliasPrefix...), placeholder[:]...)
+}
+
+func contentAliasKey(content types.Hash, placeholder types.Hash) []byte {
+	key := append(append([]byte{}, contentAliasPrefix...), content[:]...)
+	return append(key, placeholder[:]...)
+}
+
+// GetAlias returns the content hash the result of placeholder is stored under, or ok=false if it has no alias
+func (fs *FheosStorage) GetAlias(placeholder types.Hash) (types.Hash, bool) {
+	var content types.Hash
+	val, err := fs.diskStore.Get(types.NamespaceIndexes, placeholderAliasKey(placeholder))
+	if err != nil || len(val) != len(content) {
+		return content, false
+	}
+
+	copy(content[:], val)
+	return content, true
+}
+
+// GetPlaceholders returns every placeholder whose result is stored under content
+func (fs *FheosStorage) GetPlaceholders(content types.Hash) ([]types.Hash, error) {
+	var placeholders []types.Hash
+	prefix := append(append([]byte{}, contentAliasPrefix...), content[:]...)
+	err := fs.diskStore.IteratePrefix(types.NamespaceIndexes, prefix, func(key []byte, _ []byte) bool {
+		var placeholder types.Hash
+		copy(placeholder[:], key[len(prefix):])
+		placeholders = append(placeholders, placeholder)
+		return true
+	})
+	return placeholders, err
+}
+
+// The shared payloads go through the PayloadStorage of the backend when it has one, which caches and tiers them like
+// ciphertexts, and are raw records in NamespacePayloads otherwise
+func putPayload(db types.Storage, content types.Hash, payload *types.FheEncrypted, compression codec.Compression) error {
+	if payloads, ok := db.(types.PayloadStorage); ok {
+		return payloads.PutPayload(content, payload)
+	}
+
+	record, err := codec.EncodeCt(payload, compression)
+	if err != nil {
+		return err
+	}
+	return db.Put(types.NamespacePayloads, content[:], record)
+}
+
+func getPayload(db types.Storage, content types.Hash) (*types.FheEncrypted, error) {
+	if payloads, ok := db.(types.PayloadStorage); ok {
+		return payloads.GetPayload(content)
+	}
+
+	record, err := db.Get(types.NamespacePayloads, content[:])
+	if err != nil {
+		return nil, err
+	}
+
+	ct, err := codec.DecodeCt(record)
+	if err != nil {
+		return nil, fmt.Errorf("payload %x: %w", content[:], err)
+	}
+	return ct, nil
+}
+
+func hasPayload(db types.Storage, content types.Hash) bool {
+	if payloads, ok := db.(types.PayloadStorage); ok {
+		return payloads.HasPayload(content)
+	}
+
+	_, err := db.Get(types.NamespacePayloads, content[:])
+	return err == nil
+}
+
+func deletePayload(db types.Storage, content types.Hash) error {
+	if payloads, ok := db.(types.PayloadStorage); ok {
+		return payloads.DeletePayload(content)
+	}
+	return db.Delete(types.NamespacePayloads, content[:])
+}
+
+// HasPayload returns true if a shared payload is stored under content
+func (fs *FheosStorage) HasPayload(content types.Hash) bool {
+	return hasPayload(fs.diskStore, content)
+}
+
+// batch runs fn on a view of the backend whose writes are applied together, or one by one if the backend has no
+// batches
+func (fs *FheosStorage) batch(fn func(db types.Storage) error) error {
+	if batcher, ok := fs.diskStore.(types.BatchStorage); ok {
+		return batcher.Batch(fn)
+	}
+	return fn(fs.diskStore)
+}
+
+// PutResolvedCt stores the result of the async operation of placeholder under its content hash, unless an identical
+// result is already stored there, and replaces the placeholder with an alias of it. Everything is written in a
+// single batch, so a crash can't leave a placeholder whose alias points at nothing
+func (fs *FheosStorage) PutResolvedCt(placeholder types.Hash, cipher *types.FheEncrypted, content types.Hash) error {
+	if content == placeholder || content == (types.Hash{}) {
+		return fs.diskStore.PutCt(placeholder, cipher)
+	}
+
+	fs.instance.alias.Lock()
+	defer fs.instance.alias.Unlock()
+
+	return fs.batch(func(db types.Storage) error {
+		if !hasPayload(db, content) {
+			payload := *cipher
+			payload.Key.Hash = fhe.Hash(content)
+			if err := putPayload(db, content, &payload, fs.compression); err != nil {
+				return err
+			}
+		}
+
+		if err := db.Put(types.NamespaceIndexes, contentAliasKey(content, placeholder), nil); err != nil {
+			return err
+		}
+		if err := db.Put(types.NamespaceIndexes, placeholderAliasKey(placeholder), content[:]); err != nil {
+			return err
+		}
+
+		// The placeholder record is now redundant, its index entry is replaced by one for the result that keeps the
+		// time the operation was requested
+		createdAt := time.Now()
+		if m, ok := index.Get(db, placeholder); ok {
+			createdAt = m.CreatedAt
+		}
+		if err := db.DeleteCt(placeholder); err != nil {
+			return err
+		}
+		return index.Put(db, placeholder, false, uint64(len(cipher.Data)), createdAt)
+	})
+}
+
+// getPayload reads the shared payload stored under content
+func (fs *FheosStorage) getPayload(content types.Hash) (*types.FheEncrypted, error) {
+	return getPayload(fs.diskStore, content)
+}
+
+// getAliased reads the shared payload of placeholder, as the ciphertext of placeholder
+func (fs *FheosStorage) getAliased(placeholder types.Hash) (*types.FheEncrypted, error) {
+	content, ok := fs.GetAlias(placeholder)
+	if !ok {
+		return nil, errNoAlias
+	}
+
+	ct, err := fs.getPayload(content)
+	if err != nil {
+		return nil, err
+	}
+
+	aliased := *ct
+	aliased.Key.Hash = fhe.Hash(placeholder)
+	aliased.Key.IsTriviallyEncrypted = placeholder[types.TrivialEncryptAndTypeByte]&types.TrivialEncryptFlag != 0
+	return &aliased, nil
+}
+
+// deleteAlias removes the alias of placeholder, and the shared payload once no placeholder uses it anymore
+func (fs *FheosStorage) deleteAlias(placeholder types.Hash) error {
+	fs.instance.alias.Lock()
+	defer fs.instance.alias.Unlock()
+
+	content, ok := fs.GetAlias(placeholder)
+	if !ok {
+		return nil
+	}
+
+	if err := fs.diskStore.Delete(types.NamespaceIndexes, placeholderAliasKey(placeholder)); err != nil {
+		return err
+	}
+	if err := fs.diskStore.Delete(types.NamespaceIndexes, contentAliasKey(content, placeholder)); err != nil {
+		return err
+	}
+
+	placeholders, err := fs.GetPlaceholders(content)
+	if err != nil || len(placeholders) > 0 {
+		return err
+	}
+	return deletePayload(fs.diskStore, content)
+}
+
+// movePayloads moves the shared payloads that were stored in the ciphertext namespace, and indexed under the content
+// hash, into NamespacePayloads, and indexes every placeholder that aliases them instead
+func movePayloads(fs *FheosStorage) error {
+	contents := map[types.Hash]struct{}{}
+	err := fs.diskStore.IteratePrefix(types.NamespaceIndexes, contentAliasPrefix, func(key []byte, _ []byte) bool {
+		if len(key) == len(contentAliasPrefix)+2*len(types.Hash{}) {
+			var content types.Hash
+			copy(content[:], key[len(contentAliasPrefix):])
+			contents[content] = struct{}{}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	moved := 0
+	for content := range contents {
+		// An earlier run may have moved it already
+		ct, err := fs.diskStore.GetCt(content)
+		if err == nil {
+			if err := putPayload(fs.diskStore, content, ct, fs.compression); err != nil {
+				return err
+			}
+		} else if ct, err = fs.getPayload(content); err != nil {
+			log.Warn("skipping missing payload while moving payloads", "content", hex.EncodeToString(content[:]), "err", err)
+			continue
+		}
+
+		placeholders, err := fs.GetPlaceholders(content)
+		if err != nil {
+			return err
+		}
+		for _, placeholder := range placeholders {
+			if err := index.Put(fs.diskStore, placeholder, false, uint64(len(ct.Data)), time.Now()); err != nil {
+				return err
+			}
+		}
+
+		if err := fs.diskStore.DeleteCt(content); err != nil {
+			return err
+		}
+		moved++
+	}
+
+	log.Info("moved shared payloads out of the ciphertext namespace", "payloads", moved)
+	return nil
+}
+
+// Aliases resolves h, which can be either a placeholder or a content hash, to the content hash its payload is stored
+// under and every placeholder that aliases it
+func (fs *FheosStorage) Aliases(h types.Hash) (types.Hash, []types.Hash, error) {
+	content, ok := fs.GetAlias(h)
+	if !ok {
+		content = h
+	}
+
+	placeholders, err := fs.GetPlaceholders(content)
+	return content, placeholders, err
+}
@@ -0,0 +1,213 @@
+//go:build amd64 || arm64
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+	"github.com/fhenixprotocol/fheos/storage/codec"
+	"github.com/fhenixprotocol/fheos/storage/fsdb"
+	ephemeraldb "github.com/fhenixprotocol/fheos/storage/memorydb"
+	"github.com/fhenixprotocol/fheos/storage/pebble"
+	"github.com/fhenixprotocol/fheos/storage/tiered"
+)
+
+// BackendConfig is passed to every backend, each one uses the options that make sense for it
+type BackendConfig struct {
+	Path        string
+	Compression codec.Compression
+	// CacheSize is the number of bytes of decoded ciphertexts kept in memory, 0 disables the cache
+	CacheSize uint64
+	// ColdPath enables tiering: ciphertexts not accessed for ColdAfter are archived there, every TierInterval
+	ColdPath     string
+	ColdAfter    time.Duration
+	TierInterval time.Duration
+}
+
+type BackendFactory func(config BackendConfig) (types.Storage, error)
+
+const DefaultBackend = "pebble"
+
+var backends = map[string]BackendFactory{
+	"pebble": func(config BackendConfig) (types.Storage, error) {
+		return pebble.NewStorage(config.Path, pebble.Options{Compression: config.Compression, CacheSize: config.CacheSize})
+	},
+	"memory": func(_ BackendConfig) (types.Storage, error) {
+		return ephemeraldb.New(), nil
+	},
+	"fs": func(config BackendConfig) (types.Storage, error) {
+		return fsdb.New(config.Path, config.Compression)
+	},
+}
+
+// RegisterBackend makes a backend selectable by name, replacing any backend registered under the same name
+func RegisterBackend(name string, factory BackendFactory) {
+	backends[name] = factory
+}
+
+// Backends returns the names of all the registered backends
+func Backends() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func NewBackend(name string, config BackendConfig) (types.Storage, error) {
+	factory, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend %q (available: %v)", name, Backends())
+	}
+
+	return factory(config)
+}
+
+// getBackend reads the backend from FHEOS_DB_BACKEND, pebble by default
+func getBackend() string {
+	backend := os.Getenv("FHEOS_DB_BACKEND")
+	if backend == "" {
+		return DefaultBackend
+	}
+
+	return backend
+}
+
+// getCompression reads the compression of newly written ciphertexts from FHEOS_DB_COMPRESSION ("none" or "snappy")
+func getCompression() (codec.Compression, error) {
+	return codec.ParseCompression(os.Getenv("FHEOS_DB_COMPRESSION"))
+}
+
+const defaultCacheSize = 128 * 1024 * 1024
+
+// getCacheSize reads the size in bytes of the decoded ciphertext cache from FHEOS_DB_CACHE_SIZE, 0 disables it
+func getCacheSize() (uint64, error) {
+	size := os.Getenv("FHEOS_DB_CACHE_SIZE")
+	if size == "" {
+		return defaultCacheSize, nil
+	}
+
+	return strconv.ParseUint(size, 10, 64)
+}
+
+const defaultColdAfterDays = 30
+
+// getTiering reads the cold archive settings from FHEOS_DB_COLD_PATH (tiering is disabled without it),
+// FHEOS_DB_COLD_AFTER_DAYS and FHEOS_DB_TIER_INTERVAL
+func getTiering() (string, time.Duration, time.Duration, error) {
+	path := os.Getenv("FHEOS_DB_COLD_PATH")
+	if path == "" {
+		return "", 0, 0, nil
+	}
+
+	days := uint64(defaultColdAfterDays)
+	if env := os.Getenv("FHEOS_DB_COLD_AFTER_DAYS"); env != "" {
+		var err error
+		if days, err = strconv.ParseUint(env, 10, 64); err != nil {
+			return "", 0, 0, fmt.Errorf("invalid FHEOS_DB_COLD_AFTER_DAYS: %w", err)
+		}
+	}
+
+	interval := time.Hour
+	if env := os.Getenv("FHEOS_DB_TIER_INTERVAL"); env != "" {
+		var err error
+		if interval, err = time.ParseDuration(env); err != nil {
+			return "", 0, 0, fmt.Errorf("invalid FHEOS_DB_TIER_INTERVAL: %w", err)
+		}
+	}
+
+	return path, time.Duration(days) * 24 * time.Hour, interval, nil
+}
+
+// getBackendConfig reads the backend config from the environment, the path comes from FHEOS_DB_PATH
+func getBackendConfig(path string) (BackendConfig, error) {
+	compression, err := getCompression()
+	if err != nil {
+		return BackendConfig{}, err
+	}
+
+	cacheSize, err := getCacheSize()
+	if err != nil {
+		return BackendConfig{}, err
+	}
+
+	coldPath, coldAfter, tierInterval, err := getTiering()
+	if err != nil {
+		return BackendConfig{}, err
+	}
+
+	return BackendConfig{
+		Path:         path,
+		Compression:  compression,
+		CacheSize:    cacheSize,
+		ColdPath:     coldPath,
+		ColdAfter:    coldAfter,
+		TierInterval: tierInterval,
+	}, nil
+}
+
+// InitStorage opens the backend selected by FHEOS_DB_BACKEND (pebble by default) at path
+func InitStorage(path string) (*FheosStorage, error) {
+	config, err := getBackendConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewStorage(getBackend(), config)
+}
+
+func NewStorage(backend string, config BackendConfig) (*FheosStorage, error) {
+	storage, err := NewBackend(backend, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ColdPath != "" {
+		tieredStorage, err := tiered.New(storage, tiered.Options{Dir: config.ColdPath, ColdAfter: config.ColdAfter, Interval: config.TierInterval, Compression: config.Compression})
+		if err != nil {
+			_ = storage.Close()
+			return nil, err
+		}
+		storage = tieredStorage
+	}
+
+	fs := newFheosStorage(storage)
+	fs.compression = config.Compression
+	return fs, nil
+}
+
+// RestoreCheckpoint restores the backup in dir as a new pebble db at path. Backups written by an older version are
+// accepted, since they are migrated when the db is next opened, but not ones newer than maxVersion.
+// Backups are pebble dbs, so restoring fails if FHEOS_DB_BACKEND selects another backend, which couldn't open it.
+// The archived records of a backup taken with tiering are copied into FHEOS_DB_COLD_PATH, which must be set
+func RestoreCheckpoint(dir string, path string, maxVersion uint64) (types.BackupManifest, error) {
+	if backend := getBackend(); backend != "pebble" {
+		return types.BackupManifest{}, fmt.Errorf("backups can only be restored to the pebble backend, FHEOS_DB_BACKEND is %s", backend)
+	}
+
+	coldPath, _, _, err := getTiering()
+	if err != nil {
+		return types.BackupManifest{}, err
+	}
+	if coldPath == "" && tiered.HasArchive(dir) {
+		return types.BackupManifest{}, fmt.Errorf("backup at %s has archived ciphertexts, FHEOS_DB_COLD_PATH must be set to restore them", dir)
+	}
+
+	manifest, err := pebble.Restore(dir, path, func(manifest types.BackupManifest) error {
+		if manifest.Version > maxVersion {
+			return fmt.Errorf("%w: backup version %d, binary version %d", ErrNewerVersion, manifest.Version, maxVersion)
+		}
+		return nil
+	})
+	if err != nil || coldPath == "" {
+		return manifest, err
+	}
+
+	return manifest, tiered.RestoreArchive(dir, coldPath)
+}
@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+	"github.com/fhenixprotocol/fheos/storage/tiered"
+)
+
+var ErrCheckpointUnsupported = errors.New("storage backend does not support checkpoints")
+
+type checkpointer interface {
+	Checkpoint(dir string) (types.BackupManifest, error)
+}
+
+// Checkpoint writes a consistent backup of the db to dir while it keeps serving requests
+func (fs *FheosStorage) Checkpoint(dir string) (types.BackupManifest, error) {
+	store, ok := fs.diskStore.(checkpointer)
+	if !ok {
+		return types.BackupManifest{}, ErrCheckpointUnsupported
+	}
+
+	manifest, err := store.Checkpoint(dir)
+	if errors.Is(err, tiered.ErrCheckpointUnsupported) {
+		return manifest, fmt.Errorf("%w: %w", ErrCheckpointUnsupported, err)
+	}
+	return manifest, err
+}
@@ -0,0 +1,187 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+	"github.com/fhenixprotocol/warp-drive/fhe-driver"
+)
+
+// A ciphertext record is laid out as:
+//
+//	magic (1) | version (1) | flags (1) | uint type (1) | key uint type (1) | security zone (4) | hash (32) | payload length (4) | payload | checksum (4)
+//
+// The checksum is the CRC-32C of everything before it. Version 1 records have no checksum.
+// All integers are big endian. Records that don't start with recordMagic are legacy gob encoded ciphertexts.
+// recordMagic can never be the first byte of a gob stream, which is either a small length (< 0x80) or a
+// negated byte count (>= 0xF8)
+const (
+	recordMagic   byte = 0xC7
+	RecordVersion byte = 2
+
+	headerSize   = 1 + 1 + 1 + 1 + 1 + 4 + 32 + 4
+	checksumSize = 4
+)
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+const (
+	flagPlaceholder byte = 1 << iota
+	flagCompact
+	flagCompressed
+	flagTriviallyEncrypted
+	// flagSnappy marks a payload compressed at rest, unlike flagCompressed which is the FHE level compression of the ciphertext
+	flagSnappy
+)
+
+var (
+	ErrTruncatedRecord    = errors.New("truncated ciphertext record")
+	ErrUnsupportedVersion = errors.New("unsupported ciphertext record version")
+	// ErrCorruptRecord is returned when a record doesn't match its checksum, or can't be decoded at all
+	ErrCorruptRecord = errors.New("corrupt ciphertext record")
+)
+
+func encodeFlags(cipher *types.FheEncrypted) byte {
+	var flags byte
+	if cipher.Placeholder {
+		flags |= flagPlaceholder
+	}
+	if cipher.Compact {
+		flags |= flagCompact
+	}
+	if cipher.Compressed {
+		flags |= flagCompressed
+	}
+	if cipher.Key.IsTriviallyEncrypted {
+		flags |= flagTriviallyEncrypted
+	}
+	return flags
+}
+
+// EncodeCt serializes cipher into the current record version, compressing the payload with compression
+func EncodeCt(cipher *types.FheEncrypted, compression Compression) ([]byte, error) {
+	payload := compress(compression, cipher.Data)
+	if uint64(len(payload)) > uint64(^uint32(0)) {
+		return nil, fmt.Errorf("ciphertext of %d bytes is too large to encode", len(payload))
+	}
+
+	flags := encodeFlags(cipher)
+	if compression == SnappyCompression {
+		flags |= flagSnappy
+	}
+
+	record := make([]byte, headerSize+len(payload)+checksumSize)
+	record[0] = recordMagic
+	record[1] = RecordVersion
+	record[2] = flags
+	record[3] = byte(cipher.UintType)
+	record[4] = byte(cipher.Key.UintType)
+	binary.BigEndian.PutUint32(record[5:9], uint32(cipher.Key.SecurityZone))
+	copy(record[9:41], cipher.Key.Hash[:])
+	binary.BigEndian.PutUint32(record[41:45], uint32(len(payload)))
+	copy(record[headerSize:], payload)
+	binary.BigEndian.PutUint32(record[headerSize+len(payload):], crc32.Checksum(record[:headerSize+len(payload)], checksumTable))
+
+	return record, nil
+}
+
+// HasChecksum returns true if record carries a checksum, i.e. it was written by the current record version
+func HasChecksum(record []byte) bool {
+	return len(record) > 1 && record[0] == recordMagic && record[1] >= 2
+}
+
+// DecodeCt deserializes a ciphertext record, falling back to gob for records written before the binary format existed
+func DecodeCt(record []byte) (*types.FheEncrypted, error) {
+	if len(record) == 0 || record[0] != recordMagic {
+		return decodeGob(record)
+	}
+
+	if len(record) < 2 {
+		return nil, ErrTruncatedRecord
+	}
+
+	version := record[1]
+	if version != 1 && version != RecordVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+
+	trailer := 0
+	if version >= 2 {
+		trailer = checksumSize
+	}
+
+	if len(record) < headerSize+trailer {
+		return nil, ErrTruncatedRecord
+	}
+
+	payloadLen := binary.BigEndian.Uint32(record[41:45])
+	if uint64(len(record)-headerSize-trailer) != uint64(payloadLen) {
+		return nil, ErrTruncatedRecord
+	}
+
+	end := headerSize + int(payloadLen)
+	if trailer > 0 && crc32.Checksum(record[:end], checksumTable) != binary.BigEndian.Uint32(record[end:]) {
+		return nil, ErrCorruptRecord
+	}
+
+	flags := record[2]
+	payload := record[headerSize:end]
+	if flags&flagSnappy != 0 {
+		var err error
+		if payload, err = decompress(payload); err != nil {
+			return nil, err
+		}
+	} else {
+		payload = append([]byte{}, payload...)
+	}
+
+	cipher := &types.FheEncrypted{
+		Data:        payload,
+		Placeholder: flags&flagPlaceholder != 0,
+		Compact:     flags&flagCompact != 0,
+		Compressed:  flags&flagCompressed != 0,
+		UintType:    fhe.EncryptionType(record[3]),
+		Key: fhe.CiphertextKey{
+			IsTriviallyEncrypted: flags&flagTriviallyEncrypted != 0,
+			UintType:             fhe.EncryptionType(record[4]),
+			SecurityZone:         int32(binary.BigEndian.Uint32(record[5:9])),
+		},
+	}
+	copy(cipher.Key.Hash[:], record[9:41])
+
+	return cipher, nil
+}
+
+func decodeGob(record []byte) (*types.FheEncrypted, error) {
+	var cipher types.FheEncrypted
+	err := gob.NewDecoder(bytes.NewBuffer(record)).Decode(&cipher)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptRecord, err)
+	}
+
+	return &cipher, nil
+}
+
+// EncodeRefCount serializes a reference count as two big endian uint64s
+func EncodeRefCount(rc types.RefCount) []byte {
+	val := make([]byte, 16)
+	binary.BigEndian.PutUint64(val[:8], rc.Count)
+	binary.BigEndian.PutUint64(val[8:], rc.ZeroSince)
+	return val
+}
+
+func DecodeRefCount(val []byte) (types.RefCount, error) {
+	if len(val) != 16 {
+		return types.RefCount{}, errors.New("invalid reference count record")
+	}
+
+	return types.RefCount{
+		Count:     binary.BigEndian.Uint64(val[:8]),
+		ZeroSince: binary.BigEndian.Uint64(val[8:]),
+	}, nil
+}
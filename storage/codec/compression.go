@@ -0,0 +1,80 @@
+package codec
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/golang/snappy"
+)
+
+// Compression is the algorithm used to compress the payload of a ciphertext record at rest. It is recorded per entry,
+// so changing it only affects newly written records
+type Compression uint8
+
+const (
+	NoCompression Compression = iota
+	SnappyCompression
+)
+
+func ParseCompression(s string) (Compression, error) {
+	switch s {
+	case "", "none":
+		return NoCompression, nil
+	case "snappy":
+		return SnappyCompression, nil
+	default:
+		return NoCompression, fmt.Errorf("unknown compression %q", s)
+	}
+}
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case SnappyCompression:
+		return "snappy"
+	default:
+		return fmt.Sprintf("Compression(%d)", uint8(c))
+	}
+}
+
+func updateHistogram(name string, value int64) {
+	sampler := func() metrics.Sample {
+		return metrics.NewBoundedHistogramSample()
+	}
+	metrics.GetOrRegisterHistogramLazy(name, nil, sampler).Update(value)
+}
+
+func compress(c Compression, payload []byte) []byte {
+	if c != SnappyCompression {
+		return payload
+	}
+
+	start := time.Now()
+	compressed := snappy.Encode(nil, payload)
+
+	if metrics.Enabled {
+		updateHistogram(fmt.Sprintf("%s/%s/%s/%s", "fheos", "db", "put", "compress"), time.Since(start).Microseconds())
+		if len(compressed) > 0 {
+			// Stored as a percentage, histograms only take integers
+			updateHistogram(fmt.Sprintf("%s/%s/%s/%s", "fheos", "db", "put", "ratio"), int64(len(payload))*100/int64(len(compressed)))
+		}
+	}
+
+	return compressed
+}
+
+func decompress(payload []byte) ([]byte, error) {
+	start := time.Now()
+	decompressed, err := snappy.Decode(nil, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if metrics.Enabled {
+		updateHistogram(fmt.Sprintf("%s/%s/%s/%s", "fheos", "db", "get", "decompress"), time.Since(start).Microseconds())
+	}
+
+	return decompressed, nil
+}
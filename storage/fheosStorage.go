@@ -1,28 +1,73 @@
-//go:build amd64 || arm64
-
 package storage
 
 import (
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
 	"github.com/fhenixprotocol/fheos/precompiles/types"
-	"github.com/fhenixprotocol/fheos/storage/pebble"
+	"github.com/fhenixprotocol/fheos/storage/codec"
+	"github.com/fhenixprotocol/fheos/storage/index"
 )
 
+var errNoAlias = errors.New("ciphertext has no alias")
+
 // FheosStorage is a wrapper around the diskStore - it is the main storage interface for the Fheos DB, which stores
 // all the ciphertexts that are not ephemeral - i.e. that are stored in the chain state.
 type FheosStorage struct {
 	diskStore types.Storage
+	// compression is used for the records FheosStorage writes itself, the shared payloads
+	compression codec.Compression
+	instance    *storageInstance
+}
+
+// storageInstance is what every copy of an opened FheosStorage shares. It is kept behind a pointer since FheosState
+// holds a copy of the FheosStorage it was opened with
+type storageInstance struct {
+	// refCount serializes the read-modify-write of reference counts
+	refCount sync.Mutex
+	// alias serializes the updates of aliases with the payloads they share
+	alias sync.Mutex
+	// txLayer serializes Commit/Discard against writes into the tx layers on top of this storage, so that a
+	// ciphertext can't be written in between flushing a layer and clearing it
+	txLayer sync.RWMutex
+
+	// recordedBlock and recordedParent describe the block RecordBlock last wrote to the journal, guarded by refCount
+	recorded       bool
+	recordedBlock  uint64
+	recordedParent common.Hash
+}
+
+func (fs *FheosStorage) Close() error {
+	return fs.diskStore.Close()
 }
 
 func (fs *FheosStorage) DeleteCt(h types.Hash) error {
-	return fs.diskStore.DeleteCt(h)
+	if err := fs.diskStore.DeleteCt(h); err != nil {
+		return err
+	}
+	if err := fs.deleteProvenance(h); err != nil {
+		return err
+	}
+
+	return fs.deleteAlias(h)
 }
 
 func (fs *FheosStorage) PutCt(h types.Hash, cipher *types.FheEncrypted) error {
 	return fs.diskStore.PutCt(h, cipher)
 }
 
+// GetCt falls back to the shared payload for placeholders that were resolved to an alias
 func (fs *FheosStorage) GetCt(h types.Hash) (*types.FheEncrypted, error) {
 	a, e := fs.diskStore.GetCt(h)
+	if e != nil {
+		if aliased, err := fs.getAliased(h); err == nil {
+			return aliased, nil
+		}
+	}
 	return a, e
 }
 
@@ -35,27 +80,203 @@ func (fs *FheosStorage) GetVersion() (uint64, error) {
 }
 
 func (fs *FheosStorage) HasCt(h types.Hash) bool {
-	return fs.diskStore.HasCt(h)
+	if fs.diskStore.HasCt(h) {
+		return true
+	}
+
+	_, ok := fs.GetAlias(h)
+	return ok
 }
 
-func newFheosStorage(diskStore types.Storage) *FheosStorage {
+func (fs *FheosStorage) GetRefCount(h types.Hash) (types.RefCount, error) {
+	return fs.diskStore.GetRefCount(h)
+}
 
-	if diskStore == nil {
-		panic("failed to initialize FheosStorage: diskStore is nil")
+func (fs *FheosStorage) PutRefCount(h types.Hash, rc types.RefCount) error {
+	return fs.diskStore.PutRefCount(h, rc)
+}
+
+func (fs *FheosStorage) DeleteRefCount(h types.Hash) error {
+	return fs.diskStore.DeleteRefCount(h)
+}
+
+func (fs *FheosStorage) IterateRefCounts(fn func(h types.Hash, rc types.RefCount) bool) error {
+	return fs.diskStore.IterateRefCounts(fn)
+}
+
+func (fs *FheosStorage) Put(t types.DataType, key []byte, val []byte) error {
+	return fs.diskStore.Put(t, key, val)
+}
+
+func (fs *FheosStorage) Get(t types.DataType, key []byte) ([]byte, error) {
+	return fs.diskStore.Get(t, key)
+}
+
+func (fs *FheosStorage) Delete(t types.DataType, key []byte) error {
+	return fs.diskStore.Delete(t, key)
+}
+
+func (fs *FheosStorage) IteratePrefix(t types.DataType, prefix []byte, fn func(key []byte, val []byte) bool) error {
+	return fs.diskStore.IteratePrefix(t, prefix, fn)
+}
+
+func (fs *FheosStorage) IterateCts(filter types.CtFilter, fn func(m types.CtMetadata) bool) error {
+	return fs.diskStore.IterateCts(filter, fn)
+}
+
+func (fs *FheosStorage) IterateUsage(fn func(u types.Usage) bool) error {
+	return fs.diskStore.IterateUsage(fn)
+}
+
+// ZoneUsage sums the usage of every type in a security zone
+func (fs *FheosStorage) ZoneUsage(zone int32) (types.Usage, error) {
+	total := types.Usage{SecurityZone: zone}
+	err := fs.diskStore.IterateUsage(func(u types.Usage) bool {
+		if u.SecurityZone == zone {
+			total.Count += u.Count
+			total.Bytes += u.Bytes
+			total.Placeholders += u.Placeholders
+		}
+		return true
+	})
+	return total, err
+}
+
+// TrackCt starts reference counting a ciphertext that was just committed to disk. Until a contract stores it, its
+// count is zero as of block, so it will be collected once the grace period passes.
+// Only the ciphertexts committed from a tx layer are tracked. Those written straight to disk (MultiStore without a
+// tx layer, as in the coprocessor and HTTP paths) are referenced by the state of another chain, which the storage
+// hooks never see, so they are never counted and never collected
+func (fs *FheosStorage) TrackCt(h types.Hash, block uint64) error {
+	fs.instance.refCount.Lock()
+	defer fs.instance.refCount.Unlock()
+
+	if _, err := fs.diskStore.GetRefCount(h); err == nil {
+		return nil
 	}
 
-	return &FheosStorage{
-		diskStore: diskStore,
+	if err := fs.journalRefCount(h, block); err != nil {
+		return err
 	}
+	return fs.diskStore.PutRefCount(h, types.RefCount{Count: 0, ZeroSince: block})
 }
 
-func InitStorage(path string) (*FheosStorage, error) {
-	storage, err := pebble.NewStorage(path)
+// UpdateRefCount applies delta to the reference count of h. Values that aren't known ciphertexts are ignored, since
+// the storage hooks see every value written to contract state
+func (fs *FheosStorage) UpdateRefCount(h types.Hash, delta int64, block uint64) error {
+	fs.instance.refCount.Lock()
+	defer fs.instance.refCount.Unlock()
+
+	rc, err := fs.diskStore.GetRefCount(h)
 	if err != nil {
-		return nil, err
+		if delta < 0 || !fs.HasCt(h) {
+			return nil
+		}
+		rc = types.RefCount{Count: 0, ZeroSince: block}
+	}
+
+	wasReferenced := rc.Count > 0
+	if delta < 0 && uint64(-delta) >= rc.Count {
+		rc.Count = 0
+	} else {
+		rc.Count = uint64(int64(rc.Count) + delta)
+	}
+
+	if rc.Count > 0 {
+		rc.ZeroSince = 0
+	} else if wasReferenced {
+		rc.ZeroSince = block
 	}
 
-	fheosStore := newFheosStorage(storage)
+	if err := fs.journalRefCount(h, block); err != nil {
+		return err
+	}
+	return fs.diskStore.PutRefCount(h, rc)
+}
 
-	return fheosStore, nil
+type flatLayoutMigrator interface {
+	MigrateFlatLayout() (int, error)
+}
+
+func migrateFlatLayout(fs *FheosStorage) error {
+	migrator, ok := fs.diskStore.(flatLayoutMigrator)
+	if !ok {
+		return nil
+	}
+
+	moved, err := migrator.MigrateFlatLayout()
+	log.Info("moved fheos db keys into namespaces", "keys", moved)
+	return err
+}
+
+// indexCiphertexts backfills the ciphertext index for the ciphertexts stored before it existed
+func indexCiphertexts(fs *FheosStorage) error {
+	indexed := 0
+	var indexErr error
+	err := fs.IteratePrefix(types.NamespaceCiphertexts, nil, func(key []byte, val []byte) bool {
+		ct, err := codec.DecodeCt(val)
+		if err != nil {
+			log.Warn("skipping undecodable ciphertext while indexing", "hash", hex.EncodeToString(key), "err", err)
+			return true
+		}
+
+		var h types.Hash
+		copy(h[:], key)
+		if indexErr = index.PutCreated(fs.diskStore, h, ct.Placeholder, time.Now()); indexErr != nil {
+			return false
+		}
+		indexed++
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info("indexed existing ciphertexts", "ciphertexts", indexed)
+	return indexErr
+}
+
+// trackUsage rebuilds the ciphertext index with the size of every ciphertext, along with the usage counters
+func trackUsage(fs *FheosStorage) error {
+	indexed := 0
+	err := index.Rebuild(fs.diskStore, func(put func(h types.Hash, placeholder bool, size uint64) error) error {
+		var putErr error
+		err := fs.IteratePrefix(types.NamespaceCiphertexts, nil, func(key []byte, val []byte) bool {
+			ct, err := codec.DecodeCt(val)
+			if err != nil {
+				log.Warn("skipping undecodable ciphertext while indexing", "hash", hex.EncodeToString(key), "err", err)
+				return true
+			}
+
+			var h types.Hash
+			copy(h[:], key)
+			if putErr = put(h, ct.Placeholder, uint64(len(ct.Data))); putErr != nil {
+				return false
+			}
+			indexed++
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		return putErr
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info("tracked usage of existing ciphertexts", "ciphertexts", indexed)
+	return nil
+}
+
+func newFheosStorage(diskStore types.Storage) *FheosStorage {
+
+	if diskStore == nil {
+		panic("failed to initialize FheosStorage: diskStore is nil")
+	}
+
+	return &FheosStorage{
+		diskStore: diskStore,
+		instance:  &storageInstance{},
+	}
 }
@@ -0,0 +1,243 @@
+// Package fsdb implements types.Storage on top of plain files, one file per key. Meant for inspecting the stored data
+// by hand and for setups where pebble isn't an option, not for production load
+package fsdb
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+	"github.com/fhenixprotocol/fheos/storage/codec"
+	"github.com/fhenixprotocol/fheos/storage/index"
+)
+
+var ErrNotFound = errors.New("not found")
+
+var (
+	versionKey     = []byte("version")
+	refCountPrefix = []byte("refcount/")
+)
+
+// Database stores every key in <root>/<namespace>/<hex encoded key>. Hex encoding keeps the directory listing in key order
+type Database struct {
+	root        string
+	compression codec.Compression
+}
+
+func New(root string, compression codec.Compression) (*Database, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	return &Database{root: root, compression: compression}, nil
+}
+
+// Close is a no-op, every access opens and closes its own file
+func (db *Database) Close() error {
+	return nil
+}
+
+func (db *Database) namespaceDir(t types.DataType) string {
+	return filepath.Join(db.root, fmt.Sprintf("%d", t))
+}
+
+func (db *Database) path(t types.DataType, key []byte) string {
+	return filepath.Join(db.namespaceDir(t), hex.EncodeToString(key))
+}
+
+// Put writes the value to a temporary file and renames it into place, so readers never see a partial value
+func (db *Database) Put(t types.DataType, key []byte, val []byte) error {
+	dir := db.namespaceDir(t)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(val); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), db.path(t, key))
+}
+
+func (db *Database) Get(t types.DataType, key []byte) ([]byte, error) {
+	val, err := os.ReadFile(db.path(t, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return val, err
+}
+
+func (db *Database) Has(t types.DataType, key []byte) bool {
+	_, err := os.Stat(db.path(t, key))
+	return err == nil
+}
+
+func (db *Database) Delete(t types.DataType, key []byte) error {
+	err := os.Remove(db.path(t, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (db *Database) IteratePrefix(t types.DataType, prefix []byte, fn func(key []byte, val []byte) bool) error {
+	entries, err := os.ReadDir(db.namespaceDir(t))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	hexPrefix := hex.EncodeToString(prefix)
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasPrefix(entry.Name(), hexPrefix) && !strings.HasPrefix(entry.Name(), ".tmp-") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		key, err := hex.DecodeString(name)
+		if err != nil {
+			continue
+		}
+
+		val, err := db.Get(t, key)
+		if errors.Is(err, ErrNotFound) {
+			// Deleted since we listed the directory
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if !fn(key, val) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// GetVersion returns 0 if no version was ever written, i.e. the db is new
+func (db *Database) GetVersion() (uint64, error) {
+	val, err := db.Get(types.NamespaceMetadata, versionKey)
+	if errors.Is(err, ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if len(val) != 8 {
+		return 0, errors.New("invalid version record")
+	}
+	return binary.BigEndian.Uint64(val), nil
+}
+
+func (db *Database) PutVersion(v uint64) error {
+	return db.Put(types.NamespaceMetadata, versionKey, binary.BigEndian.AppendUint64(nil, v))
+}
+
+func (db *Database) PutCt(h types.Hash, cipher *types.FheEncrypted) error {
+	val, err := codec.EncodeCt(cipher, db.compression)
+	if err != nil {
+		return err
+	}
+
+	if err := db.Put(types.NamespaceCiphertexts, h[:], val); err != nil {
+		return err
+	}
+
+	return index.Put(db, h, cipher.Placeholder, uint64(len(cipher.Data)), time.Now())
+}
+
+func (db *Database) GetCt(h types.Hash) (*types.FheEncrypted, error) {
+	val, err := db.Get(types.NamespaceCiphertexts, h[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return codec.DecodeCt(val)
+}
+
+func (db *Database) HasCt(h types.Hash) bool {
+	return db.Has(types.NamespaceCiphertexts, h[:])
+}
+
+func (db *Database) DeleteCt(h types.Hash) error {
+	if err := db.Delete(types.NamespaceCiphertexts, h[:]); err != nil {
+		return err
+	}
+
+	return index.Delete(db, h)
+}
+
+func (db *Database) IterateCts(filter types.CtFilter, fn func(m types.CtMetadata) bool) error {
+	return index.Iterate(db, filter, fn)
+}
+
+func (db *Database) IterateUsage(fn func(u types.Usage) bool) error {
+	return index.IterateUsage(db, fn)
+}
+
+func refCountKey(h types.Hash) []byte {
+	return append(append([]byte{}, refCountPrefix...), h[:]...)
+}
+
+func (db *Database) GetRefCount(h types.Hash) (types.RefCount, error) {
+	val, err := db.Get(types.NamespaceMetadata, refCountKey(h))
+	if err != nil {
+		return types.RefCount{}, err
+	}
+
+	return codec.DecodeRefCount(val)
+}
+
+func (db *Database) PutRefCount(h types.Hash, rc types.RefCount) error {
+	return db.Put(types.NamespaceMetadata, refCountKey(h), codec.EncodeRefCount(rc))
+}
+
+func (db *Database) DeleteRefCount(h types.Hash) error {
+	return db.Delete(types.NamespaceMetadata, refCountKey(h))
+}
+
+func (db *Database) IterateRefCounts(fn func(h types.Hash, rc types.RefCount) bool) error {
+	var decodeErr error
+	err := db.IteratePrefix(types.NamespaceMetadata, refCountPrefix, func(key []byte, val []byte) bool {
+		var h types.Hash
+		copy(h[:], key[len(refCountPrefix):])
+
+		rc, err := codec.DecodeRefCount(val)
+		if err != nil {
+			decodeErr = err
+			return false
+		}
+
+		return fn(h, rc)
+	})
+	if err != nil {
+		return err
+	}
+
+	return decodeErr
+}
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+	"github.com/fhenixprotocol/warp-drive/fhe-driver"
+)
+
+type GCConfig struct {
+	// GraceBlocks is how many blocks a ciphertext must stay unreferenced before it is deleted. It is also how far back
+	// reference counts can be reverted on a reorg, so it must be larger than the deepest reorg expected
+	GraceBlocks uint64
+	Interval    time.Duration
+	// DryRun only reports what would be deleted
+	DryRun bool
+}
+
+type GCReport struct {
+	Head       uint64
+	DryRun     bool
+	Candidates []types.Hash
+	Deleted    int
+}
+
+// RefCountCollector periodically deletes ciphertexts whose reference count has been zero for at least
+// GCConfig.GraceBlocks blocks. Only ciphertexts committed by chain txs are counted (see FheosStorage.TrackCt)
+type RefCountCollector struct {
+	store  *FheosStorage
+	config GCConfig
+	head   atomic.Uint64
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func NewRefCountCollector(store *FheosStorage, config GCConfig) *RefCountCollector {
+	return &RefCountCollector{
+		store:  store,
+		config: config,
+	}
+}
+
+// SetHead updates the latest block number seen by the node, which the grace period is measured against
+func (c *RefCountCollector) SetHead(block uint64) {
+	c.head.Store(block)
+}
+
+func (c *RefCountCollector) isCollectable(rc types.RefCount, head uint64) bool {
+	return rc.Count == 0 && head >= rc.ZeroSince+c.config.GraceBlocks
+}
+
+// Collect does a single pass over the reference counts and deletes (or, in dry-run mode, reports) every collectable ciphertext
+func (c *RefCountCollector) Collect() (GCReport, error) {
+	report := GCReport{
+		Head:   c.head.Load(),
+		DryRun: c.config.DryRun,
+	}
+
+	err := c.store.IterateRefCounts(func(h types.Hash, rc types.RefCount) bool {
+		if c.isCollectable(rc, report.Head) {
+			report.Candidates = append(report.Candidates, h)
+		}
+		return true
+	})
+	if err != nil {
+		return report, err
+	}
+
+	if c.config.DryRun {
+		return report, nil
+	}
+
+	if report.Head > c.config.GraceBlocks {
+		if err := c.store.PruneRefJournal(report.Head - c.config.GraceBlocks); err != nil {
+			return report, err
+		}
+	}
+
+	for _, h := range report.Candidates {
+		deleted, err := c.collect(h, report.Head)
+		if err != nil {
+			return report, err
+		}
+		if deleted {
+			report.Deleted++
+		}
+	}
+
+	if metrics.Enabled {
+		metrics.GetOrRegisterCounter("fheos/gc/deleted", nil).Inc(int64(report.Deleted))
+	}
+
+	return report, nil
+}
+
+func (c *RefCountCollector) collect(h types.Hash, head uint64) (bool, error) {
+	c.store.instance.refCount.Lock()
+	defer c.store.instance.refCount.Unlock()
+
+	// The ciphertext might have been referenced again since we listed it
+	rc, err := c.store.diskStore.GetRefCount(h)
+	if err != nil || !c.isCollectable(rc, head) {
+		return false, nil
+	}
+
+	if err := c.store.DeleteCt(h); err != nil {
+		return false, err
+	}
+
+	return true, c.store.diskStore.DeleteRefCount(h)
+}
+
+func (c *RefCountCollector) Start() {
+	c.stop = make(chan struct{})
+	c.wg.Add(1)
+
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(c.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				report, err := c.Collect()
+				if err != nil {
+					log.Error("fheos garbage collection failed", "err", err)
+					continue
+				}
+
+				if report.DryRun {
+					log.Info("fheos garbage collection dry run", "head", report.Head, "candidates", len(report.Candidates))
+					for _, h := range report.Candidates {
+						log.Debug("fheos garbage collection candidate", "hash", fhe.Hash(h).Hex())
+					}
+				} else if report.Deleted > 0 {
+					log.Info("fheos garbage collection", "head", report.Head, "deleted", report.Deleted)
+				}
+			}
+		}
+	}()
+}
+
+func (c *RefCountCollector) Stop() {
+	if c.stop == nil {
+		return
+	}
+
+	close(c.stop)
+	c.wg.Wait()
+	c.stop = nil
+}
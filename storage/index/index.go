@@ -0,0 +1,323 @@
+// Package index maintains the metadata index of the stored ciphertexts in the NamespaceIndexes namespace, so that
+// they can be enumerated by security zone, type and placeholder flag without decoding them, along with running
+// usage counters per security zone and type
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+	"github.com/fhenixprotocol/warp-drive/fhe-driver"
+)
+
+// Every ciphertext has a single entry:
+//
+//	"ct/" | security zone | type | placeholder | hash  ->  creation time (unix nanoseconds) | size (bytes)
+//
+// and every security zone and type pair has a usage counter:
+//
+//	"usage/" | security zone | type  ->  count | bytes | placeholders
+//
+// Zone and type come from bytes 31 and 30 of the hash, so scans by zone, or by zone and type, are prefix scans
+var (
+	ctPrefix    = []byte("ct/")
+	usagePrefix = []byte("usage/")
+)
+
+// lock serializes the read-modify-write of entries and usage counters
+var lock sync.Mutex
+
+type entry struct {
+	createdAt time.Time
+	size      uint64
+}
+
+func entryPrefix(zone byte, utype byte, placeholder bool, levels int) []byte {
+	prefix := append([]byte{}, ctPrefix...)
+	fields := []byte{zone, utype, 0}
+	if placeholder {
+		fields[2] = 1
+	}
+	return append(prefix, fields[:levels]...)
+}
+
+func entryKey(h types.Hash, placeholder bool) []byte {
+	return append(entryPrefix(h[types.SecurityZoneByte], h[types.TrivialEncryptAndTypeByte]&types.TypeMask, placeholder, 3), h[:]...)
+}
+
+func usageKey(zone byte, utype byte) []byte {
+	return append(append([]byte{}, usagePrefix...), zone, utype)
+}
+
+func encodeEntry(e entry) []byte {
+	val := binary.BigEndian.AppendUint64(nil, uint64(e.createdAt.UnixNano()))
+	return binary.BigEndian.AppendUint64(val, e.size)
+}
+
+// decodeEntry also accepts the entries written before sizes were tracked, which only hold the creation time
+func decodeEntry(val []byte) (entry, error) {
+	if len(val) != 8 && len(val) != 16 {
+		return entry{}, errors.New("invalid ciphertext index entry")
+	}
+
+	e := entry{createdAt: time.Unix(0, int64(binary.BigEndian.Uint64(val[:8])))}
+	if len(val) == 16 {
+		e.size = binary.BigEndian.Uint64(val[8:])
+	}
+	return e, nil
+}
+
+func encodeUsage(u types.Usage) []byte {
+	val := binary.BigEndian.AppendUint64(nil, u.Count)
+	val = binary.BigEndian.AppendUint64(val, u.Bytes)
+	return binary.BigEndian.AppendUint64(val, u.Placeholders)
+}
+
+func decodeUsage(zone byte, utype byte, val []byte) (types.Usage, error) {
+	if len(val) != 24 {
+		return types.Usage{}, errors.New("invalid usage counter")
+	}
+
+	return types.Usage{
+		SecurityZone: int32(zone),
+		UintType:     fhe.EncryptionType(utype),
+		Count:        binary.BigEndian.Uint64(val[:8]),
+		Bytes:        binary.BigEndian.Uint64(val[8:16]),
+		Placeholders: binary.BigEndian.Uint64(val[16:]),
+	}, nil
+}
+
+// getEntry returns the entry of h and whether it is a placeholder, or ok=false if h isn't indexed
+func getEntry(db types.NamespacedStorage, h types.Hash) (e entry, placeholder bool, ok bool) {
+	for _, flag := range []bool{false, true} {
+		val, err := db.Get(types.NamespaceIndexes, entryKey(h, flag))
+		if err != nil {
+			continue
+		}
+		if e, err := decodeEntry(val); err == nil {
+			return e, flag, true
+		}
+	}
+
+	return entry{}, false, false
+}
+
+// updateUsage adds (or, with sign -1, removes) a ciphertext of the given size to the counters of its zone and type
+func updateUsage(db types.NamespacedStorage, h types.Hash, size uint64, placeholder bool, sign int) error {
+	zone, utype := h[types.SecurityZoneByte], h[types.TrivialEncryptAndTypeByte]&types.TypeMask
+	u, err := GetUsage(db, int32(zone), fhe.EncryptionType(utype))
+	if err != nil {
+		return err
+	}
+
+	placeholders := uint64(0)
+	if placeholder {
+		placeholders = 1
+	}
+
+	if sign > 0 {
+		u.Count++
+		u.Bytes += size
+		u.Placeholders += placeholders
+	} else {
+		u.Count -= min(u.Count, 1)
+		u.Bytes -= min(u.Bytes, size)
+		u.Placeholders -= min(u.Placeholders, placeholders)
+	}
+
+	if metrics.Enabled {
+		name := fmt.Sprintf("%s/%s/%s/%d/%d", "fheos", "db", "usage", zone, utype)
+		metrics.GetOrRegisterGauge(name+"/count", nil).Update(int64(u.Count))
+		metrics.GetOrRegisterGauge(name+"/bytes", nil).Update(int64(u.Bytes))
+		metrics.GetOrRegisterGauge(name+"/placeholders", nil).Update(int64(u.Placeholders))
+	}
+
+	return db.Put(types.NamespaceIndexes, usageKey(zone, utype), encodeUsage(u))
+}
+
+// Put indexes a ciphertext of size bytes that was just written. A ciphertext that is already indexed keeps its
+// creation time, so a resolved placeholder still shows when the operation was requested
+func Put(db types.NamespacedStorage, h types.Hash, placeholder bool, size uint64, now time.Time) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	e := entry{createdAt: now, size: size}
+	if prev, prevPlaceholder, ok := getEntry(db, h); ok {
+		e.createdAt = prev.createdAt
+		if err := db.Delete(types.NamespaceIndexes, entryKey(h, prevPlaceholder)); err != nil {
+			return err
+		}
+		if err := updateUsage(db, h, prev.size, prevPlaceholder, -1); err != nil {
+			return err
+		}
+	}
+
+	if err := updateUsage(db, h, size, placeholder, 1); err != nil {
+		return err
+	}
+	return db.Put(types.NamespaceIndexes, entryKey(h, placeholder), encodeEntry(e))
+}
+
+// PutCreated indexes a ciphertext with its creation time only, the way the version 1003 index did. It keeps an
+// existing entry and leaves the usage counters alone, which are backfilled from the ciphertexts themselves
+func PutCreated(db types.NamespacedStorage, h types.Hash, placeholder bool, now time.Time) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, _, ok := getEntry(db, h); ok {
+		return nil
+	}
+	return db.Put(types.NamespaceIndexes, entryKey(h, placeholder), binary.BigEndian.AppendUint64(nil, uint64(now.UnixNano())))
+}
+
+// Get returns the metadata of h, or ok=false if h isn't indexed
+func Get(db types.NamespacedStorage, h types.Hash) (types.CtMetadata, bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	e, placeholder, ok := getEntry(db, h)
+	if !ok {
+		return types.CtMetadata{}, false
+	}
+
+	m := types.NewCtMetadata(h, placeholder, e.createdAt)
+	m.Size = e.size
+	return m, true
+}
+
+func Delete(db types.NamespacedStorage, h types.Hash) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	prev, prevPlaceholder, ok := getEntry(db, h)
+	if !ok {
+		return nil
+	}
+
+	if err := updateUsage(db, h, prev.size, prevPlaceholder, -1); err != nil {
+		return err
+	}
+	return db.Delete(types.NamespaceIndexes, entryKey(h, prevPlaceholder))
+}
+
+// Iterate scans the smallest key range that covers filter and calls fn for every matching ciphertext
+func Iterate(db types.NamespacedStorage, filter types.CtFilter, fn func(m types.CtMetadata) bool) error {
+	levels := 0
+	var zone, utype byte
+	placeholder := false
+	if filter.SecurityZone != nil {
+		zone, levels = byte(*filter.SecurityZone), 1
+		if filter.UintType != nil {
+			utype, levels = byte(*filter.UintType)&types.TypeMask, 2
+			if filter.Placeholder != nil {
+				placeholder, levels = *filter.Placeholder, 3
+			}
+		}
+	}
+
+	var decodeErr error
+	err := db.IteratePrefix(types.NamespaceIndexes, entryPrefix(zone, utype, placeholder, levels), func(key []byte, val []byte) bool {
+		if len(key) != len(ctPrefix)+3+len(types.Hash{}) {
+			return true
+		}
+
+		e, err := decodeEntry(val)
+		if err != nil {
+			decodeErr = err
+			return false
+		}
+
+		var h types.Hash
+		copy(h[:], key[len(ctPrefix)+3:])
+		m := types.NewCtMetadata(h, key[len(ctPrefix)+2] == 1, e.createdAt)
+		m.Size = e.size
+		if !filter.Matches(m) {
+			return true
+		}
+		return fn(m)
+	})
+	if err != nil {
+		return err
+	}
+
+	return decodeErr
+}
+
+// GetUsage returns the usage counters of a security zone and type, which are zero if nothing was ever stored there
+func GetUsage(db types.NamespacedStorage, zone int32, utype fhe.EncryptionType) (types.Usage, error) {
+	val, err := db.Get(types.NamespaceIndexes, usageKey(byte(zone), byte(utype)&types.TypeMask))
+	if err != nil {
+		return types.Usage{SecurityZone: zone, UintType: utype}, nil
+	}
+
+	return decodeUsage(byte(zone), byte(utype)&types.TypeMask, val)
+}
+
+// IterateUsage calls fn with the usage counters of every security zone and type that was ever used
+func IterateUsage(db types.NamespacedStorage, fn func(u types.Usage) bool) error {
+	var decodeErr error
+	err := db.IteratePrefix(types.NamespaceIndexes, usagePrefix, func(key []byte, val []byte) bool {
+		if len(key) != len(usagePrefix)+2 {
+			return true
+		}
+
+		u, err := decodeUsage(key[len(usagePrefix)], key[len(usagePrefix)+1], val)
+		if err != nil {
+			decodeErr = err
+			return false
+		}
+		return fn(u)
+	})
+	if err != nil {
+		return err
+	}
+
+	return decodeErr
+}
+
+// Rebuild drops every entry and usage counter, then calls cts to reindex the stored ciphertexts through put. Entries
+// that existed before keep their creation time
+func Rebuild(db types.NamespacedStorage, cts func(put func(h types.Hash, placeholder bool, size uint64) error) error) error {
+	createdAt := map[types.Hash]time.Time{}
+	var keys [][]byte
+	err := db.IteratePrefix(types.NamespaceIndexes, ctPrefix, func(key []byte, val []byte) bool {
+		if e, err := decodeEntry(val); err == nil && len(key) == len(ctPrefix)+3+len(types.Hash{}) {
+			var h types.Hash
+			copy(h[:], key[len(ctPrefix)+3:])
+			createdAt[h] = e.createdAt
+		}
+		keys = append(keys, append([]byte{}, key...))
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	err = db.IteratePrefix(types.NamespaceIndexes, usagePrefix, func(key []byte, val []byte) bool {
+		keys = append(keys, append([]byte{}, key...))
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := db.Delete(types.NamespaceIndexes, key); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	return cts(func(h types.Hash, placeholder bool, size uint64) error {
+		t, ok := createdAt[h]
+		if !ok {
+			t = now
+		}
+		return Put(db, h, placeholder, size, t)
+	})
+}
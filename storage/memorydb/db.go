@@ -20,8 +20,13 @@ package ephemeraldb
 
 import (
 	"errors"
-	"github.com/fhenixprotocol/fheos/precompiles/types"
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+	"github.com/fhenixprotocol/fheos/storage/codec"
+	"github.com/fhenixprotocol/fheos/storage/index"
 )
 
 var (
@@ -34,6 +39,8 @@ var (
 	ErrMemorydbNotFound = errors.New("not found")
 )
 
+var refCountPrefix = []byte("refcount/")
+
 // ClearAll removes all entries from the database.
 func (db *Database) ClearAll() error {
 	db.lock.Lock()
@@ -43,11 +50,14 @@ func (db *Database) ClearAll() error {
 		return errMemorydbClosed
 	}
 
-	// Reinitialize the map to clear all entries
+	// Reinitialize the maps to clear all entries
 	db.db = make(map[string][]byte)
+	db.encryptedDb = make(map[types.Hash]*types.FheEncrypted)
+	db.version = 0
 	return nil
 }
 
+// Database is an in-memory implementation of types.Storage, for tests and devnets
 type Database struct {
 	db          map[string][]byte
 	version     uint64
@@ -62,6 +72,16 @@ func New() *Database {
 	}
 }
 
+// Close drops all the data, any later access fails
+func (db *Database) Close() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.db = nil
+	db.encryptedDb = nil
+	return nil
+}
+
 func (db *Database) GetVersion() (uint64, error) {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
@@ -83,7 +103,75 @@ func (db *Database) PutVersion(v uint64) error {
 	return nil
 }
 
+func copyCt(cipher *types.FheEncrypted) *types.FheEncrypted {
+	ct := *cipher
+	ct.Data = append([]byte{}, cipher.Data...)
+	return &ct
+}
+
 func (db *Database) PutCt(h types.Hash, cipher *types.FheEncrypted) error {
+	db.lock.Lock()
+	if db.db == nil {
+		db.lock.Unlock()
+		return errMemorydbClosed
+	}
+
+	// Store the encrypted data in a separate map. The ciphertext is copied so callers can't change it behind our back
+	db.encryptedDb[h] = copyCt(cipher)
+	db.lock.Unlock()
+
+	return index.Put(db, h, cipher.Placeholder, uint64(len(cipher.Data)), time.Now())
+}
+
+func (db *Database) GetCt(h types.Hash) (*types.FheEncrypted, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	if db.db == nil {
+		return nil, errMemorydbClosed
+	}
+
+	cipher, ok := db.encryptedDb[h]
+	if !ok {
+		return nil, ErrMemorydbNotFound
+	}
+	return copyCt(cipher), nil
+}
+
+func (db *Database) HasCt(h types.Hash) bool {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	_, ok := db.encryptedDb[h]
+	return ok
+}
+
+func (db *Database) DeleteCt(h types.Hash) error {
+	db.lock.Lock()
+	if db.db == nil {
+		db.lock.Unlock()
+		return errMemorydbClosed
+	}
+
+	delete(db.encryptedDb, h)
+	db.lock.Unlock()
+
+	return index.Delete(db, h)
+}
+
+func (db *Database) IterateCts(filter types.CtFilter, fn func(m types.CtMetadata) bool) error {
+	return index.Iterate(db, filter, fn)
+}
+
+func (db *Database) IterateUsage(fn func(u types.Usage) bool) error {
+	return index.IterateUsage(db, fn)
+}
+
+func namespacedKey(t types.DataType, key []byte) string {
+	return string(append([]byte{byte(t)}, key...))
+}
+
+func (db *Database) Put(t types.DataType, key []byte, val []byte) error {
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
@@ -91,12 +179,11 @@ func (db *Database) PutCt(h types.Hash, cipher *types.FheEncrypted) error {
 		return errMemorydbClosed
 	}
 
-	// Store the encrypted data in a separate map.
-	db.encryptedDb[h] = cipher
+	db.db[namespacedKey(t, key)] = append([]byte{}, val...)
 	return nil
 }
 
-func (db *Database) GetCt(h types.Hash) (*types.FheEncrypted, error) {
+func (db *Database) Get(t types.DataType, key []byte) ([]byte, error) {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 
@@ -104,10 +191,94 @@ func (db *Database) GetCt(h types.Hash) (*types.FheEncrypted, error) {
 		return nil, errMemorydbClosed
 	}
 
-	cipher, ok := db.encryptedDb[h]
+	val, ok := db.db[namespacedKey(t, key)]
 	if !ok {
 		return nil, ErrMemorydbNotFound
 	}
-	// Assuming a deep copy is not required for *types.FheEncrypted, return directly.
-	return cipher, nil
+	return append([]byte{}, val...), nil
+}
+
+func (db *Database) Delete(t types.DataType, key []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.db == nil {
+		return errMemorydbClosed
+	}
+
+	delete(db.db, namespacedKey(t, key))
+	return nil
+}
+
+// IteratePrefix iterates over a snapshot of the matching keys, so fn may modify the database
+func (db *Database) IteratePrefix(t types.DataType, prefix []byte, fn func(key []byte, val []byte) bool) error {
+	db.lock.RLock()
+	if db.db == nil {
+		db.lock.RUnlock()
+		return errMemorydbClosed
+	}
+
+	start := namespacedKey(t, prefix)
+	var keys []string
+	for key := range db.db {
+		if len(key) >= len(start) && key[:len(start)] == start {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = db.db[key]
+	}
+	db.lock.RUnlock()
+
+	for i, key := range keys {
+		if !fn([]byte(key[1:]), values[i]) {
+			break
+		}
+	}
+	return nil
+}
+
+func refCountKey(h types.Hash) []byte {
+	return append(append([]byte{}, refCountPrefix...), h[:]...)
+}
+
+func (db *Database) GetRefCount(h types.Hash) (types.RefCount, error) {
+	val, err := db.Get(types.NamespaceMetadata, refCountKey(h))
+	if err != nil {
+		return types.RefCount{}, err
+	}
+
+	return codec.DecodeRefCount(val)
+}
+
+func (db *Database) PutRefCount(h types.Hash, rc types.RefCount) error {
+	return db.Put(types.NamespaceMetadata, refCountKey(h), codec.EncodeRefCount(rc))
+}
+
+func (db *Database) DeleteRefCount(h types.Hash) error {
+	return db.Delete(types.NamespaceMetadata, refCountKey(h))
+}
+
+func (db *Database) IterateRefCounts(fn func(h types.Hash, rc types.RefCount) bool) error {
+	var decodeErr error
+	err := db.IteratePrefix(types.NamespaceMetadata, refCountPrefix, func(key []byte, val []byte) bool {
+		var h types.Hash
+		copy(h[:], key[len(refCountPrefix):])
+
+		rc, err := codec.DecodeRefCount(val)
+		if err != nil {
+			decodeErr = err
+			return false
+		}
+
+		return fn(h, rc)
+	})
+	if err != nil {
+		return err
+	}
+
+	return decodeErr
 }
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// Migration upgrades the db from the previous version to Version. A step may be interrupted at any point and is
+// rerun from scratch on the next start, so it has to be idempotent
+type Migration struct {
+	Version     uint64
+	Description string
+	Migrate     func(store *FheosStorage) error
+}
+
+// Migrations is the list of every migration of the fheos db, in any order
+var Migrations = []Migration{
+	{Version: 1002, Description: "move keys into namespaces", Migrate: migrateFlatLayout},
+	{Version: 1003, Description: "index existing ciphertexts", Migrate: indexCiphertexts},
+	{Version: 1004, Description: "track ciphertext sizes and usage per security zone and type", Migrate: trackUsage},
+	{Version: 1005, Description: "move shared payloads out of the ciphertext namespace", Migrate: movePayloads},
+	{Version: 1006, Description: "move the reference count journal into its own namespace", Migrate: moveRefJournal},
+}
+
+var (
+	ErrNewerVersion    = errors.New("fheos db was written by a newer version")
+	ErrOutdatedVersion = errors.New("fheos db has to be migrated")
+)
+
+type MigrationReport struct {
+	From    uint64
+	To      uint64
+	DryRun  bool
+	Applied []Migration
+}
+
+// CheckVersion fails unless the db is at version target (or new), so that it can be used as is
+func (fs *FheosStorage) CheckVersion(target uint64) error {
+	stored, err := fs.GetVersion()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case stored > target:
+		return fmt.Errorf("%w: db version %d, binary version %d", ErrNewerVersion, stored, target)
+	case stored != 0 && stored < target:
+		return fmt.Errorf("%w: db version %d, binary version %d", ErrOutdatedVersion, stored, target)
+	default:
+		return nil
+	}
+}
+
+// Migrate runs the steps needed to bring the db from its stored version up to target, persisting the version after
+// every step so an interrupted migration resumes where it stopped. A new db (no stored version) needs no migration.
+// In dry-run mode the pending steps are only reported
+func (fs *FheosStorage) Migrate(steps []Migration, target uint64, dryRun bool) (MigrationReport, error) {
+	stored, err := fs.GetVersion()
+	if err != nil {
+		return MigrationReport{}, err
+	}
+
+	report := MigrationReport{From: stored, To: target, DryRun: dryRun}
+	if stored > target {
+		return report, fmt.Errorf("%w: db version %d, binary version %d", ErrNewerVersion, stored, target)
+	}
+
+	if stored == 0 {
+		if dryRun {
+			return report, nil
+		}
+		return report, fs.PutVersion(target)
+	}
+
+	pending := make([]Migration, 0, len(steps))
+	for _, step := range steps {
+		if step.Version > stored && step.Version <= target {
+			pending = append(pending, step)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Version < pending[j].Version
+	})
+
+	for i, step := range pending {
+		if dryRun {
+			report.Applied = append(report.Applied, step)
+			continue
+		}
+
+		log.Info("migrating fheos db", "step", i+1, "steps", len(pending), "version", step.Version, "description", step.Description)
+		if err := step.Migrate(fs); err != nil {
+			return report, fmt.Errorf("migration to version %d failed: %w", step.Version, err)
+		}
+
+		if err := fs.PutVersion(step.Version); err != nil {
+			return report, err
+		}
+		report.Applied = append(report.Applied, step)
+	}
+
+	if dryRun || stored == target {
+		return report, nil
+	}
+
+	return report, fs.PutVersion(target)
+}
@@ -1,21 +1,93 @@
 package storage
 
 import (
+	"errors"
+
 	"github.com/ethereum/go-ethereum/ethdb/memorydb"
 	"github.com/fhenixprotocol/fheos/precompiles/types"
+	"github.com/fhenixprotocol/fheos/storage/codec"
 )
 
 type IMultiStore interface {
 	types.FheCipherTextStorage
 }
 
+// txLayerPrefix namespaces the ciphertexts that MultiStore keeps in the tx-scoped memorydb, txAliasPrefix the
+// content hashes of the results resolved there, which are only turned into aliases on Commit, and txProvenancePrefix
+// the provenance records of the ciphertexts created there
+var (
+	txLayerPrefix      = []byte("fheos-ct-")
+	txAliasPrefix      = []byte("fheos-alias-")
+	txProvenancePrefix = []byte("fheos-prov-")
+)
+
+// ErrPlaceholderDiscarded is returned when the result of an async operation arrives after the tx that created its
+// placeholder was reverted (or was only a query), so there is nothing left to resolve
+var ErrPlaceholderDiscarded = errors.New("placeholder was discarded")
+
+// MultiStore is a two-layer ciphertext store. Writes go to the tx-scoped layer (the memorydb in TxParams.CiphertextDb)
+// and only reach the disk store on Commit, reads check the tx layer first and fall back to disk.
+// A MultiStore without a tx layer reads and writes directly to disk
 type MultiStore struct {
-	disk *FheosStorage
+	txLayer *memorydb.Database
+	disk    *FheosStorage
+}
+
+func txLayerKey(h types.Hash) []byte {
+	return append(append([]byte{}, txLayerPrefix...), h[:]...)
+}
+
+func txAliasKey(h types.Hash) []byte {
+	return append(append([]byte{}, txAliasPrefix...), h[:]...)
+}
+
+func txProvenanceKey(h types.Hash) []byte {
+	return append(append([]byte{}, txProvenancePrefix...), h[:]...)
+}
+
+func (ms *MultiStore) putTxLayer(h types.Hash, cipher *types.FheEncrypted) error {
+	val, err := codec.EncodeCt(cipher, codec.NoCompression)
+	if err != nil {
+		return err
+	}
+
+	ms.disk.instance.txLayer.RLock()
+	defer ms.disk.instance.txLayer.RUnlock()
+	return ms.txLayer.Put(txLayerKey(h), val)
+}
+
+func (ms *MultiStore) getTxLayer(h types.Hash) (*types.FheEncrypted, bool) {
+	if ms.txLayer == nil {
+		return nil, false
+	}
+
+	val, err := ms.txLayer.Get(txLayerKey(h))
+	if err != nil {
+		return nil, false
+	}
+
+	ct, err := codec.DecodeCt(val)
+	if err != nil {
+		return nil, false
+	}
+	return ct, true
+}
+
+func (ms *MultiStore) hasTxLayer(h types.Hash) bool {
+	if ms.txLayer == nil {
+		return false
+	}
+
+	has, err := ms.txLayer.Has(txLayerKey(h))
+	return err == nil && has
 }
 
 func (ms *MultiStore) PutCt(h types.Hash, cipher *types.FheEncrypted) error {
-	err := ms.disk.PutCt(h, cipher)
-	return err
+	if ms.txLayer == nil {
+		return ms.disk.PutCt(h, cipher)
+	}
+
+	return ms.putTxLayer(h, cipher)
 }
 
 func (ms *MultiStore) PutCtIfNotExist(h types.Hash, cipher *types.FheEncrypted) error {
@@ -27,19 +99,225 @@ func (ms *MultiStore) PutCtIfNotExist(h types.Hash, cipher *types.FheEncrypted)
 	return ms.PutCt(h, cipher)
 }
 
+// ResolvePlaceholder replaces the placeholder stored under h with the result of the async operation, whose content
+// hash (as computed by the engine) is content. The result is written to whichever layer holds the placeholder - if
+// the tx that created it was already committed that is the disk, and if it was discarded the result is dropped and
+// ErrPlaceholderDiscarded is returned
+func (ms *MultiStore) ResolvePlaceholder(h types.Hash, cipher *types.FheEncrypted, content types.Hash) error {
+	if ms.txLayer != nil {
+		val, err := codec.EncodeCt(cipher, codec.NoCompression)
+		if err != nil {
+			return err
+		}
+
+		// Hold the lock across the lookup and the write so the layer can't be committed in between
+		ms.disk.instance.txLayer.RLock()
+		defer ms.disk.instance.txLayer.RUnlock()
+		if ms.hasTxLayer(h) {
+			if content != (types.Hash{}) {
+				if err := ms.txLayer.Put(txAliasKey(h), content[:]); err != nil {
+					return err
+				}
+			}
+			return ms.txLayer.Put(txLayerKey(h), val)
+		}
+	}
+
+	if ms.disk.HasCt(h) {
+		return ms.disk.PutResolvedCt(h, cipher, content)
+	}
+
+	return ErrPlaceholderDiscarded
+}
+
 func (ms *MultiStore) GetCt(h types.Hash) (*types.FheEncrypted, error) {
+	if ct, ok := ms.getTxLayer(h); ok {
+		return ct, nil
+	}
+
 	return ms.disk.GetCt(h)
 }
+
 func (ms *MultiStore) Has(h types.Hash) bool {
-	return ms.disk.HasCt(h)
+	return ms.hasTxLayer(h) || ms.disk.HasCt(h)
 }
 
 func (ms *MultiStore) DeleteCt(h types.Hash) error {
+	if ms.hasTxLayer(h) {
+		ms.disk.instance.txLayer.RLock()
+		err := ms.txLayer.Delete(txLayerKey(h))
+		if err == nil {
+			err = ms.txLayer.Delete(txProvenanceKey(h))
+		}
+		ms.disk.instance.txLayer.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+
 	return ms.disk.DeleteCt(h)
 }
 
+// ZoneUsage is the usage of zone on disk plus that of the ciphertexts still pending in the tx layer, so that writes
+// of a tx are counted before it is committed
+func (ms *MultiStore) ZoneUsage(zone int32) (types.Usage, error) {
+	usage, err := ms.disk.ZoneUsage(zone)
+	if err != nil || ms.txLayer == nil {
+		return usage, err
+	}
+
+	ms.disk.instance.txLayer.RLock()
+	defer ms.disk.instance.txLayer.RUnlock()
+
+	it := ms.txLayer.NewIterator(txLayerPrefix, nil)
+	defer it.Release()
+
+	for it.Next() {
+		var h types.Hash
+		copy(h[:], it.Key()[len(txLayerPrefix):])
+		if int32(h[types.SecurityZoneByte]) != zone || ms.disk.HasCt(h) {
+			continue
+		}
+
+		ct, err := codec.DecodeCt(it.Value())
+		if err != nil {
+			return usage, err
+		}
+
+		usage.Count++
+		usage.Bytes += uint64(len(ct.Data))
+		if ct.Placeholder {
+			usage.Placeholders++
+		}
+	}
+
+	return usage, it.Error()
+}
+
+// PutProvenance records how the ciphertext h was produced. Like the ciphertext itself, the record only reaches the
+// disk store on Commit
+func (ms *MultiStore) PutProvenance(h types.Hash, p types.Provenance) error {
+	if ms.txLayer == nil {
+		return ms.disk.PutProvenance(h, p)
+	}
+
+	ms.disk.instance.txLayer.RLock()
+	defer ms.disk.instance.txLayer.RUnlock()
+	return ms.txLayer.Put(txProvenanceKey(h), encodeProvenance(p))
+}
+
+// Commit flushes every ciphertext (and provenance record) in the tx layer to the disk store, clears the layer and
+// returns the flushed hashes
+func (ms *MultiStore) Commit() ([]types.Hash, error) {
+	if ms.txLayer == nil {
+		return nil, nil
+	}
+
+	ms.disk.instance.txLayer.Lock()
+	defer ms.disk.instance.txLayer.Unlock()
+
+	it := ms.txLayer.NewIterator(txLayerPrefix, nil)
+	defer it.Release()
+
+	var committed []types.Hash
+	for it.Next() {
+		var h types.Hash
+		copy(h[:], it.Key()[len(txLayerPrefix):])
+
+		ct, err := codec.DecodeCt(it.Value())
+		if err != nil {
+			return committed, err
+		}
+
+		if err := ms.commitCt(h, ct); err != nil {
+			return committed, err
+		}
+
+		if err := ms.txLayer.Delete(it.Key()); err != nil {
+			return committed, err
+		}
+		committed = append(committed, h)
+	}
+	if err := it.Error(); err != nil {
+		return committed, err
+	}
+
+	return committed, ms.commitProvenance()
+}
+
+func (ms *MultiStore) commitProvenance() error {
+	it := ms.txLayer.NewIterator(txProvenancePrefix, nil)
+	defer it.Release()
+
+	for it.Next() {
+		var h types.Hash
+		copy(h[:], it.Key()[len(txProvenancePrefix):])
+
+		p, err := decodeProvenance(it.Value())
+		if err != nil {
+			return err
+		}
+		if err := ms.disk.PutProvenance(h, p); err != nil {
+			return err
+		}
+		if err := ms.txLayer.Delete(it.Key()); err != nil {
+			return err
+		}
+	}
+
+	return it.Error()
+}
+
+// commitCt writes a ciphertext of the tx layer to disk, as an alias if it is a result with a known content hash
+func (ms *MultiStore) commitCt(h types.Hash, ct *types.FheEncrypted) error {
+	val, err := ms.txLayer.Get(txAliasKey(h))
+	if err != nil || ct.Placeholder {
+		return ms.disk.PutCt(h, ct)
+	}
+
+	if err := ms.txLayer.Delete(txAliasKey(h)); err != nil {
+		return err
+	}
+
+	var content types.Hash
+	copy(content[:], val)
+	return ms.disk.PutResolvedCt(h, ct, content)
+}
+
+// Discard drops every ciphertext in the tx layer without writing anything to disk
+func (ms *MultiStore) Discard() error {
+	if ms.txLayer == nil {
+		return nil
+	}
+
+	ms.disk.instance.txLayer.Lock()
+	defer ms.disk.instance.txLayer.Unlock()
+
+	for _, prefix := range [][]byte{txLayerPrefix, txAliasPrefix, txProvenancePrefix} {
+		if err := ms.discardPrefix(prefix); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ms *MultiStore) discardPrefix(prefix []byte) error {
+	it := ms.txLayer.NewIterator(prefix, nil)
+	defer it.Release()
+
+	for it.Next() {
+		if err := ms.txLayer.Delete(it.Key()); err != nil {
+			return err
+		}
+	}
+
+	return it.Error()
+}
+
 func NewMultiStore(db *memorydb.Database, disk *FheosStorage) *MultiStore {
 	return &MultiStore{
-		disk: disk,
+		txLayer: db,
+		disk:    disk,
 	}
 }
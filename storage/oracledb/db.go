@@ -0,0 +1,133 @@
+// Package oracledb implements types.Storage for the replay binary that proves fheos execution. There is no disk there:
+// the ciphertexts stored before the replayed block are resolved through a preimage oracle, and everything written
+// while replaying it is kept in memory
+package oracledb
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+	"github.com/fhenixprotocol/fheos/storage/codec"
+	ephemeraldb "github.com/fhenixprotocol/fheos/storage/memorydb"
+)
+
+// Oracle resolves a ciphertext handle to its record (in the codec format), the way the preimage oracle of the replay
+// binary resolves a hash to its preimage
+type Oracle interface {
+	GetCiphertext(h types.Hash) ([]byte, error)
+}
+
+var (
+	ErrNotFound = errors.New("ciphertext not found")
+	// ErrOracleMismatch is returned when the oracle answers with the ciphertext of another handle
+	ErrOracleMismatch = errors.New("preimage oracle returned a ciphertext for another handle")
+)
+
+// Database reads through to the oracle for ciphertexts it doesn't hold. Ciphertexts resolved from the oracle are
+// kept, so each handle is requested at most once. Enumeration (IterateCts, IterateUsage, refcounts and namespaces)
+// only sees what is held in memory, since the oracle can't list its preimages
+type Database struct {
+	*ephemeraldb.Database
+	oracle Oracle
+
+	lock sync.Mutex
+	// deleted hides ciphertexts deleted during the replay, which the oracle would otherwise still serve
+	deleted map[types.Hash]struct{}
+}
+
+func New(oracle Oracle) *Database {
+	return &Database{
+		Database: ephemeraldb.New(),
+		oracle:   oracle,
+		deleted:  make(map[types.Hash]struct{}),
+	}
+}
+
+func (db *Database) isDeleted(h types.Hash) bool {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	_, ok := db.deleted[h]
+	return ok
+}
+
+// resolve requests h from the oracle and checks that the record is intact and belongs to h
+func (db *Database) resolve(h types.Hash) (*types.FheEncrypted, error) {
+	record, err := db.oracle.GetCiphertext(h)
+	if err != nil {
+		return nil, fmt.Errorf("ciphertext %x not available from the preimage oracle: %w", h[:], err)
+	}
+
+	ct, err := codec.DecodeCt(record)
+	if err != nil {
+		return nil, fmt.Errorf("ciphertext %x: %w", h[:], err)
+	}
+
+	if types.Hash(ct.Key.Hash) != h {
+		return nil, fmt.Errorf("%w: requested %x, got %x", ErrOracleMismatch, h[:], ct.Key.Hash[:])
+	}
+
+	return ct, nil
+}
+
+func (db *Database) PutCt(h types.Hash, cipher *types.FheEncrypted) error {
+	db.lock.Lock()
+	delete(db.deleted, h)
+	db.lock.Unlock()
+
+	return db.Database.PutCt(h, cipher)
+}
+
+func (db *Database) GetCt(h types.Hash) (*types.FheEncrypted, error) {
+	if ct, err := db.Database.GetCt(h); err == nil {
+		return ct, nil
+	}
+
+	if db.isDeleted(h) {
+		return nil, ErrNotFound
+	}
+
+	ct, err := db.resolve(h)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Database.PutCt(h, ct); err != nil {
+		return nil, err
+	}
+	return ct, nil
+}
+
+func (db *Database) HasCt(h types.Hash) bool {
+	_, err := db.GetCt(h)
+	return err == nil
+}
+
+func (db *Database) DeleteCt(h types.Hash) error {
+	db.lock.Lock()
+	db.deleted[h] = struct{}{}
+	db.lock.Unlock()
+
+	return db.Database.DeleteCt(h)
+}
+
+// LocalOracle serves the ciphertexts of a local store the way the preimage oracle would, so the replay storage can
+// be exercised natively, e.g. against a copy of a node's db
+type LocalOracle struct {
+	store types.FheCipherTextStorage
+}
+
+func NewLocalOracle(store types.FheCipherTextStorage) *LocalOracle {
+	return &LocalOracle{store: store}
+}
+
+func (o *LocalOracle) GetCiphertext(h types.Hash) ([]byte, error) {
+	ct, err := o.store.GetCt(h)
+	if err != nil {
+		return nil, err
+	}
+
+	return codec.EncodeCt(ct, codec.NoCompression)
+}
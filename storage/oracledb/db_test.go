@@ -0,0 +1,108 @@
+package oracledb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+	"github.com/fhenixprotocol/fheos/storage/codec"
+	ephemeraldb "github.com/fhenixprotocol/fheos/storage/memorydb"
+	"github.com/fhenixprotocol/warp-drive/fhe-driver"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingOracle simulates the preimage oracle of the replay binary on top of a local store, and counts the requests
+type countingOracle struct {
+	*LocalOracle
+	requests map[types.Hash]int
+	// records overrides what is served for a handle
+	records map[types.Hash][]byte
+}
+
+func newCountingOracle(store types.FheCipherTextStorage) *countingOracle {
+	return &countingOracle{
+		LocalOracle: NewLocalOracle(store),
+		requests:    map[types.Hash]int{},
+		records:     map[types.Hash][]byte{},
+	}
+}
+
+func (o *countingOracle) GetCiphertext(h types.Hash) ([]byte, error) {
+	o.requests[h]++
+	if record, ok := o.records[h]; ok {
+		return record, nil
+	}
+	return o.LocalOracle.GetCiphertext(h)
+}
+
+func storedCt(h types.Hash, data ...byte) *types.FheEncrypted {
+	ct := &types.FheEncrypted{Data: data, UintType: 2}
+	ct.Key.Hash = fhe.Hash(h)
+	return ct
+}
+
+func TestOracleStorage(t *testing.T) {
+	node := ephemeraldb.New()
+	stored := types.Hash{1}
+	assert.NoError(t, node.PutCt(stored, storedCt(stored, 1, 2, 3)))
+
+	oracle := newCountingOracle(node)
+	db := New(oracle)
+
+	t.Run("ResolvesFromOracleOnce", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			ct, err := db.GetCt(stored)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte{1, 2, 3}, ct.Data)
+		}
+		assert.Equal(t, 1, oracle.requests[stored])
+	})
+
+	t.Run("WritesStayLocal", func(t *testing.T) {
+		created := types.Hash{2}
+		assert.NoError(t, db.PutCt(created, storedCt(created, 4)))
+		assert.True(t, db.HasCt(created))
+		assert.Zero(t, oracle.requests[created])
+		assert.False(t, node.HasCt(created))
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		assert.False(t, db.HasCt(types.Hash{3}))
+		_, err := db.GetCt(types.Hash{3})
+		assert.Error(t, err)
+	})
+
+	t.Run("DeleteHidesOracle", func(t *testing.T) {
+		assert.NoError(t, db.DeleteCt(stored))
+		assert.False(t, db.HasCt(stored))
+		_, err := db.GetCt(stored)
+		assert.True(t, errors.Is(err, ErrNotFound))
+
+		// Writing it again brings it back
+		assert.NoError(t, db.PutCt(stored, storedCt(stored, 5)))
+		ct, err := db.GetCt(stored)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{5}, ct.Data)
+	})
+
+	t.Run("RejectsCorruptRecords", func(t *testing.T) {
+		h := types.Hash{4}
+		record, err := codec.EncodeCt(storedCt(h, 6, 7), codec.NoCompression)
+		assert.NoError(t, err)
+		record[len(record)-1] ^= 0xff
+		oracle.records[h] = record
+
+		_, err = db.GetCt(h)
+		assert.ErrorIs(t, err, codec.ErrCorruptRecord)
+	})
+
+	t.Run("RejectsOtherHandles", func(t *testing.T) {
+		h := types.Hash{5}
+		record, err := codec.EncodeCt(storedCt(types.Hash{6}, 8), codec.NoCompression)
+		assert.NoError(t, err)
+		oracle.records[h] = record
+
+		_, err = db.GetCt(h)
+		assert.ErrorIs(t, err, ErrOracleMismatch)
+	})
+}
@@ -0,0 +1,90 @@
+//go:build amd64 || arm64
+
+package pebble
+
+import (
+	"errors"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+)
+
+var errDeletedInBatch = errors.New("not found")
+
+// batchDb puts the writes made through it in a single ethdb batch. Reads see them, iterators don't
+type batchDb struct {
+	ethdb.Database
+	batch   ethdb.Batch
+	written map[string][]byte
+	deleted map[string]struct{}
+}
+
+func newBatchDb(db ethdb.Database) *batchDb {
+	return &batchDb{Database: db, batch: db.NewBatch(), written: map[string][]byte{}, deleted: map[string]struct{}{}}
+}
+
+func (b *batchDb) Has(key []byte) (bool, error) {
+	if _, ok := b.deleted[string(key)]; ok {
+		return false, nil
+	}
+	if _, ok := b.written[string(key)]; ok {
+		return true, nil
+	}
+	return b.Database.Has(key)
+}
+
+func (b *batchDb) Get(key []byte) ([]byte, error) {
+	if _, ok := b.deleted[string(key)]; ok {
+		return nil, errDeletedInBatch
+	}
+	if val, ok := b.written[string(key)]; ok {
+		return append([]byte{}, val...), nil
+	}
+	return b.Database.Get(key)
+}
+
+func (b *batchDb) Put(key []byte, val []byte) error {
+	delete(b.deleted, string(key))
+	b.written[string(key)] = append([]byte{}, val...)
+	return b.batch.Put(key, val)
+}
+
+func (b *batchDb) Delete(key []byte) error {
+	delete(b.written, string(key))
+	b.deleted[string(key)] = struct{}{}
+	return b.batch.Delete(key)
+}
+
+// invalidate drops the cached records the batch wrote, it must be called once the batch was written
+func (b *batchDb) invalidate(cache *ctCache) {
+	invalidate := func(key string) {
+		if len(key) != 1+len(types.Hash{}) {
+			return
+		}
+
+		var h types.Hash
+		copy(h[:], key[1:])
+		switch t := types.DataType(key[0]); t {
+		case types.NamespaceCiphertexts, types.NamespacePayloads:
+			cache.invalidate(t, h)
+		}
+	}
+
+	for key := range b.written {
+		invalidate(key)
+	}
+	for key := range b.deleted {
+		invalidate(key)
+	}
+}
+
+// Batch runs fn on a view of p whose writes go to a single pebble batch, which is written once fn returns nil
+func (p *EthDbWrapper) Batch(fn func(s types.Storage) error) error {
+	db := newBatchDb(p.db)
+	if err := fn(&EthDbWrapper{db: db, compression: p.compression}); err != nil {
+		return err
+	}
+
+	defer db.invalidate(p.cache)
+	return db.batch.Write()
+}
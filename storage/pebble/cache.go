@@ -0,0 +1,174 @@
+package pebble
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+)
+
+// ctCacheEntryOverhead approximates the memory used by a cache entry besides the ciphertext payload
+const ctCacheEntryOverhead = 128
+
+// ctCacheShards is the number of invalidation epochs, a write only keeps the reads of its own shard from being cached
+const ctCacheShards = 256
+
+// cacheKey keeps a shared payload and a ciphertext with the same hash apart
+type cacheKey struct {
+	namespace types.DataType
+	hash      types.Hash
+}
+
+type ctCacheEntry struct {
+	key  cacheKey
+	ct   types.FheEncrypted
+	size uint64
+}
+
+// ctCache is an LRU of decoded ciphertexts and shared payloads, bounded by the total size of the cached data, so that
+// hot ciphertexts aren't read and decoded from pebble on every operation.
+// Placeholders are never cached, since they are replaced as soon as the async operation finishes
+type ctCache struct {
+	lock     sync.Mutex
+	maxBytes uint64
+	size     uint64
+	lru      *list.List
+	entries  map[cacheKey]*list.Element
+	// epochs are bumped on every invalidation of a hash in their shard, so that a value read from disk before a
+	// concurrent write isn't cached
+	epochs [ctCacheShards]uint64
+}
+
+func ctCacheShard(h types.Hash) int {
+	return int(h[0]) % ctCacheShards
+}
+
+// newCtCache returns nil (no caching) if maxBytes is 0
+func newCtCache(maxBytes uint64) *ctCache {
+	if maxBytes == 0 {
+		return nil
+	}
+
+	return &ctCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[cacheKey]*list.Element),
+	}
+}
+
+func markCache(name string, count int64) {
+	if metrics.Enabled {
+		metrics.GetOrRegisterCounter("fheos/db/cache/"+name, nil).Inc(count)
+	}
+}
+
+func (c *ctCache) get(t types.DataType, h types.Hash) (*types.FheEncrypted, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.entries[cacheKey{t, h}]
+	if !ok {
+		markCache("miss", 1)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+	markCache("hit", 1)
+
+	// Callers get their own copy of the struct so they can't change the cached flags
+	ct := elem.Value.(*ctCacheEntry).ct
+	return &ct, true
+}
+
+// currentEpoch must be read before reading the value of h that is later passed to add
+func (c *ctCache) currentEpoch(h types.Hash) uint64 {
+	if c == nil {
+		return 0
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.epochs[ctCacheShard(h)]
+}
+
+func (c *ctCache) add(t types.DataType, h types.Hash, ct *types.FheEncrypted, epoch uint64) {
+	if c == nil || ct.Placeholder {
+		return
+	}
+
+	size := uint64(len(ct.Data)) + ctCacheEntryOverhead
+	if size > c.maxBytes {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if epoch != c.epochs[ctCacheShard(h)] {
+		return
+	}
+
+	key := cacheKey{t, h}
+	c.remove(key)
+	c.entries[key] = c.lru.PushFront(&ctCacheEntry{key: key, ct: *ct, size: size})
+	c.size += size
+
+	evicted := int64(0)
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back().Value.(*ctCacheEntry).key)
+		evicted++
+	}
+
+	if evicted > 0 {
+		markCache("evict", evicted)
+	}
+	if metrics.Enabled {
+		metrics.GetOrRegisterGauge("fheos/db/cache/size", nil).Update(int64(c.size))
+	}
+}
+
+func (c *ctCache) invalidate(t types.DataType, h types.Hash) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.epochs[ctCacheShard(h)]++
+	c.remove(cacheKey{t, h})
+}
+
+// clear drops every entry, for when keys were changed behind the cache's back
+func (c *ctCache) clear() {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for i := range c.epochs {
+		c.epochs[i]++
+	}
+	c.lru.Init()
+	c.entries = make(map[cacheKey]*list.Element)
+	c.size = 0
+}
+
+// remove must be called with the lock held
+func (c *ctCache) remove(key cacheKey) {
+	elem, ok := c.entries[key]
+	if !ok {
+		return
+	}
+
+	entry := c.lru.Remove(elem).(*ctCacheEntry)
+	delete(c.entries, key)
+	c.size -= entry.size
+}
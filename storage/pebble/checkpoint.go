@@ -0,0 +1,244 @@
+//go:build amd64 || arm64
+
+package pebble
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+)
+
+// manifestFile is written next to the pebble files of a checkpoint
+const manifestFile = "fheos-backup.json"
+
+var ErrManifestMismatch = errors.New("backup does not match its manifest")
+
+type manifestBuilder struct {
+	entries map[string]uint64
+	keys    hash.Hash
+}
+
+func newManifestBuilder() *manifestBuilder {
+	return &manifestBuilder{entries: map[string]uint64{}, keys: sha256.New()}
+}
+
+func (b *manifestBuilder) add(key []byte) {
+	namespace := "none"
+	if len(key) > 0 {
+		namespace = types.DataType(key[0]).String()
+	}
+	b.entries[namespace]++
+
+	// Length prefixed, so that different key sets can't hash the same
+	b.keys.Write(binary.BigEndian.AppendUint32(nil, uint32(len(key))))
+	b.keys.Write(key)
+}
+
+func (b *manifestBuilder) manifest(version uint64, createdAt time.Time) types.BackupManifest {
+	return types.BackupManifest{
+		Version:   version,
+		CreatedAt: createdAt,
+		Entries:   b.entries,
+		KeysHash:  hex.EncodeToString(b.keys.Sum(nil)),
+	}
+}
+
+// copyAll copies every key of src into dst. A single iterator reads them, which sees a consistent snapshot of src
+// even while it is being written to
+func copyAll(src ethdb.Iteratee, dst ethdb.Batcher) (*manifestBuilder, error) {
+	it := src.NewIterator(nil, nil)
+	defer it.Release()
+
+	b := newManifestBuilder()
+	batch := dst.NewBatch()
+	for it.Next() {
+		if err := batch.Put(it.Key(), it.Value()); err != nil {
+			return nil, err
+		}
+		b.add(it.Key())
+
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return nil, err
+			}
+			batch.Reset()
+		}
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+
+	return b, batch.Write()
+}
+
+// verify checks that db holds exactly the keys and version described by manifest
+func verify(db ethdb.Database, manifest types.BackupManifest) error {
+	it := db.NewIterator(nil, nil)
+	defer it.Release()
+
+	b := newManifestBuilder()
+	for it.Next() {
+		b.add(it.Key())
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+
+	return matchManifest(db, b, manifest)
+}
+
+// matchManifest checks that the keys added to b, and the version in db, are the ones described by manifest
+func matchManifest(db ethdb.Database, b *manifestBuilder, manifest types.BackupManifest) error {
+	version, err := (&EthDbWrapper{db: db}).GetVersion()
+	if err != nil {
+		return err
+	}
+
+	found := b.manifest(version, manifest.CreatedAt)
+	if found.Version != manifest.Version {
+		return fmt.Errorf("%w: version %d, manifest says %d", ErrManifestMismatch, found.Version, manifest.Version)
+	}
+	for namespace, count := range manifest.Entries {
+		if found.Entries[namespace] != count {
+			return fmt.Errorf("%w: %d %s keys, manifest says %d", ErrManifestMismatch, found.Entries[namespace], namespace, count)
+		}
+	}
+	if len(found.Entries) != len(manifest.Entries) || found.KeysHash != manifest.KeysHash {
+		return fmt.Errorf("%w: keys differ", ErrManifestMismatch)
+	}
+
+	return nil
+}
+
+// isEmptyDir returns true if dir doesn't exist or has no entries
+func isEmptyDir(dir string) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	}
+	return len(entries) == 0, err
+}
+
+// clearDir removes everything in dir, so that the partial output of a failed checkpoint or restore doesn't keep it
+// from being retried
+func clearDir(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			log.Warn("failed to remove partial output", "path", filepath.Join(dir, entry.Name()), "err", err)
+		}
+	}
+}
+
+// Checkpoint writes a consistent copy of the db, along with its manifest, to dir, which must be empty. The db keeps
+// serving reads and writes while the checkpoint is taken. If it fails dir is left empty
+func (p *EthDbWrapper) Checkpoint(dir string) (manifest types.BackupManifest, err error) {
+	empty, err := isEmptyDir(dir)
+	if err != nil {
+		return types.BackupManifest{}, err
+	}
+	if !empty {
+		return types.BackupManifest{}, fmt.Errorf("backup directory %s must be empty", dir)
+	}
+
+	// Registered before the db is opened, so that it runs after the db is closed
+	defer func() {
+		if err != nil {
+			clearDir(dir)
+		}
+	}()
+
+	dst, err := rawdb.NewPebbleDBDatabase(dir, 128, 128, "fheos", false, false, nil)
+	if err != nil {
+		return types.BackupManifest{}, fmt.Errorf("failed to create checkpoint at %s: %w", dir, err)
+	}
+	defer dst.Close()
+
+	b, err := copyAll(p.db, dst)
+	if err != nil {
+		return types.BackupManifest{}, err
+	}
+
+	version, err := (&EthDbWrapper{db: dst}).GetVersion()
+	if err != nil {
+		return types.BackupManifest{}, err
+	}
+
+	manifest = b.manifest(version, time.Now())
+	val, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+
+	return manifest, os.WriteFile(filepath.Join(dir, manifestFile), val, 0o644)
+}
+
+// Restore verifies the checkpoint in dir against its manifest, lets check refuse it, and copies it into a new db at
+// path. path must not hold a db already, and is left empty if the restore fails
+func Restore(dir string, path string, check func(manifest types.BackupManifest) error) (manifest types.BackupManifest, err error) {
+	val, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return types.BackupManifest{}, fmt.Errorf("failed to read backup manifest: %w", err)
+	}
+
+	if err := json.Unmarshal(val, &manifest); err != nil {
+		return manifest, fmt.Errorf("invalid backup manifest: %w", err)
+	}
+
+	if err := check(manifest); err != nil {
+		return manifest, err
+	}
+
+	empty, err := isEmptyDir(path)
+	if err != nil {
+		return manifest, err
+	}
+	if !empty {
+		return manifest, fmt.Errorf("refusing to restore over the existing db at %s", path)
+	}
+
+	// Registered before the db is opened, so that it runs after the db is closed
+	defer func() {
+		if err != nil {
+			clearDir(path)
+		}
+	}()
+
+	src, err := rawdb.NewPebbleDBDatabase(dir, 128, 128, "fheos", true, false, nil)
+	if err != nil {
+		return manifest, fmt.Errorf("failed to open backup at %s: %w", dir, err)
+	}
+	defer src.Close()
+
+	dst, err := rawdb.NewPebbleDBDatabase(path, 128, 128, "fheos", false, false, nil)
+	if err != nil {
+		return manifest, fmt.Errorf("failed to create db at %s: %w", path, err)
+	}
+	defer dst.Close()
+
+	// The backup is checked against its manifest as it is copied, and the copy once it is written
+	b, err := copyAll(src, dst)
+	if err != nil {
+		return manifest, err
+	}
+	if err := matchManifest(dst, b, manifest); err != nil {
+		return manifest, err
+	}
+
+	return manifest, verify(dst, manifest)
+}
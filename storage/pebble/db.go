@@ -5,37 +5,63 @@ package pebble
 import (
 	"bytes"
 	"encoding/gob"
-	"log"
-	"sync"
+	"errors"
+	"fmt"
+	"time"
 
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/fhenixprotocol/fheos/precompiles/types"
-)
-
-var (
-	instance *EthDbWrapper
-	once     sync.Once
+	"github.com/fhenixprotocol/fheos/storage/codec"
+	"github.com/fhenixprotocol/fheos/storage/index"
 )
 
 type EthDbWrapper struct {
 	types.Storage
-	db ethdb.Database
+	db          ethdb.Database
+	compression codec.Compression
+	cache       *ctCache
 }
 
-// NewStorage ensures a single EthDbWrapper instance
-func NewStorage(path string) (*EthDbWrapper, error) {
-	once.Do(func() {
-		db, err := rawdb.NewPebbleDBDatabase(path, 128, 128, "fheos", false, false, nil)
-		if err != nil {
-			log.Fatalf("Error creating PebbleDBDatabase: %v", err)
-		}
-		instance = &EthDbWrapper{db: db}
-	})
-	return instance, nil
+type Options struct {
+	// Compression is applied to ciphertexts written from now on, existing records are read with whatever they were written with
+	Compression codec.Compression
+	// CacheSize is the number of bytes of decoded ciphertexts kept in memory, 0 disables the cache
+	CacheSize uint64
+}
+
+// NewStorage opens the pebble db at path. Every call opens an independent instance, which must be closed when done
+func NewStorage(path string, opts Options) (*EthDbWrapper, error) {
+	db, err := rawdb.NewPebbleDBDatabase(path, 128, 128, "fheos", false, false, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pebble db at %s: %w", path, err)
+	}
+
+	return &EthDbWrapper{db: db, compression: opts.Compression, cache: newCtCache(opts.CacheSize)}, nil
+}
+
+func (p *EthDbWrapper) Close() error {
+	p.cache.clear()
+	return p.db.Close()
 }
+
+// GetVersion returns 0 if no version was ever written, i.e. the db is new
 func (p *EthDbWrapper) GetVersion() (uint64, error) {
-	key := []byte("version")
+	key := namespacedKey(types.NamespaceMetadata, versionKey)
+	has, err := p.db.Has(key)
+	if err != nil {
+		return 0, err
+	}
+
+	// The version of a db that still uses the flat layout is read from there, so it can be migrated
+	if !has {
+		key = legacyVersionKey
+		if has, err = p.db.Has(key); err != nil || !has {
+			return 0, err
+		}
+	}
+
 	val, err := p.db.Get(key)
 	if err != nil {
 		return 0, err
@@ -53,29 +79,32 @@ func (p *EthDbWrapper) GetVersion() (uint64, error) {
 }
 
 func (p *EthDbWrapper) PutVersion(v uint64) error {
-	key := []byte("version")
 	var buf bytes.Buffer
 	err := gob.NewEncoder(&buf).Encode(v)
 	if err != nil {
 		return err
 	}
-	return p.db.Put(key, buf.Bytes())
+	return p.Put(types.NamespaceMetadata, versionKey, buf.Bytes())
 }
 
 func (p *EthDbWrapper) PutCt(h types.Hash, cipher *types.FheEncrypted) error {
 	// Serialize Ciphertext
-	var buf bytes.Buffer
-	err := gob.NewEncoder(&buf).Encode(cipher)
+	val, err := codec.EncodeCt(cipher, p.compression)
 	if err != nil {
 		return err
 	}
 
 	// Use hash as key
-	return p.db.Put(h[:], buf.Bytes())
+	defer p.cache.invalidate(types.NamespaceCiphertexts, h)
+	if err := p.db.Put(ctKey(h), val); err != nil {
+		return err
+	}
+
+	return index.Put(p, h, cipher.Placeholder, uint64(len(cipher.Data)), time.Now())
 }
 
 func (p *EthDbWrapper) HasCt(h types.Hash) bool {
-	isPresent, err := p.db.Has(h[:])
+	isPresent, err := p.db.Has(ctKey(h))
 	if err != nil {
 		return false
 	}
@@ -84,20 +113,109 @@ func (p *EthDbWrapper) HasCt(h types.Hash) bool {
 }
 
 func (p *EthDbWrapper) GetCt(h types.Hash) (*types.FheEncrypted, error) {
-	val, err := p.db.Get(h[:])
+	return p.getCached(types.NamespaceCiphertexts, h, "ciphertext")
+}
+
+// getCached reads the record of h in namespace t, which is a ciphertext or a shared payload, through the cache
+func (p *EthDbWrapper) getCached(t types.DataType, h types.Hash, what string) (*types.FheEncrypted, error) {
+	if ct, ok := p.cache.get(t, h); ok {
+		return ct, nil
+	}
+
+	epoch := p.cache.currentEpoch(h)
+	val, err := p.db.Get(namespacedKey(t, h[:]))
 	if err != nil {
 		return nil, err
 	}
 
-	var cipher types.FheEncrypted
-	err = gob.NewDecoder(bytes.NewBuffer(val)).Decode(&cipher)
+	ct, err := codec.DecodeCt(val)
 	if err != nil {
-		return nil, err
+		if errors.Is(err, codec.ErrCorruptRecord) && metrics.Enabled {
+			metrics.GetOrRegisterCounter("fheos/db/get/corrupt", nil).Inc(1)
+		}
+		return nil, fmt.Errorf("%s %x: %w", what, h[:], err)
 	}
 
-	return &cipher, nil
+	p.cache.add(t, h, ct, epoch)
+	return ct, nil
 }
 
 func (p *EthDbWrapper) DeleteCt(h types.Hash) error {
-	return p.db.Delete(h[:])
+	defer p.cache.invalidate(types.NamespaceCiphertexts, h)
+	if err := p.db.Delete(ctKey(h)); err != nil {
+		return err
+	}
+
+	return index.Delete(p, h)
+}
+
+// PutPayload stores a shared payload. Payloads aren't ciphertexts of their own, so they aren't indexed
+func (p *EthDbWrapper) PutPayload(h types.Hash, cipher *types.FheEncrypted) error {
+	val, err := codec.EncodeCt(cipher, p.compression)
+	if err != nil {
+		return err
+	}
+
+	defer p.cache.invalidate(types.NamespacePayloads, h)
+	return p.db.Put(payloadKey(h), val)
+}
+
+func (p *EthDbWrapper) GetPayload(h types.Hash) (*types.FheEncrypted, error) {
+	return p.getCached(types.NamespacePayloads, h, "payload")
+}
+
+func (p *EthDbWrapper) HasPayload(h types.Hash) bool {
+	isPresent, err := p.db.Has(payloadKey(h))
+	return err == nil && isPresent
+}
+
+func (p *EthDbWrapper) DeletePayload(h types.Hash) error {
+	defer p.cache.invalidate(types.NamespacePayloads, h)
+	return p.db.Delete(payloadKey(h))
+}
+
+func (p *EthDbWrapper) IterateCts(filter types.CtFilter, fn func(m types.CtMetadata) bool) error {
+	return index.Iterate(p, filter, fn)
+}
+
+func (p *EthDbWrapper) IterateUsage(fn func(u types.Usage) bool) error {
+	return index.IterateUsage(p, fn)
+}
+
+func (p *EthDbWrapper) GetRefCount(h types.Hash) (types.RefCount, error) {
+	val, err := p.db.Get(refCountKey(h))
+	if err != nil {
+		return types.RefCount{}, err
+	}
+
+	return codec.DecodeRefCount(val)
+}
+
+func (p *EthDbWrapper) PutRefCount(h types.Hash, rc types.RefCount) error {
+	return p.db.Put(refCountKey(h), codec.EncodeRefCount(rc))
+}
+
+func (p *EthDbWrapper) DeleteRefCount(h types.Hash) error {
+	return p.db.Delete(refCountKey(h))
+}
+
+func (p *EthDbWrapper) IterateRefCounts(fn func(h types.Hash, rc types.RefCount) bool) error {
+	var decodeErr error
+	err := p.IteratePrefix(types.NamespaceMetadata, refCountPrefix, func(key []byte, val []byte) bool {
+		var h types.Hash
+		copy(h[:], key[len(refCountPrefix):])
+
+		rc, err := codec.DecodeRefCount(val)
+		if err != nil {
+			decodeErr = err
+			return false
+		}
+
+		return fn(h, rc)
+	})
+	if err != nil {
+		return err
+	}
+
+	return decodeErr
 }
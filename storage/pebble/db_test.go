@@ -0,0 +1,256 @@
+//go:build amd64 || arm64
+
+package pebble
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+	"github.com/fhenixprotocol/fheos/storage/codec"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrateFlatLayout(t *testing.T) {
+	store := &EthDbWrapper{db: rawdb.NewMemoryDatabase()}
+
+	// Write a db the way it looked before namespaces
+	ct := &types.FheEncrypted{Data: []byte{1, 2, 3}}
+	hash := types.Hash{0x02, 0xaa}
+	record, err := codec.EncodeCt(ct, codec.NoCompression)
+	assert.NoError(t, err)
+	assert.NoError(t, store.db.Put(hash[:], record))
+	assert.NoError(t, store.db.Put(append([]byte("refcount-"), hash[:]...), make([]byte, 16)))
+
+	var version bytes.Buffer
+	assert.NoError(t, gob.NewEncoder(&version).Encode(uint64(1001)))
+	assert.NoError(t, store.db.Put([]byte("version"), version.Bytes()))
+
+	v, err := store.GetVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1001), v, "version should be readable before migrating")
+	assert.False(t, store.HasCt(hash))
+
+	moved, err := store.MigrateFlatLayout()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, moved)
+
+	migrated, err := store.GetCt(hash)
+	assert.NoError(t, err)
+	assert.Equal(t, ct.Data, migrated.Data)
+
+	_, err = store.GetRefCount(hash)
+	assert.NoError(t, err)
+
+	v, err = store.GetVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1001), v)
+
+	has, _ := store.db.Has(hash[:])
+	assert.False(t, has, "legacy key should be deleted")
+
+	// Rerunning the migration is a no-op
+	moved, err = store.MigrateFlatLayout()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, moved)
+}
+
+func TestIteratePrefix(t *testing.T) {
+	store := &EthDbWrapper{db: rawdb.NewMemoryDatabase()}
+
+	assert.NoError(t, store.Put(types.NamespaceIndexes, []byte("a/1"), []byte{1}))
+	assert.NoError(t, store.Put(types.NamespaceIndexes, []byte("a/2"), []byte{2}))
+	assert.NoError(t, store.Put(types.NamespaceIndexes, []byte("b/1"), []byte{3}))
+	assert.NoError(t, store.Put(types.NamespaceJournal, []byte("a/3"), []byte{4}))
+
+	var keys []string
+	err := store.IteratePrefix(types.NamespaceIndexes, []byte("a/"), func(key []byte, val []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a/1", "a/2"}, keys)
+}
+
+func TestCheckpoint(t *testing.T) {
+	store := &EthDbWrapper{db: rawdb.NewMemoryDatabase()}
+	assert.NoError(t, store.PutVersion(1004))
+	for i := byte(0); i < 3; i++ {
+		assert.NoError(t, store.PutCt(types.Hash{i}, &types.FheEncrypted{Data: []byte{i}}))
+	}
+
+	backup := rawdb.NewMemoryDatabase()
+	b, err := copyAll(store.db, backup)
+	assert.NoError(t, err)
+
+	manifest := b.manifest(1004, time.Now())
+	assert.Equal(t, uint64(3), manifest.Entries[types.NamespaceCiphertexts.String()])
+	assert.NoError(t, verify(backup, manifest))
+
+	// Writes after the copy don't show up in it
+	assert.NoError(t, store.PutCt(types.Hash{9}, &types.FheEncrypted{Data: []byte{9}}))
+	assert.ErrorIs(t, verify(store.db, manifest), ErrManifestMismatch)
+
+	assert.NoError(t, backup.Delete(ctKey(types.Hash{1})))
+	assert.ErrorIs(t, verify(backup, manifest), ErrManifestMismatch)
+
+	t.Run("RefusesNonEmptyDir", func(t *testing.T) {
+		dir := t.TempDir()
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "data"), nil, 0o644))
+		_, err := store.Checkpoint(dir)
+		assert.Error(t, err)
+	})
+
+	t.Run("RestoreChecksManifestFirst", func(t *testing.T) {
+		dir := t.TempDir()
+		val, err := json.Marshal(manifest)
+		assert.NoError(t, err)
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, manifestFile), val, 0o644))
+
+		refused := errors.New("refused")
+		_, err = Restore(dir, t.TempDir(), func(m types.BackupManifest) error {
+			assert.Equal(t, manifest.KeysHash, m.KeysHash)
+			return refused
+		})
+		assert.ErrorIs(t, err, refused)
+	})
+}
+
+// failingDb fails every iteration after the first key, like a db that breaks halfway through a copy
+type failingDb struct {
+	ethdb.Database
+}
+
+type failingIterator struct {
+	ethdb.Iterator
+	err error
+}
+
+func (it *failingIterator) Next() bool {
+	if it.err != nil || !it.Iterator.Next() {
+		return false
+	}
+	it.err = errors.New("read failed")
+	return true
+}
+
+func (it *failingIterator) Error() error {
+	return it.err
+}
+
+func (db failingDb) NewIterator(prefix []byte, start []byte) ethdb.Iterator {
+	return &failingIterator{Iterator: db.Database.NewIterator(prefix, start)}
+}
+
+func TestCheckpointCleanup(t *testing.T) {
+	store := &EthDbWrapper{db: rawdb.NewMemoryDatabase()}
+	assert.NoError(t, store.PutVersion(1004))
+	for i := byte(0); i < 3; i++ {
+		assert.NoError(t, store.PutCt(types.Hash{i}, &types.FheEncrypted{Data: []byte{i}}))
+	}
+
+	// A failed checkpoint leaves nothing behind, so it can be taken again in the same dir
+	dir := t.TempDir()
+	_, err := (&EthDbWrapper{db: failingDb{store.db}}).Checkpoint(dir)
+	assert.Error(t, err)
+	empty, err := isEmptyDir(dir)
+	assert.NoError(t, err)
+	assert.True(t, empty)
+
+	_, err = store.Checkpoint(dir)
+	assert.NoError(t, err)
+
+	// Same for a restore that fails after the new db was created
+	path := t.TempDir()
+	val, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	assert.NoError(t, err)
+	var manifest types.BackupManifest
+	assert.NoError(t, json.Unmarshal(val, &manifest))
+	manifest.KeysHash = "tampered"
+	tampered, err := json.Marshal(manifest)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, manifestFile), tampered, 0o644))
+
+	_, err = Restore(dir, path, func(types.BackupManifest) error { return nil })
+	assert.ErrorIs(t, err, ErrManifestMismatch)
+	empty, err = isEmptyDir(path)
+	assert.NoError(t, err)
+	assert.True(t, empty)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, manifestFile), val, 0o644))
+	restored, err := Restore(dir, path, func(types.BackupManifest) error { return nil })
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), restored.Entries[types.NamespaceCiphertexts.String()])
+}
+
+func TestCtCacheInvalidation(t *testing.T) {
+	cache := newCtCache(1 << 20)
+	ct := &types.FheEncrypted{Data: []byte{1, 2, 3}}
+	read, written := types.Hash{1}, types.Hash{2}
+
+	// A write to another hash doesn't keep a concurrent read from being cached
+	epoch := cache.currentEpoch(read)
+	cache.invalidate(types.NamespaceCiphertexts, written)
+	cache.add(types.NamespaceCiphertexts, read, ct, epoch)
+	_, ok := cache.get(types.NamespaceCiphertexts, read)
+	assert.True(t, ok)
+
+	// A write to the hash itself does
+	epoch = cache.currentEpoch(written)
+	cache.invalidate(types.NamespaceCiphertexts, written)
+	cache.add(types.NamespaceCiphertexts, written, ct, epoch)
+	_, ok = cache.get(types.NamespaceCiphertexts, written)
+	assert.False(t, ok)
+
+	// Clearing the cache invalidates every read in flight
+	epoch = cache.currentEpoch(written)
+	cache.clear()
+	cache.add(types.NamespaceCiphertexts, written, ct, epoch)
+	_, ok = cache.get(types.NamespaceCiphertexts, written)
+	assert.False(t, ok)
+}
+
+func TestBatch(t *testing.T) {
+	store := &EthDbWrapper{db: rawdb.NewMemoryDatabase(), cache: newCtCache(1 << 20)}
+	ct := &types.FheEncrypted{Data: []byte{1, 2, 3}}
+	written, deleted := types.Hash{1}, types.Hash{2}
+	assert.NoError(t, store.PutCt(deleted, ct))
+	_, err := store.GetCt(deleted)
+	assert.NoError(t, err)
+
+	// Nothing is written if fn fails
+	failed := errors.New("failed")
+	err = store.Batch(func(s types.Storage) error {
+		assert.NoError(t, s.PutCt(written, ct))
+		assert.True(t, s.HasCt(written), "the batch should see its own writes")
+		return failed
+	})
+	assert.ErrorIs(t, err, failed)
+	assert.False(t, store.HasCt(written))
+
+	assert.NoError(t, store.Batch(func(s types.Storage) error {
+		if err := s.(types.PayloadStorage).PutPayload(written, ct); err != nil {
+			return err
+		}
+		if err := s.DeleteCt(deleted); err != nil {
+			return err
+		}
+
+		assert.True(t, store.HasCt(deleted), "writes should be held back until fn returns")
+		return nil
+	}))
+
+	payload, err := store.GetPayload(written)
+	assert.NoError(t, err)
+	assert.Equal(t, ct.Data, payload.Data)
+	_, err = store.GetCt(deleted)
+	assert.Error(t, err, "the cached record should be dropped once the batch is written")
+}
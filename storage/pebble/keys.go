@@ -0,0 +1,117 @@
+//go:build amd64 || arm64
+
+package pebble
+
+import (
+	"bytes"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+)
+
+// Every key is prefixed with the byte of its namespace (types.DataType):
+//
+//	ciphertexts:        NamespaceCiphertexts | hash
+//	shared payloads:    NamespacePayloads    | content hash
+//	version:            NamespaceMetadata    | "version"
+//	reference counts:   NamespaceMetadata    | "refcount/" | hash
+var (
+	versionKey     = []byte("version")
+	refCountPrefix = []byte("refcount/")
+)
+
+// Keys of the flat layout used before namespaces were introduced
+var (
+	legacyVersionKey     = []byte("version")
+	legacyRefCountPrefix = []byte("refcount-")
+)
+
+func namespacedKey(t types.DataType, key []byte) []byte {
+	return append([]byte{byte(t)}, key...)
+}
+
+func ctKey(h types.Hash) []byte {
+	return namespacedKey(types.NamespaceCiphertexts, h[:])
+}
+
+func payloadKey(h types.Hash) []byte {
+	return namespacedKey(types.NamespacePayloads, h[:])
+}
+
+func refCountKey(h types.Hash) []byte {
+	return namespacedKey(types.NamespaceMetadata, append(append([]byte{}, refCountPrefix...), h[:]...))
+}
+
+func (p *EthDbWrapper) Put(t types.DataType, key []byte, val []byte) error {
+	return p.db.Put(namespacedKey(t, key), val)
+}
+
+func (p *EthDbWrapper) Get(t types.DataType, key []byte) ([]byte, error) {
+	return p.db.Get(namespacedKey(t, key))
+}
+
+func (p *EthDbWrapper) Delete(t types.DataType, key []byte) error {
+	return p.db.Delete(namespacedKey(t, key))
+}
+
+func (p *EthDbWrapper) IteratePrefix(t types.DataType, prefix []byte, fn func(key []byte, val []byte) bool) error {
+	it := p.db.NewIterator(namespacedKey(t, prefix), nil)
+	defer it.Release()
+
+	for it.Next() {
+		if !fn(it.Key()[1:], it.Value()) {
+			break
+		}
+	}
+
+	return it.Error()
+}
+
+// legacyKey maps a key of the flat layout to its namespaced key, or returns nil if key isn't a legacy key
+func legacyKey(key []byte) []byte {
+	switch {
+	case len(key) == len(types.Hash{}):
+		return namespacedKey(types.NamespaceCiphertexts, key)
+	case bytes.Equal(key, legacyVersionKey):
+		return namespacedKey(types.NamespaceMetadata, versionKey)
+	case len(key) == len(legacyRefCountPrefix)+len(types.Hash{}) && bytes.HasPrefix(key, legacyRefCountPrefix):
+		return namespacedKey(types.NamespaceMetadata, append(append([]byte{}, refCountPrefix...), key[len(legacyRefCountPrefix):]...))
+	default:
+		return nil
+	}
+}
+
+// MigrateFlatLayout moves every key of the flat layout (raw hashes, "version" and "refcount-") into its namespace.
+// Each key is moved in its own batch, so the migration can be interrupted and rerun
+func (p *EthDbWrapper) MigrateFlatLayout() (int, error) {
+	it := p.db.NewIterator(nil, nil)
+	defer it.Release()
+
+	moved := 0
+	for it.Next() {
+		newKey := legacyKey(it.Key())
+		if newKey == nil {
+			continue
+		}
+
+		batch := p.db.NewBatch()
+		if err := moveKey(batch, it.Key(), newKey, it.Value()); err != nil {
+			return moved, err
+		}
+		if err := batch.Write(); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+
+	p.cache.clear()
+	return moved, it.Error()
+}
+
+func moveKey(batch ethdb.Batch, oldKey []byte, newKey []byte, val []byte) error {
+	if err := batch.Put(newKey, val); err != nil {
+		return err
+	}
+
+	return batch.Delete(oldKey)
+}
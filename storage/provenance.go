@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+)
+
+// Every ciphertext written by an operation has a provenance record, kept for as long as the ciphertext itself:
+//
+//	NamespaceMetadata | "provenance/" | hash  ->  operation (8) | block (8) | created at (8) | contract (20) | tx hash (32) | inputs (32 each)
+var provenancePrefix = []byte("provenance/")
+
+const provenanceHeaderSize = 8 + 8 + 8 + 20 + 32
+
+var ErrNoProvenance = errors.New("ciphertext has no provenance record")
+
+func provenanceKey(h types.Hash) []byte {
+	return append(append([]byte{}, provenancePrefix...), h[:]...)
+}
+
+func encodeProvenance(p types.Provenance) []byte {
+	val := make([]byte, provenanceHeaderSize, provenanceHeaderSize+len(p.Inputs)*len(types.Hash{}))
+	binary.BigEndian.PutUint64(val[0:8], uint64(p.Operation))
+	binary.BigEndian.PutUint64(val[8:16], p.BlockNumber)
+	binary.BigEndian.PutUint64(val[16:24], uint64(p.CreatedAt.UnixNano()))
+	copy(val[24:44], p.Contract[:])
+	copy(val[44:76], p.TxHash[:])
+	for _, input := range p.Inputs {
+		val = append(val, input[:]...)
+	}
+	return val
+}
+
+func decodeProvenance(val []byte) (types.Provenance, error) {
+	var p types.Provenance
+	hashSize := len(types.Hash{})
+	if len(val) < provenanceHeaderSize || (len(val)-provenanceHeaderSize)%hashSize != 0 {
+		return p, errors.New("invalid provenance record")
+	}
+
+	p.Operation = types.PrecompileName(binary.BigEndian.Uint64(val[0:8]))
+	p.BlockNumber = binary.BigEndian.Uint64(val[8:16])
+	p.CreatedAt = time.Unix(0, int64(binary.BigEndian.Uint64(val[16:24])))
+	copy(p.Contract[:], val[24:44])
+	copy(p.TxHash[:], val[44:76])
+	for i := provenanceHeaderSize; i < len(val); i += hashSize {
+		var input types.Hash
+		copy(input[:], val[i:i+hashSize])
+		p.Inputs = append(p.Inputs, input)
+	}
+	return p, nil
+}
+
+func (fs *FheosStorage) PutProvenance(h types.Hash, p types.Provenance) error {
+	return fs.diskStore.Put(types.NamespaceMetadata, provenanceKey(h), encodeProvenance(p))
+}
+
+// GetProvenance returns the provenance record of h, or ErrNoProvenance if it has none
+func (fs *FheosStorage) GetProvenance(h types.Hash) (types.Provenance, error) {
+	val, err := fs.diskStore.Get(types.NamespaceMetadata, provenanceKey(h))
+	if err != nil || val == nil {
+		return types.Provenance{}, ErrNoProvenance
+	}
+
+	return decodeProvenance(val)
+}
+
+func (fs *FheosStorage) deleteProvenance(h types.Hash) error {
+	return fs.diskStore.Delete(types.NamespaceMetadata, provenanceKey(h))
+}
+
+// LineageNode is a ciphertext in the ancestry of a handle. Provenance is nil for ciphertexts without a record
+// (inputs created before provenance was recorded, or already deleted), which end their branch of the graph
+type LineageNode struct {
+	Hash       types.Hash
+	Depth      int
+	Provenance *types.Provenance
+}
+
+// Lineage is the ancestry graph of Root. Inputs can be shared by several ciphertexts, so it is a DAG and every
+// ciphertext appears once, at the depth it was first reached at
+type Lineage struct {
+	Root  types.Hash
+	Nodes []LineageNode
+	// Truncated is set when some inputs were left out because they are deeper than the requested depth, or because
+	// the graph has more nodes than were asked for
+	Truncated bool
+}
+
+// Lineage walks the provenance records from h up to maxDepth operations back (0 only returns h itself), and returns
+// at most maxNodes ciphertexts (no limit if it is 0)
+func (fs *FheosStorage) Lineage(h types.Hash, maxDepth int, maxNodes int) (Lineage, error) {
+	lineage := Lineage{Root: h}
+	seen := map[types.Hash]bool{h: true}
+	queue := []LineageNode{{Hash: h}}
+
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+
+		p, err := fs.GetProvenance(node.Hash)
+		if err == nil {
+			node.Provenance = &p
+		} else if !errors.Is(err, ErrNoProvenance) {
+			return lineage, err
+		}
+		lineage.Nodes = append(lineage.Nodes, node)
+
+		if node.Provenance == nil {
+			continue
+		}
+
+		for _, input := range node.Provenance.Inputs {
+			if seen[input] {
+				continue
+			}
+			if node.Depth >= maxDepth || (maxNodes > 0 && len(seen) >= maxNodes) {
+				lineage.Truncated = true
+				break
+			}
+			seen[input] = true
+			queue = append(queue, LineageNode{Hash: input, Depth: node.Depth + 1})
+		}
+	}
+
+	return lineage, nil
+}
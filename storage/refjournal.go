@@ -0,0 +1,275 @@
+package storage
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+	"github.com/fhenixprotocol/fheos/storage/codec"
+)
+
+// Reference counts are updated as blocks are executed, so a reorg has to undo the updates of the blocks it drops.
+// The first update of a hash in every block journals the count it had before, and the parent hash of every block is
+// recorded so that a block executed on top of a different chain can be noticed:
+//
+//	NamespaceJournal | "refjournal/" | block (8) | hash  ->  0 (no count before) or 1 | previous count (16)
+//	NamespaceJournal | "refparent/" | block (8)          ->  parent hash
+//	NamespaceJournal | "refhead"                         ->  latest block (8)
+//
+// Entries older than the collector's grace period are pruned, reorgs deeper than that can't be undone
+var (
+	refJournalPrefix = []byte("refjournal/")
+	refParentPrefix  = []byte("refparent/")
+	refHeadKey       = []byte("refhead")
+)
+
+func blockKey(prefix []byte, block uint64) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte{}, prefix...), block)
+}
+
+func refJournalKey(block uint64, h types.Hash) []byte {
+	return append(blockKey(refJournalPrefix, block), h[:]...)
+}
+
+// journalRefCount records the count h had before block changed it, unless block already changed it before.
+// Must be called with the reference count lock held
+func (fs *FheosStorage) journalRefCount(h types.Hash, block uint64) error {
+	key := refJournalKey(block, h)
+	if val, err := fs.diskStore.Get(types.NamespaceJournal, key); err == nil && len(val) > 0 {
+		return nil
+	}
+
+	val := []byte{0}
+	if rc, err := fs.diskStore.GetRefCount(h); err == nil {
+		val = append([]byte{1}, codec.EncodeRefCount(rc)...)
+	}
+	return fs.diskStore.Put(types.NamespaceJournal, key, val)
+}
+
+type refJournalEntry struct {
+	key   []byte
+	block uint64
+	hash  types.Hash
+	val   []byte
+}
+
+func (fs *FheosStorage) refJournal(fn func(e refJournalEntry) bool) error {
+	return fs.diskStore.IteratePrefix(types.NamespaceJournal, refJournalPrefix, func(key []byte, val []byte) bool {
+		if len(key) != len(refJournalPrefix)+8+len(types.Hash{}) {
+			return true
+		}
+
+		e := refJournalEntry{
+			key:   append([]byte{}, key...),
+			block: binary.BigEndian.Uint64(key[len(refJournalPrefix):]),
+			val:   append([]byte{}, val...),
+		}
+		copy(e.hash[:], key[len(refJournalPrefix)+8:])
+		return fn(e)
+	})
+}
+
+// RevertRefCounts undoes the reference count updates of fromBlock and every block after it, for when the chain
+// reorgs back to fromBlock - 1. Ciphertexts that weren't counted before are left with a count of zero as of
+// fromBlock, so that they are collected unless the new chain references them again
+func (fs *FheosStorage) RevertRefCounts(fromBlock uint64) error {
+	fs.instance.refCount.Lock()
+	defer fs.instance.refCount.Unlock()
+
+	return fs.revertRefCounts(fromBlock)
+}
+
+func (fs *FheosStorage) revertRefCounts(fromBlock uint64) error {
+	var entries []refJournalEntry
+	err := fs.refJournal(func(e refJournalEntry) bool {
+		if e.block >= fromBlock {
+			entries = append(entries, e)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	// Latest blocks first, so every hash ends up with the count it had before fromBlock
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].block > entries[j].block })
+	for _, e := range entries {
+		rc := types.RefCount{Count: 0, ZeroSince: fromBlock}
+		if len(e.val) > 1 && e.val[0] == 1 {
+			if rc, err = codec.DecodeRefCount(e.val[1:]); err != nil {
+				return err
+			}
+		} else if !fs.HasCt(e.hash) {
+			if err := fs.diskStore.DeleteRefCount(e.hash); err != nil {
+				return err
+			}
+			if err := fs.diskStore.Delete(types.NamespaceJournal, e.key); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := fs.diskStore.PutRefCount(e.hash, rc); err != nil {
+			return err
+		}
+		if err := fs.diskStore.Delete(types.NamespaceJournal, e.key); err != nil {
+			return err
+		}
+	}
+
+	var parents [][]byte
+	err = fs.diskStore.IteratePrefix(types.NamespaceJournal, refParentPrefix, func(key []byte, _ []byte) bool {
+		if len(key) == len(refParentPrefix)+8 && binary.BigEndian.Uint64(key[len(refParentPrefix):]) >= fromBlock {
+			parents = append(parents, append([]byte{}, key...))
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range parents {
+		if err := fs.diskStore.Delete(types.NamespaceJournal, key); err != nil {
+			return err
+		}
+	}
+
+	fs.instance.recorded = false
+	if fromBlock == 0 {
+		return fs.diskStore.Delete(types.NamespaceJournal, refHeadKey)
+	}
+	return fs.diskStore.Put(types.NamespaceJournal, refHeadKey, binary.BigEndian.AppendUint64(nil, fromBlock-1))
+}
+
+func (fs *FheosStorage) refParent(block uint64) (common.Hash, bool) {
+	val, err := fs.diskStore.Get(types.NamespaceJournal, blockKey(refParentPrefix, block))
+	if err != nil || len(val) != common.HashLength {
+		return common.Hash{}, false
+	}
+	return common.BytesToHash(val), true
+}
+
+// RecordBlock must be called before the reference counts of block are updated. getHash returns the hashes of the
+// chain block is executed on. If block is behind the latest block seen, or the chain it is built on differs from
+// the one the journaled blocks were built on, the updates of the dropped blocks (and of block) are reverted.
+// Re-executing the latest block on top of the same parent can't be told apart from the next tx of that block, so a
+// reorg that only replaces the head block has to be reported with RevertRefCounts.
+// It is called for every tx, but only the first tx of a block (on a given parent) writes anything
+func (fs *FheosStorage) RecordBlock(block uint64, getHash func(uint64) common.Hash) error {
+	fs.instance.refCount.Lock()
+	defer fs.instance.refCount.Unlock()
+
+	var parent common.Hash
+	if getHash != nil && block > 0 {
+		parent = getHash(block - 1)
+	}
+	if fs.instance.recorded && fs.instance.recordedBlock == block && fs.instance.recordedParent == parent {
+		return nil
+	}
+
+	// Nothing to revert unless the chain went back, or was replaced under block
+	revertFrom := uint64(0)
+	reorged := false
+	if val, err := fs.diskStore.Get(types.NamespaceJournal, refHeadKey); err == nil && len(val) == 8 {
+		// Every tx of block ran before the head, so it is block itself that is executed again
+		if head := binary.BigEndian.Uint64(val); head > block {
+			revertFrom, reorged = block, true
+		}
+	}
+
+	// A recorded parent that doesn't match the current chain means the block we executed under that number was
+	// replaced, so walk back for as long as that is the case
+	for b := block; b > 0 && getHash != nil; b-- {
+		parent, ok := fs.refParent(b)
+		if !ok || parent == getHash(b-1) {
+			break
+		}
+		revertFrom, reorged = b-1, true
+	}
+
+	if reorged {
+		if err := fs.revertRefCounts(revertFrom); err != nil {
+			return err
+		}
+	}
+
+	if getHash != nil && block > 0 {
+		if _, ok := fs.refParent(block); !ok {
+			if err := fs.diskStore.Put(types.NamespaceJournal, blockKey(refParentPrefix, block), parent[:]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := fs.diskStore.Put(types.NamespaceJournal, refHeadKey, binary.BigEndian.AppendUint64(nil, block)); err != nil {
+		return err
+	}
+
+	fs.instance.recorded, fs.instance.recordedBlock, fs.instance.recordedParent = true, block, parent
+	return nil
+}
+
+// moveRefJournal moves the reference count journal, which used to be kept in NamespaceMetadata, into
+// NamespaceJournal
+func moveRefJournal(fs *FheosStorage) error {
+	type entry struct{ key, val []byte }
+	var entries []entry
+	for _, prefix := range [][]byte{refJournalPrefix, refParentPrefix, refHeadKey} {
+		err := fs.diskStore.IteratePrefix(types.NamespaceMetadata, prefix, func(key []byte, val []byte) bool {
+			entries = append(entries, entry{append([]byte{}, key...), append([]byte{}, val...)})
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, e := range entries {
+		if err := fs.diskStore.Put(types.NamespaceJournal, e.key, e.val); err != nil {
+			return err
+		}
+		if err := fs.diskStore.Delete(types.NamespaceMetadata, e.key); err != nil {
+			return err
+		}
+	}
+
+	log.Info("moved reference count journal into its own namespace", "entries", len(entries))
+	return nil
+}
+
+// PruneRefJournal drops the journal of every block before block, which can no longer be reorged
+func (fs *FheosStorage) PruneRefJournal(block uint64) error {
+	fs.instance.refCount.Lock()
+	defer fs.instance.refCount.Unlock()
+
+	var keys [][]byte
+	err := fs.refJournal(func(e refJournalEntry) bool {
+		if e.block >= block {
+			return false
+		}
+		keys = append(keys, e.key)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	err = fs.diskStore.IteratePrefix(types.NamespaceJournal, refParentPrefix, func(key []byte, _ []byte) bool {
+		if len(key) != len(refParentPrefix)+8 || binary.BigEndian.Uint64(key[len(refParentPrefix):]) >= block {
+			return false
+		}
+		keys = append(keys, append([]byte{}, key...))
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := fs.diskStore.Delete(types.NamespaceJournal, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+	"github.com/fhenixprotocol/fheos/storage/codec"
+)
+
+// quarantinePrefix holds the raw records scrubbing took out of the ciphertext namespace, under
+// NamespaceMetadata | "quarantine/" | hash
+var quarantinePrefix = []byte("quarantine/")
+
+type ScrubOptions struct {
+	// CheckMetadata also checks that the type, security zone and trivial encryption flag encoded in the handle
+	// match the stored ciphertext
+	CheckMetadata bool
+	// Quarantine moves bad records out of the ciphertext namespace, otherwise they are only reported
+	Quarantine bool
+}
+
+type ScrubIssue struct {
+	Hash   types.Hash
+	Reason string
+}
+
+type ScrubReport struct {
+	Scanned int
+	// Unverified counts the records written before checksums existed, which can only be checked for decodability
+	Unverified  int
+	Issues      []ScrubIssue
+	Quarantined int
+}
+
+// metadataMismatch returns why the metadata bytes of handle h don't describe ct, or "" if they do
+func metadataMismatch(h types.Hash, ct *types.FheEncrypted) string {
+	switch {
+	case h[types.TrivialEncryptAndTypeByte]&types.TypeMask != byte(ct.UintType):
+		return "handle type doesn't match the ciphertext"
+	case h[types.SecurityZoneByte] != byte(ct.Key.SecurityZone):
+		return "handle security zone doesn't match the ciphertext"
+	case (h[types.TrivialEncryptAndTypeByte]&types.TrivialEncryptFlag != 0) != ct.Key.IsTriviallyEncrypted:
+		return "handle trivial encryption flag doesn't match the ciphertext"
+	default:
+		return ""
+	}
+}
+
+type archiveIterator interface {
+	IterateArchived(fn func(h types.Hash, record []byte, err error) bool) error
+	IterateArchivedPayloads(fn func(h types.Hash, record []byte, err error) bool) error
+}
+
+// Scrub reads every stored ciphertext record, including the archived ones of a tiered backend, and reports the ones
+// that are corrupt, or (with ScrubOptions.CheckMetadata) stored under a handle that doesn't describe them
+func (fs *FheosStorage) Scrub(opts ScrubOptions) (ScrubReport, error) {
+	var report ScrubReport
+	check := func(h types.Hash, val []byte, handle bool) {
+		report.Scanned++
+		if !codec.HasChecksum(val) {
+			report.Unverified++
+		}
+
+		ct, err := codec.DecodeCt(val)
+		if err != nil {
+			report.Issues = append(report.Issues, ScrubIssue{Hash: h, Reason: err.Error()})
+			return
+		}
+
+		if opts.CheckMetadata && handle {
+			if reason := metadataMismatch(h, ct); reason != "" {
+				report.Issues = append(report.Issues, ScrubIssue{Hash: h, Reason: reason})
+			}
+		}
+	}
+
+	err := fs.IteratePrefix(types.NamespaceCiphertexts, nil, func(key []byte, val []byte) bool {
+		var h types.Hash
+		copy(h[:], key)
+		check(h, val, true)
+		return true
+	})
+	if err != nil {
+		return report, err
+	}
+
+	// Shared payloads are stored under the engine's content hash, which isn't a handle
+	payloads := map[types.Hash]bool{}
+	err = fs.IteratePrefix(types.NamespacePayloads, nil, func(key []byte, val []byte) bool {
+		var h types.Hash
+		copy(h[:], key)
+		payloads[h] = true
+		check(h, val, false)
+		return true
+	})
+	if err != nil {
+		return report, err
+	}
+
+	// Archived records aren't in the ciphertext or payload namespace, the raw ones are kept for quarantining
+	archived, archivedPayloads := map[types.Hash][]byte{}, map[types.Hash][]byte{}
+	if archive, ok := fs.diskStore.(archiveIterator); ok {
+		collect := func(records map[types.Hash][]byte, handle bool) func(h types.Hash, record []byte, err error) bool {
+			return func(h types.Hash, record []byte, err error) bool {
+				records[h] = record
+				if !handle {
+					payloads[h] = true
+				}
+				if err != nil {
+					report.Scanned++
+					report.Issues = append(report.Issues, ScrubIssue{Hash: h, Reason: err.Error()})
+					return true
+				}
+				check(h, record, handle)
+				return true
+			}
+		}
+
+		err = archive.IterateArchived(collect(archived, true))
+		if err == nil {
+			err = archive.IterateArchivedPayloads(collect(archivedPayloads, false))
+		}
+	}
+	if err != nil || !opts.Quarantine {
+		return report, err
+	}
+
+	// Records are moved after the walk, so the iteration never sees its own deletes
+	for _, issue := range report.Issues {
+		if payloads[issue.Hash] {
+			val, ok := archivedPayloads[issue.Hash]
+			if !ok {
+				if val, err = fs.Get(types.NamespacePayloads, issue.Hash[:]); err != nil {
+					return report, err
+				}
+			}
+
+			if err := fs.quarantinePayload(issue.Hash, val); err != nil {
+				return report, err
+			}
+			report.Quarantined++
+			continue
+		}
+
+		val, ok := archived[issue.Hash]
+		if !ok {
+			if val, err = fs.Get(types.NamespaceCiphertexts, issue.Hash[:]); err != nil {
+				return report, err
+			}
+		}
+
+		if err := fs.quarantine(issue.Hash, val); err != nil {
+			return report, err
+		}
+		report.Quarantined++
+	}
+
+	return report, nil
+}
+
+// quarantine keeps the raw record val of h aside and deletes the ciphertext, so it is no longer served
+func (fs *FheosStorage) quarantine(h types.Hash, val []byte) error {
+	if err := fs.Put(types.NamespaceMetadata, append(append([]byte{}, quarantinePrefix...), h[:]...), val); err != nil {
+		return err
+	}
+
+	return fs.DeleteCt(h)
+}
+
+// quarantinePayload keeps the raw payload val stored under content aside and deletes it, so that the placeholders that
+// alias it are no longer served
+func (fs *FheosStorage) quarantinePayload(content types.Hash, val []byte) error {
+	if err := fs.Put(types.NamespaceMetadata, append(append([]byte{}, quarantinePrefix...), content[:]...), val); err != nil {
+		return err
+	}
+	return deletePayload(fs.diskStore, content)
+}
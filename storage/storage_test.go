@@ -1,19 +1,30 @@
+//go:build amd64 || arm64
+
 package storage_test
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
 	"github.com/fhenixprotocol/fheos/precompiles/types"
 	storage2 "github.com/fhenixprotocol/fheos/storage"
+	"github.com/fhenixprotocol/fheos/storage/codec"
 	"github.com/stretchr/testify/assert"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/fhenixprotocol/warp-drive/fhe-driver"
 )
 
-const storagePath = "/tmp/fheosdb"
 const TestFileSize = 1024 * 1024 * 4 // 4MB
 func init() {
 	err := os.Setenv("FHEOS_DB_PATH", "/tmp/fheosdb")
@@ -23,6 +34,21 @@ func init() {
 
 }
 
+// newTestStorage opens a storage of its own for the test, closed when the test ends
+func newTestStorage(tb testing.TB) (*storage2.FheosStorage, error) {
+	storage, err := storage2.InitStorage(tb.TempDir())
+	if err != nil {
+		return nil, err
+	}
+
+	tb.Cleanup(func() {
+		if err := storage.Close(); err != nil {
+			tb.Errorf("Failed to close storage: %v", err)
+		}
+	})
+	return storage, nil
+}
+
 // Helper function to generate a random Ciphertext
 func randomCiphertext() *fhe.FheEncrypted {
 	// Generate a large serialization
@@ -46,7 +72,7 @@ func randomCiphertext() *fhe.FheEncrypted {
 }
 
 func TestStorageConcurrency(t *testing.T) {
-	storage, err := storage2.InitStorage(storagePath)
+	storage, err := newTestStorage(t)
 
 	if err != nil {
 		t.Fatalf("Failed to initialize storage: %v", err)
@@ -74,7 +100,7 @@ func TestStorageConcurrency(t *testing.T) {
 }
 
 func TestStorageEphemeralConcurrency(t *testing.T) {
-	storage, err := storage2.InitStorage(storagePath)
+	storage, err := newTestStorage(t)
 
 	if err != nil {
 		t.Fatalf("Failed to initialize storage: %v", err)
@@ -108,7 +134,7 @@ func TestStorageEphemeralConcurrency(t *testing.T) {
 // Additional tests for the Storage interface
 
 func TestStorageCt(t *testing.T) {
-	storage, err := storage2.InitStorage(storagePath)
+	storage, err := newTestStorage(t)
 
 	if err != nil {
 		t.Fatalf("Failed to initialize storage: %v", err)
@@ -134,7 +160,7 @@ func TestStorageCt(t *testing.T) {
 }
 
 func TestStorageEphemeralCt(t *testing.T) {
-	storage, err := storage2.InitStorage(storagePath)
+	storage, err := newTestStorage(t)
 
 	if err != nil {
 		t.Fatalf("Failed to initialize storage: %v", err)
@@ -158,7 +184,7 @@ func TestStorageEphemeralCt(t *testing.T) {
 }
 
 func TestStorageVersioning(t *testing.T) {
-	storage, err := storage2.InitStorage(storagePath)
+	storage, err := newTestStorage(t)
 
 	if err != nil {
 		t.Fatalf("Failed to initialize storage: %v", err)
@@ -185,7 +211,7 @@ func TestStorageVersioning(t *testing.T) {
 }
 
 func TestStorageGetSetReset(t *testing.T) {
-	storage, err := storage2.InitStorage(storagePath)
+	storage, err := newTestStorage(t)
 
 	if err != nil {
 		t.Fatalf("Failed to initialize storage: %v", err)
@@ -218,7 +244,7 @@ func TestStorageGetSetReset(t *testing.T) {
 }
 
 func BenchmarkConcurrentPut(b *testing.B) {
-	storage, err := storage2.InitStorage(storagePath)
+	storage, err := newTestStorage(b)
 
 	if err != nil {
 		b.Fatalf("Failed to initialize storage: %v", err)
@@ -248,7 +274,7 @@ func BenchmarkConcurrentPut(b *testing.B) {
 	}
 }
 func TestMultiStore_AppendCt(t *testing.T) {
-	diskStorage, err := storage2.InitStorage(storagePath)
+	diskStorage, err := newTestStorage(t)
 	multiStore := storage2.NewMultiStore(nil, diskStorage)
 
 	ct := randomCiphertext()
@@ -270,7 +296,7 @@ func TestMultiStore_AppendCt(t *testing.T) {
 	}
 }
 func TestMultiStore_AppendCtPlaceholderReplace(t *testing.T) {
-	diskStorage, err := storage2.InitStorage(storagePath)
+	diskStorage, err := newTestStorage(t)
 	multiStore := storage2.NewMultiStore(nil, diskStorage)
 
 	ct := randomCiphertext()
@@ -295,3 +321,1263 @@ func TestMultiStore_AppendCtPlaceholderReplace(t *testing.T) {
 	assert.Equal(t, (*fhe.FheEncrypted)(retrievedCt).GetHash(), ct.GetHash())
 	assert.Equal(t, retrievedCt.Placeholder, false)
 }
+
+func TestMultiStore_TxLayerCommit(t *testing.T) {
+	diskStorage, err := newTestStorage(t)
+	if err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+	multiStore := storage2.NewMultiStore(memorydb.New(), diskStorage)
+
+	ct := randomCiphertext()
+	hash := types.Hash(fhe.Hash{110}) // this key needs to be unique for the test
+
+	if err := multiStore.PutCt(hash, (*types.FheEncrypted)(ct)); err != nil {
+		t.Fatalf("Failed to put ciphertext: %v", err)
+	}
+
+	assert.True(t, multiStore.Has(hash))
+	assert.False(t, diskStorage.HasCt(hash), "ciphertext should not reach disk before commit")
+
+	if _, err := multiStore.Commit(); err != nil {
+		t.Fatalf("Failed to commit tx layer: %v", err)
+	}
+
+	retrievedCt, err := diskStorage.GetCt(hash)
+	if err != nil {
+		t.Fatalf("Failed to get committed ciphertext: %v", err)
+	}
+	assert.True(t, bytes.Equal(retrievedCt.Data, ct.Data))
+}
+
+func TestMultiStore_TxLayerDiscard(t *testing.T) {
+	diskStorage, err := newTestStorage(t)
+	if err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+	multiStore := storage2.NewMultiStore(memorydb.New(), diskStorage)
+
+	ct := randomCiphertext()
+	ct.Placeholder = true
+	hash := types.Hash(fhe.Hash{111}) // this key needs to be unique for the test
+
+	if err := multiStore.PutCt(hash, (*types.FheEncrypted)(ct)); err != nil {
+		t.Fatalf("Failed to put ciphertext: %v", err)
+	}
+
+	if err := multiStore.Discard(); err != nil {
+		t.Fatalf("Failed to discard tx layer: %v", err)
+	}
+
+	assert.False(t, multiStore.Has(hash))
+	assert.False(t, diskStorage.HasCt(hash))
+
+	// A result that arrives after its placeholder was discarded must not be written anywhere
+	ct.Placeholder = false
+	err = multiStore.ResolvePlaceholder(hash, (*types.FheEncrypted)(ct), types.Hash{})
+	assert.ErrorIs(t, err, storage2.ErrPlaceholderDiscarded)
+	assert.False(t, diskStorage.HasCt(hash))
+}
+
+func TestMultiStore_ResolveCommittedPlaceholder(t *testing.T) {
+	diskStorage, err := newTestStorage(t)
+	if err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+	multiStore := storage2.NewMultiStore(memorydb.New(), diskStorage)
+
+	ct := randomCiphertext()
+	ct.Placeholder = true
+	hash := types.Hash(fhe.Hash{112}) // this key needs to be unique for the test
+
+	if err := multiStore.PutCt(hash, (*types.FheEncrypted)(ct)); err != nil {
+		t.Fatalf("Failed to put ciphertext: %v", err)
+	}
+	if _, err := multiStore.Commit(); err != nil {
+		t.Fatalf("Failed to commit tx layer: %v", err)
+	}
+
+	// The result of an async operation may arrive after the tx was committed, it should go straight to disk
+	ct.Placeholder = false
+	if err := multiStore.ResolvePlaceholder(hash, (*types.FheEncrypted)(ct), types.Hash{}); err != nil {
+		t.Fatalf("Failed to resolve placeholder: %v", err)
+	}
+
+	retrievedCt, err := diskStorage.GetCt(hash)
+	if err != nil {
+		t.Fatalf("Failed to get resolved ciphertext: %v", err)
+	}
+	assert.False(t, retrievedCt.Placeholder)
+}
+
+func TestMultiStore_ResolveSharesIdenticalResults(t *testing.T) {
+	diskStorage, err := newTestStorage(t)
+	if err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	ct := randomCiphertext()
+	ct.Placeholder = true
+	committed := types.Hash(fhe.Hash{113}) // these keys need to be unique for the test
+	pending := types.Hash(fhe.Hash{114})
+	content := types.Hash(fhe.Hash{115})
+
+	// One placeholder is resolved after its tx was committed, the other one before
+	multiStore := storage2.NewMultiStore(memorydb.New(), diskStorage)
+	if err := multiStore.PutCt(committed, (*types.FheEncrypted)(ct)); err != nil {
+		t.Fatalf("Failed to put ciphertext: %v", err)
+	}
+	if _, err := multiStore.Commit(); err != nil {
+		t.Fatalf("Failed to commit tx layer: %v", err)
+	}
+	if err := multiStore.PutCt(pending, (*types.FheEncrypted)(ct)); err != nil {
+		t.Fatalf("Failed to put ciphertext: %v", err)
+	}
+
+	ct.Placeholder = false
+	for _, h := range []types.Hash{committed, pending} {
+		if err := multiStore.ResolvePlaceholder(h, (*types.FheEncrypted)(ct), content); err != nil {
+			t.Fatalf("Failed to resolve placeholder: %v", err)
+		}
+	}
+
+	_, ok := diskStorage.GetAlias(pending)
+	assert.False(t, ok, "aliases should not reach disk before commit")
+	if _, err := multiStore.Commit(); err != nil {
+		t.Fatalf("Failed to commit tx layer: %v", err)
+	}
+
+	resolved, placeholders, err := diskStorage.Aliases(pending)
+	if err != nil {
+		t.Fatalf("Failed to get aliases: %v", err)
+	}
+	assert.Equal(t, content, resolved)
+	assert.ElementsMatch(t, []types.Hash{committed, pending}, placeholders)
+
+	for _, h := range []types.Hash{committed, pending} {
+		assert.True(t, diskStorage.HasCt(h))
+		retrievedCt, err := diskStorage.GetCt(h)
+		if err != nil {
+			t.Fatalf("Failed to get aliased ciphertext: %v", err)
+		}
+		assert.True(t, bytes.Equal(retrievedCt.Data, ct.Data))
+		assert.Equal(t, fhe.Hash(h), retrievedCt.Key.Hash)
+	}
+
+	// The payload is kept apart from the ciphertexts, which index every placeholder as resolved under its own zone
+	// and type
+	assert.True(t, diskStorage.HasPayload(content))
+	assert.False(t, diskStorage.HasCt(content))
+	indexed := func() map[types.Hash]types.CtMetadata {
+		found := map[types.Hash]types.CtMetadata{}
+		assert.NoError(t, diskStorage.IterateCts(types.CtFilter{}, func(m types.CtMetadata) bool {
+			found[m.Hash] = m
+			return true
+		}))
+		return found
+	}
+	for _, h := range []types.Hash{committed, pending} {
+		if m, ok := indexed()[h]; assert.True(t, ok) {
+			assert.False(t, m.Placeholder)
+			assert.Equal(t, uint64(len(ct.Data)), m.Size)
+		}
+	}
+	assert.NotContains(t, indexed(), content)
+
+	// Scrubbing checks the payload, but not as a handle
+	report, err := diskStorage.Scrub(storage2.ScrubOptions{CheckMetadata: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Scanned)
+	assert.Empty(t, report.Issues)
+
+	// The shared payload is only deleted with the last placeholder that uses it
+	if err := diskStorage.DeleteCt(committed); err != nil {
+		t.Fatalf("Failed to delete ciphertext: %v", err)
+	}
+	assert.False(t, diskStorage.HasCt(committed))
+	assert.True(t, diskStorage.HasCt(pending))
+	assert.True(t, diskStorage.HasPayload(content))
+	assert.NotContains(t, indexed(), committed)
+	assert.Contains(t, indexed(), pending)
+
+	if err := diskStorage.DeleteCt(pending); err != nil {
+		t.Fatalf("Failed to delete ciphertext: %v", err)
+	}
+	assert.False(t, diskStorage.HasCt(pending))
+	assert.False(t, diskStorage.HasPayload(content))
+	assert.NotContains(t, indexed(), pending)
+}
+
+func TestStorageLineage(t *testing.T) {
+	diskStorage, err := newTestStorage(t)
+	if err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+	multiStore := storage2.NewMultiStore(memorydb.New(), diskStorage)
+
+	// c = a + b, d = c * c, e = not(d)
+	a := types.Hash(fhe.Hash{130}) // these keys need to be unique for the test
+	b := types.Hash(fhe.Hash{131})
+	c := types.Hash(fhe.Hash{132})
+	d := types.Hash(fhe.Hash{133})
+	e := types.Hash(fhe.Hash{134})
+	records := map[types.Hash]types.Provenance{
+		a: {Operation: types.StoreCt},
+		b: {Operation: types.TrivialEncrypt},
+		c: {Operation: types.Add, Inputs: []types.Hash{a, b}},
+		d: {Operation: types.Mul, Inputs: []types.Hash{c, c}},
+		e: {Operation: types.Not, Inputs: []types.Hash{d}},
+	}
+
+	ct := randomCiphertext()
+	for h, p := range records {
+		p.BlockNumber = 7
+		p.CreatedAt = time.Unix(1700000000, 0)
+		if err := multiStore.PutCt(h, (*types.FheEncrypted)(ct)); err != nil {
+			t.Fatalf("Failed to put ciphertext: %v", err)
+		}
+		if err := multiStore.PutProvenance(h, p); err != nil {
+			t.Fatalf("Failed to put provenance: %v", err)
+		}
+	}
+
+	_, err = diskStorage.GetProvenance(e)
+	assert.ErrorIs(t, err, storage2.ErrNoProvenance, "provenance should not reach disk before commit")
+	if _, err := multiStore.Commit(); err != nil {
+		t.Fatalf("Failed to commit tx layer: %v", err)
+	}
+
+	p, err := diskStorage.GetProvenance(c)
+	if err != nil {
+		t.Fatalf("Failed to get provenance: %v", err)
+	}
+	assert.Equal(t, types.Add, p.Operation)
+	assert.Equal(t, []types.Hash{a, b}, p.Inputs)
+	assert.Equal(t, uint64(7), p.BlockNumber)
+	assert.True(t, p.CreatedAt.Equal(time.Unix(1700000000, 0)))
+
+	lineage, err := diskStorage.Lineage(e, 10, 0)
+	if err != nil {
+		t.Fatalf("Failed to get lineage: %v", err)
+	}
+	assert.False(t, lineage.Truncated)
+	depths := map[types.Hash]int{}
+	for _, node := range lineage.Nodes {
+		depths[node.Hash] = node.Depth
+	}
+	assert.Equal(t, map[types.Hash]int{e: 0, d: 1, c: 2, a: 3, b: 3}, depths, "every ancestor should appear once")
+
+	lineage, err = diskStorage.Lineage(e, 1, 0)
+	if err != nil {
+		t.Fatalf("Failed to get lineage: %v", err)
+	}
+	assert.True(t, lineage.Truncated)
+	assert.Len(t, lineage.Nodes, 2)
+
+	// The node cap truncates a graph that is within the depth
+	lineage, err = diskStorage.Lineage(e, 10, 4)
+	if err != nil {
+		t.Fatalf("Failed to get lineage: %v", err)
+	}
+	assert.True(t, lineage.Truncated)
+	assert.Len(t, lineage.Nodes, 4)
+
+	lineage, err = diskStorage.Lineage(e, 10, 5)
+	if err != nil {
+		t.Fatalf("Failed to get lineage: %v", err)
+	}
+	assert.False(t, lineage.Truncated)
+	assert.Len(t, lineage.Nodes, 5)
+
+	// Provenance is dropped along with the ciphertext, and discarded along with the tx layer
+	if err := diskStorage.DeleteCt(a); err != nil {
+		t.Fatalf("Failed to delete ciphertext: %v", err)
+	}
+	_, err = diskStorage.GetProvenance(a)
+	assert.ErrorIs(t, err, storage2.ErrNoProvenance)
+
+	discarded := types.Hash(fhe.Hash{135})
+	if err := multiStore.PutProvenance(discarded, types.Provenance{Operation: types.Random}); err != nil {
+		t.Fatalf("Failed to put provenance: %v", err)
+	}
+	if err := multiStore.Discard(); err != nil {
+		t.Fatalf("Failed to discard tx layer: %v", err)
+	}
+	if _, err := multiStore.Commit(); err != nil {
+		t.Fatalf("Failed to commit tx layer: %v", err)
+	}
+	_, err = diskStorage.GetProvenance(discarded)
+	assert.ErrorIs(t, err, storage2.ErrNoProvenance)
+}
+
+func TestRefCountCollector(t *testing.T) {
+	diskStorage, err := newTestStorage(t)
+	if err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	ct := randomCiphertext()
+	unreferenced := types.Hash(fhe.Hash{120}) // these keys need to be unique for the test
+	referenced := types.Hash(fhe.Hash{121})
+	for _, h := range []types.Hash{unreferenced, referenced} {
+		if err := diskStorage.PutCt(h, (*types.FheEncrypted)(ct)); err != nil {
+			t.Fatalf("Failed to put ciphertext: %v", err)
+		}
+		if err := diskStorage.TrackCt(h, 10); err != nil {
+			t.Fatalf("Failed to track ciphertext: %v", err)
+		}
+	}
+
+	if err := diskStorage.UpdateRefCount(referenced, 1, 11); err != nil {
+		t.Fatalf("Failed to update reference count: %v", err)
+	}
+
+	dryRun := storage2.NewRefCountCollector(diskStorage, storage2.GCConfig{GraceBlocks: 5, DryRun: true})
+	dryRun.SetHead(14)
+	report, err := dryRun.Collect()
+	assert.NoError(t, err)
+	assert.NotContains(t, report.Candidates, unreferenced, "grace period has not passed yet")
+
+	dryRun.SetHead(15)
+	report, err = dryRun.Collect()
+	assert.NoError(t, err)
+	assert.Contains(t, report.Candidates, unreferenced)
+	assert.NotContains(t, report.Candidates, referenced)
+	assert.True(t, diskStorage.HasCt(unreferenced), "dry run should not delete anything")
+
+	collector := storage2.NewRefCountCollector(diskStorage, storage2.GCConfig{GraceBlocks: 5})
+	collector.SetHead(15)
+	_, err = collector.Collect()
+	assert.NoError(t, err)
+	assert.False(t, diskStorage.HasCt(unreferenced))
+	assert.True(t, diskStorage.HasCt(referenced))
+
+	// Once the last reference is dropped the grace period starts over
+	if err := diskStorage.UpdateRefCount(referenced, -1, 20); err != nil {
+		t.Fatalf("Failed to update reference count: %v", err)
+	}
+	collector.SetHead(24)
+	_, err = collector.Collect()
+	assert.NoError(t, err)
+	assert.True(t, diskStorage.HasCt(referenced))
+
+	collector.SetHead(25)
+	_, err = collector.Collect()
+	assert.NoError(t, err)
+	assert.False(t, diskStorage.HasCt(referenced))
+}
+
+func TestRefCountsOnlyCoverTxCommits(t *testing.T) {
+	diskStorage, err := newTestStorage(t)
+	if err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	// Written straight to disk, as the coprocessor does - its references live in another chain
+	direct := types.Hash(fhe.Hash{140})
+	ms := storage2.NewMultiStore(nil, diskStorage)
+	if err := ms.PutCt(direct, (*types.FheEncrypted)(randomCiphertext())); err != nil {
+		t.Fatalf("Failed to put ciphertext: %v", err)
+	}
+
+	_, err = diskStorage.GetRefCount(direct)
+	assert.Error(t, err, "ciphertexts written straight to disk should not be counted")
+
+	collector := storage2.NewRefCountCollector(diskStorage, storage2.GCConfig{GraceBlocks: 1})
+	collector.SetHead(1000)
+	_, err = collector.Collect()
+	assert.NoError(t, err)
+	assert.True(t, diskStorage.HasCt(direct))
+}
+
+func TestRefCountReorg(t *testing.T) {
+	diskStorage, err := newTestStorage(t)
+	if err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	h := types.Hash(fhe.Hash{141})
+	if err := diskStorage.PutCt(h, (*types.FheEncrypted)(randomCiphertext())); err != nil {
+		t.Fatalf("Failed to put ciphertext: %v", err)
+	}
+
+	chainA := func(n uint64) common.Hash { return common.Hash{byte(n)} }
+	// chainB forks off chainA after block 10
+	chainB := func(n uint64) common.Hash {
+		if n <= 10 {
+			return chainA(n)
+		}
+		return common.Hash{byte(n), 0xb}
+	}
+	refCount := func() types.RefCount {
+		rc, err := diskStorage.GetRefCount(h)
+		assert.NoError(t, err)
+		return rc
+	}
+
+	assert.NoError(t, diskStorage.RecordBlock(10, chainA))
+	assert.NoError(t, diskStorage.TrackCt(h, 10))
+	assert.NoError(t, diskStorage.RecordBlock(11, chainA))
+	assert.NoError(t, diskStorage.UpdateRefCount(h, 1, 11))
+	assert.NoError(t, diskStorage.RecordBlock(12, chainA))
+	assert.NoError(t, diskStorage.UpdateRefCount(h, -1, 12))
+	assert.Equal(t, types.RefCount{Count: 0, ZeroSince: 12}, refCount())
+
+	// Block 11 is executed again, on chainB - the updates of blocks 11 and 12 are undone
+	assert.NoError(t, diskStorage.RecordBlock(11, chainB))
+	assert.Equal(t, types.RefCount{Count: 0, ZeroSince: 10}, refCount())
+
+	// Further txs of the same block don't revert anything
+	assert.NoError(t, diskStorage.UpdateRefCount(h, 1, 11))
+	assert.NoError(t, diskStorage.RecordBlock(11, chainB))
+	assert.Equal(t, types.RefCount{Count: 1, ZeroSince: 0}, refCount())
+
+	// A block built on a chain that replaced an earlier block is detected by its parent
+	assert.NoError(t, diskStorage.RecordBlock(12, chainB))
+	assert.NoError(t, diskStorage.RecordBlock(12, chainA))
+	assert.Equal(t, types.RefCount{Count: 0, ZeroSince: 10}, refCount())
+
+	// A reorg that only replaces the head block has to be reported
+	assert.NoError(t, diskStorage.RecordBlock(11, chainA))
+	assert.NoError(t, diskStorage.UpdateRefCount(h, 1, 11))
+	assert.NoError(t, diskStorage.RevertRefCounts(11))
+	assert.Equal(t, types.RefCount{Count: 0, ZeroSince: 10}, refCount())
+
+	// Once pruned, a block can no longer be reverted
+	assert.NoError(t, diskStorage.RecordBlock(11, chainA))
+	assert.NoError(t, diskStorage.UpdateRefCount(h, 1, 11))
+	assert.NoError(t, diskStorage.PruneRefJournal(12))
+	assert.NoError(t, diskStorage.RevertRefCounts(11))
+	assert.Equal(t, types.RefCount{Count: 1, ZeroSince: 0}, refCount())
+
+	// Only the first tx of a block writes to the journal
+	assert.NoError(t, diskStorage.RecordBlock(11, chainA))
+	head, err := diskStorage.Get(types.NamespaceJournal, []byte("refhead"))
+	assert.NoError(t, err)
+	assert.Equal(t, binary.BigEndian.AppendUint64(nil, 11), head)
+	assert.NoError(t, diskStorage.Delete(types.NamespaceJournal, []byte("refhead")))
+	assert.NoError(t, diskStorage.RecordBlock(11, chainA))
+	_, err = diskStorage.Get(types.NamespaceJournal, []byte("refhead"))
+	assert.Error(t, err)
+}
+
+func TestRefJournalMigration(t *testing.T) {
+	diskStorage, err := newTestStorage(t)
+	if err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	h := types.Hash(fhe.Hash{145})
+	if err := diskStorage.PutCt(h, (*types.FheEncrypted)(randomCiphertext())); err != nil {
+		t.Fatalf("Failed to put ciphertext: %v", err)
+	}
+	assert.NoError(t, diskStorage.PutRefCount(h, types.RefCount{Count: 1}))
+
+	// The journal of block 11 as version 1005 kept it, in the metadata namespace: h wasn't counted before
+	journalKey := append(binary.BigEndian.AppendUint64([]byte("refjournal/"), 11), h[:]...)
+	assert.NoError(t, diskStorage.Put(types.NamespaceMetadata, journalKey, []byte{0}))
+	assert.NoError(t, diskStorage.Put(types.NamespaceMetadata, []byte("refhead"), binary.BigEndian.AppendUint64(nil, 11)))
+	assert.NoError(t, diskStorage.PutVersion(1005))
+
+	_, err = diskStorage.Migrate(storage2.Migrations, 1006, false)
+	assert.NoError(t, err)
+
+	for _, key := range [][]byte{journalKey, []byte("refhead")} {
+		_, err = diskStorage.Get(types.NamespaceMetadata, key)
+		assert.Error(t, err)
+		_, err = diskStorage.Get(types.NamespaceJournal, key)
+		assert.NoError(t, err)
+	}
+
+	// and the moved journal can still revert block 11
+	assert.NoError(t, diskStorage.RevertRefCounts(11))
+	rc, err := diskStorage.GetRefCount(h)
+	assert.NoError(t, err)
+	assert.Equal(t, types.RefCount{Count: 0, ZeroSince: 11}, rc)
+}
+
+func TestStorageCacheInvalidation(t *testing.T) {
+	storage, err := newTestStorage(t)
+	if err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	ct := randomCiphertext()
+	hash := types.Hash(fhe.Hash{130}) // this key needs to be unique for the test
+
+	if err := storage.PutCt(hash, (*types.FheEncrypted)(ct)); err != nil {
+		t.Fatalf("Failed to put ciphertext: %v", err)
+	}
+
+	// The first read populates the cache, the second one is served from it
+	for i := 0; i < 2; i++ {
+		retrievedCt, err := storage.GetCt(hash)
+		if err != nil {
+			t.Fatalf("Failed to get ciphertext: %v", err)
+		}
+		assert.True(t, bytes.Equal(retrievedCt.Data, ct.Data))
+	}
+
+	// Overwriting the ciphertext must not leave a stale entry behind
+	updated := randomCiphertext()
+	if err := storage.PutCt(hash, (*types.FheEncrypted)(updated)); err != nil {
+		t.Fatalf("Failed to put ciphertext: %v", err)
+	}
+	retrievedCt, err := storage.GetCt(hash)
+	if err != nil {
+		t.Fatalf("Failed to get ciphertext: %v", err)
+	}
+	assert.True(t, bytes.Equal(retrievedCt.Data, updated.Data))
+
+	if err := storage.DeleteCt(hash); err != nil {
+		t.Fatalf("Failed to delete ciphertext: %v", err)
+	}
+	_, err = storage.GetCt(hash)
+	assert.Error(t, err)
+}
+
+// resolveTestPlaceholder stores a placeholder and resolves it to an alias of a payload stored under content
+func resolveTestPlaceholder(t *testing.T, storage *storage2.FheosStorage, ct *types.FheEncrypted) (types.Hash, types.Hash) {
+	placeholder, content := randomHash(), randomHash()
+	assert.NoError(t, storage.PutCt(placeholder, &types.FheEncrypted{Placeholder: true}))
+	assert.NoError(t, storage.PutResolvedCt(placeholder, ct, content))
+
+	_, ok := storage.GetAlias(placeholder)
+	assert.True(t, ok)
+	return placeholder, content
+}
+
+func TestStorageAliasedReadIsCached(t *testing.T) {
+	storage, err := storage2.NewStorage("pebble", storage2.BackendConfig{Path: t.TempDir(), CacheSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+	defer storage.Close()
+
+	ct := &types.FheEncrypted{Data: []byte{1, 2, 3}, UintType: 2}
+	placeholder, content := resolveTestPlaceholder(t, storage, ct)
+
+	// The first read populates the cache, so the second one doesn't need the record anymore
+	retrievedCt, err := storage.GetCt(placeholder)
+	assert.NoError(t, err)
+	assert.Equal(t, ct.Data, retrievedCt.Data)
+
+	assert.NoError(t, storage.Delete(types.NamespacePayloads, content[:]))
+	retrievedCt, err = storage.GetCt(placeholder)
+	assert.NoError(t, err, "aliased read should be served from the cache")
+	assert.Equal(t, ct.Data, retrievedCt.Data)
+	assert.Equal(t, fhe.Hash(placeholder), retrievedCt.Key.Hash)
+
+	// Deleting the last placeholder drops the cached payload with the record
+	assert.NoError(t, storage.DeleteCt(placeholder))
+	_, err = storage.GetCt(placeholder)
+	assert.Error(t, err)
+	assert.False(t, storage.HasPayload(content))
+}
+
+func TestStorageArchivesAliasedResults(t *testing.T) {
+	coldDir := t.TempDir()
+	storage, err := storage2.NewStorage("pebble", storage2.BackendConfig{Path: t.TempDir(), ColdPath: coldDir, TierInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+	defer storage.Close()
+
+	ct := &types.FheEncrypted{Data: []byte{4, 5, 6}, UintType: 2}
+	placeholder, content := resolveTestPlaceholder(t, storage, ct)
+
+	// The payload is archived by the next run, as nothing is accessed after being written
+	assert.Eventually(t, func() bool {
+		_, err := storage.Get(types.NamespacePayloads, content[:])
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, storage.HasPayload(content))
+
+	archived := 0
+	assert.NoError(t, filepath.Walk(coldDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			archived++
+		}
+		return err
+	}))
+	assert.Equal(t, 1, archived)
+
+	// Scrubbing checks the archived payload, but not as a handle
+	report, err := storage.Scrub(storage2.ScrubOptions{CheckMetadata: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Scanned)
+	assert.Empty(t, report.Issues)
+
+	// Reading the placeholder promotes the payload back
+	retrievedCt, err := storage.GetCt(placeholder)
+	assert.NoError(t, err)
+	assert.Equal(t, ct.Data, retrievedCt.Data)
+	assert.Equal(t, fhe.Hash(placeholder), retrievedCt.Key.Hash)
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	ct := randomCiphertext()
+	ct.Placeholder = true
+	ct.Key = fhe.CiphertextKey{
+		IsTriviallyEncrypted: true,
+		UintType:             fhe.Uint64,
+		SecurityZone:         -1,
+		Hash:                 fhe.Hash{1, 2, 3},
+	}
+
+	for _, compression := range []codec.Compression{codec.NoCompression, codec.SnappyCompression} {
+		record, err := codec.EncodeCt((*types.FheEncrypted)(ct), compression)
+		if err != nil {
+			t.Fatalf("Failed to encode ciphertext with %s: %v", compression, err)
+		}
+
+		decoded, err := codec.DecodeCt(record)
+		if err != nil {
+			t.Fatalf("Failed to decode ciphertext with %s: %v", compression, err)
+		}
+		assert.Equal(t, (*types.FheEncrypted)(ct), decoded)
+	}
+
+	record, err := codec.EncodeCt((*types.FheEncrypted)(ct), codec.NoCompression)
+	if err != nil {
+		t.Fatalf("Failed to encode ciphertext: %v", err)
+	}
+
+	_, err = codec.DecodeCt(record[:len(record)-1])
+	assert.ErrorIs(t, err, codec.ErrTruncatedRecord)
+
+	record[1] = codec.RecordVersion + 1
+	_, err = codec.DecodeCt(record)
+	assert.ErrorIs(t, err, codec.ErrUnsupportedVersion)
+}
+
+func TestCodecChecksum(t *testing.T) {
+	ct := randomCiphertext()
+	record, err := codec.EncodeCt((*types.FheEncrypted)(ct), codec.NoCompression)
+	if err != nil {
+		t.Fatalf("Failed to encode ciphertext: %v", err)
+	}
+	assert.True(t, codec.HasChecksum(record))
+
+	corrupted := append([]byte{}, record...)
+	corrupted[len(corrupted)/2] ^= 0x01
+	_, err = codec.DecodeCt(corrupted)
+	assert.ErrorIs(t, err, codec.ErrCorruptRecord)
+
+	// Version 1 records carry no checksum and are still readable
+	v1 := append([]byte{}, record[:len(record)-4]...)
+	v1[1] = 1
+	assert.False(t, codec.HasChecksum(v1))
+	decoded, err := codec.DecodeCt(v1)
+	assert.NoError(t, err)
+	assert.Equal(t, ct.Data, decoded.Data)
+
+	store, err := newTestStorage(t)
+	if err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+	hash := randomHash()
+	if err := store.Put(types.NamespaceCiphertexts, hash[:], corrupted); err != nil {
+		t.Fatalf("Failed to write corrupted record: %v", err)
+	}
+	_, err = store.GetCt(hash)
+	assert.ErrorIs(t, err, codec.ErrCorruptRecord)
+}
+
+func TestStorageScrub(t *testing.T) {
+	storage, err := newTestStorage(t)
+	if err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	handle := func(ct *fhe.FheEncrypted) types.Hash {
+		h := randomHash()
+		h[types.TrivialEncryptAndTypeByte] = byte(ct.UintType)
+		h[types.SecurityZoneByte] = byte(ct.Key.SecurityZone)
+		return h
+	}
+
+	good := randomCiphertext()
+	goodHash := handle(good)
+	assert.NoError(t, storage.PutCt(goodHash, (*types.FheEncrypted)(good)))
+
+	mismatched := randomCiphertext()
+	mismatchedHash := handle(mismatched)
+	mismatchedHash[types.SecurityZoneByte]++
+	assert.NoError(t, storage.PutCt(mismatchedHash, (*types.FheEncrypted)(mismatched)))
+
+	corrupted := randomCiphertext()
+	corruptedHash := handle(corrupted)
+	record, err := codec.EncodeCt((*types.FheEncrypted)(corrupted), codec.NoCompression)
+	assert.NoError(t, err)
+	record[len(record)-1] ^= 0xff
+	assert.NoError(t, storage.Put(types.NamespaceCiphertexts, corruptedHash[:], record))
+
+	report, err := storage.Scrub(storage2.ScrubOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.Scanned)
+	if assert.Len(t, report.Issues, 1) {
+		assert.Equal(t, corruptedHash, report.Issues[0].Hash)
+	}
+
+	report, err = storage.Scrub(storage2.ScrubOptions{CheckMetadata: true, Quarantine: true})
+	assert.NoError(t, err)
+	assert.Len(t, report.Issues, 2)
+	assert.Equal(t, 2, report.Quarantined)
+
+	assert.True(t, storage.HasCt(goodHash))
+	assert.False(t, storage.HasCt(mismatchedHash))
+	assert.False(t, storage.HasCt(corruptedHash))
+
+	report, err = storage.Scrub(storage2.ScrubOptions{CheckMetadata: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Scanned)
+	assert.Empty(t, report.Issues)
+}
+
+func TestStorageScrubArchived(t *testing.T) {
+	coldDir := t.TempDir()
+	storage, err := storage2.NewStorage("pebble", storage2.BackendConfig{Path: t.TempDir(), ColdPath: coldDir, TierInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+	defer storage.Close()
+
+	handle := func(ct *fhe.FheEncrypted) types.Hash {
+		h := randomHash()
+		h[types.TrivialEncryptAndTypeByte] = byte(ct.UintType)
+		h[types.SecurityZoneByte] = byte(ct.Key.SecurityZone)
+		return h
+	}
+
+	good := &fhe.FheEncrypted{Data: []byte{1, 2, 3}, UintType: 2}
+	corrupted := &fhe.FheEncrypted{Data: []byte{4, 5, 6}, UintType: 2}
+	goodHash, corruptedHash := handle(good), handle(corrupted)
+	assert.NoError(t, storage.PutCt(goodHash, (*types.FheEncrypted)(good)))
+	assert.NoError(t, storage.PutCt(corruptedHash, (*types.FheEncrypted)(corrupted)))
+
+	// Both are archived by the next run, as nothing is accessed after being written
+	assert.Eventually(t, func() bool {
+		_, goodErr := storage.Get(types.NamespaceCiphertexts, goodHash[:])
+		_, corruptedErr := storage.Get(types.NamespaceCiphertexts, corruptedHash[:])
+		return goodErr != nil && corruptedErr != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	corruptedRecord, err := codec.EncodeCt((*types.FheEncrypted)(corrupted), codec.SnappyCompression)
+	assert.NoError(t, err)
+	digest := sha256.Sum256(corruptedRecord)
+	name := hex.EncodeToString(digest[:])
+	assert.NoError(t, os.WriteFile(filepath.Join(coldDir, name[:2], name), []byte("garbage"), 0o644))
+
+	report, err := storage.Scrub(storage2.ScrubOptions{CheckMetadata: true, Quarantine: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Scanned)
+	if assert.Len(t, report.Issues, 1) {
+		assert.Equal(t, corruptedHash, report.Issues[0].Hash)
+	}
+	assert.Equal(t, 1, report.Quarantined)
+
+	assert.True(t, storage.HasCt(goodHash))
+	assert.False(t, storage.HasCt(corruptedHash))
+}
+
+func TestCodecReadsLegacyGob(t *testing.T) {
+	ct := randomCiphertext()
+	ct.Compact = false
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode((*types.FheEncrypted)(ct)); err != nil {
+		t.Fatalf("Failed to gob encode ciphertext: %v", err)
+	}
+
+	decoded, err := codec.DecodeCt(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to decode legacy ciphertext: %v", err)
+	}
+	assert.Equal(t, (*types.FheEncrypted)(ct), decoded)
+}
+
+func TestCodecCompression(t *testing.T) {
+	// Real ciphertexts are far from random, a repetitive payload should actually shrink
+	ct := &types.FheEncrypted{Data: bytes.Repeat([]byte{1, 2, 3, 4}, 1024), UintType: fhe.Uint8}
+
+	plain, err := codec.EncodeCt(ct, codec.NoCompression)
+	assert.NoError(t, err)
+	compressed, err := codec.EncodeCt(ct, codec.SnappyCompression)
+	assert.NoError(t, err)
+	assert.Less(t, len(compressed), len(plain))
+
+	// Records written with and without compression are both readable
+	for _, record := range [][]byte{plain, compressed} {
+		decoded, err := codec.DecodeCt(record)
+		assert.NoError(t, err)
+		assert.Equal(t, ct.Data, decoded.Data)
+	}
+
+	_, err = codec.ParseCompression("zip")
+	assert.Error(t, err)
+}
+
+func BenchmarkCodec(b *testing.B) {
+	ct := (*types.FheEncrypted)(randomCiphertext())
+
+	for _, compression := range []codec.Compression{codec.NoCompression, codec.SnappyCompression} {
+		b.Run("Binary/"+compression.String(), func(b *testing.B) {
+			b.SetBytes(int64(len(ct.Data)))
+			for i := 0; i < b.N; i++ {
+				record, err := codec.EncodeCt(ct, compression)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := codec.DecodeCt(record); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+
+	b.Run("Gob", func(b *testing.B) {
+		b.SetBytes(int64(len(ct.Data)))
+		for i := 0; i < b.N; i++ {
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(ct); err != nil {
+				b.Fatal(err)
+			}
+			var decoded types.FheEncrypted
+			if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestStorageMigrations(t *testing.T) {
+	storage, err := newTestStorage(t)
+	if err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	var applied []uint64
+	step := func(version uint64, err error) storage2.Migration {
+		return storage2.Migration{
+			Version:     version,
+			Description: "test step",
+			Migrate: func(_ *storage2.FheosStorage) error {
+				if err == nil {
+					applied = append(applied, version)
+				}
+				return err
+			},
+		}
+	}
+
+	if err := storage.PutVersion(5); err != nil {
+		t.Fatalf("Failed to put version: %v", err)
+	}
+
+	t.Run("DryRun", func(t *testing.T) {
+		report, err := storage.Migrate([]storage2.Migration{step(7, nil), step(6, nil)}, 8, true)
+		assert.NoError(t, err)
+		assert.Len(t, report.Applied, 2)
+		assert.Empty(t, applied)
+
+		version, _ := storage.GetVersion()
+		assert.Equal(t, uint64(5), version)
+	})
+
+	t.Run("ResumesAfterFailure", func(t *testing.T) {
+		steps := []storage2.Migration{step(7, errors.New("interrupted")), step(6, nil), step(9, nil)}
+		_, err := storage.Migrate(steps, 8, false)
+		assert.Error(t, err)
+
+		// The successful step is persisted, so the next run starts from it
+		version, _ := storage.GetVersion()
+		assert.Equal(t, uint64(6), version)
+
+		steps[0] = step(7, nil)
+		report, err := storage.Migrate(steps, 8, false)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(6), report.From)
+		assert.Equal(t, []uint64{6, 7}, applied)
+
+		version, _ = storage.GetVersion()
+		assert.Equal(t, uint64(8), version)
+	})
+
+	t.Run("RefusesNewerVersion", func(t *testing.T) {
+		_, err := storage.Migrate(nil, 7, false)
+		assert.ErrorIs(t, err, storage2.ErrNewerVersion)
+	})
+
+	t.Run("ChecksVersion", func(t *testing.T) {
+		assert.NoError(t, storage.CheckVersion(8))
+		assert.ErrorIs(t, storage.CheckVersion(9), storage2.ErrOutdatedVersion)
+		assert.ErrorIs(t, storage.CheckVersion(7), storage2.ErrNewerVersion)
+	})
+}
+
+func randomHash() types.Hash {
+	var h types.Hash
+	_, _ = rand.Read(h[:])
+	return h
+}
+
+// testBackendConformance checks the behaviour every types.Storage backend must share
+func testBackendConformance(t *testing.T, backend types.Storage) {
+	t.Run("Ciphertexts", func(t *testing.T) {
+		ct := randomCiphertext()
+		ct.Key.SecurityZone = 1
+		hash := randomHash()
+
+		assert.False(t, backend.HasCt(hash))
+		_, err := backend.GetCt(hash)
+		assert.Error(t, err)
+
+		assert.NoError(t, backend.PutCt(hash, (*types.FheEncrypted)(ct)))
+		assert.True(t, backend.HasCt(hash))
+
+		retrievedCt, err := backend.GetCt(hash)
+		assert.NoError(t, err)
+		assert.Equal(t, (*types.FheEncrypted)(ct), retrievedCt)
+
+		assert.NoError(t, backend.DeleteCt(hash))
+		assert.False(t, backend.HasCt(hash))
+	})
+
+	t.Run("Index", func(t *testing.T) {
+		handle := func(zone byte, utype byte) types.Hash {
+			h := randomHash()
+			h[types.SecurityZoneByte] = zone
+			h[types.TrivialEncryptAndTypeByte] = utype
+			return h
+		}
+
+		// A zone no other subtest writes to, so the counts below are exact
+		zone := int32(77)
+		uint64Ct := handle(byte(zone), byte(fhe.Uint64)|types.TrivialEncryptFlag)
+		uint8Ct := handle(byte(zone), byte(fhe.Uint8))
+		placeholder := handle(byte(zone), byte(fhe.Uint64))
+
+		ct := randomCiphertext()
+		assert.NoError(t, backend.PutCt(uint64Ct, (*types.FheEncrypted)(ct)))
+		assert.NoError(t, backend.PutCt(uint8Ct, (*types.FheEncrypted)(ct)))
+		ct.Placeholder = true
+		assert.NoError(t, backend.PutCt(placeholder, (*types.FheEncrypted)(ct)))
+
+		list := func(filter types.CtFilter) []types.CtMetadata {
+			var found []types.CtMetadata
+			assert.NoError(t, backend.IterateCts(filter, func(m types.CtMetadata) bool {
+				found = append(found, m)
+				return true
+			}))
+			return found
+		}
+
+		assert.Len(t, list(types.CtFilter{SecurityZone: &zone}), 3)
+
+		uint64Type := fhe.Uint64
+		found := list(types.CtFilter{SecurityZone: &zone, UintType: &uint64Type})
+		assert.Len(t, found, 2)
+
+		isPlaceholder := true
+		found = list(types.CtFilter{SecurityZone: &zone, UintType: &uint64Type, Placeholder: &isPlaceholder})
+		if assert.Len(t, found, 1) {
+			assert.Equal(t, placeholder, found[0].Hash)
+			assert.True(t, found[0].Placeholder)
+			assert.False(t, found[0].TriviallyEncrypted)
+		}
+
+		// Type and placeholder filters also work without a zone
+		found = list(types.CtFilter{HashPrefix: uint64Ct[:4], UintType: &uint64Type})
+		if assert.Len(t, found, 1) {
+			assert.True(t, found[0].TriviallyEncrypted)
+			assert.Equal(t, zone, found[0].SecurityZone)
+		}
+
+		// Resolving the placeholder moves it in the index but keeps its creation time
+		createdAt := list(types.CtFilter{HashPrefix: placeholder[:]})[0].CreatedAt
+		ct.Placeholder = false
+		assert.NoError(t, backend.PutCt(placeholder, (*types.FheEncrypted)(ct)))
+		assert.Empty(t, list(types.CtFilter{SecurityZone: &zone, Placeholder: &isPlaceholder}))
+		found = list(types.CtFilter{HashPrefix: placeholder[:]})
+		if assert.Len(t, found, 1) {
+			assert.False(t, found[0].Placeholder)
+			assert.True(t, createdAt.Equal(found[0].CreatedAt))
+		}
+
+		for _, h := range []types.Hash{uint64Ct, uint8Ct, placeholder} {
+			assert.NoError(t, backend.DeleteCt(h))
+		}
+		assert.Empty(t, list(types.CtFilter{SecurityZone: &zone}))
+	})
+
+	t.Run("Usage", func(t *testing.T) {
+		usage := func(zone int32, utype fhe.EncryptionType) types.Usage {
+			found := types.Usage{SecurityZone: zone, UintType: utype}
+			assert.NoError(t, backend.IterateUsage(func(u types.Usage) bool {
+				if u.SecurityZone == zone && u.UintType == utype {
+					found = u
+				}
+				return true
+			}))
+			return found
+		}
+
+		zone := int32(78)
+		first := randomHash()
+		first[types.SecurityZoneByte], first[types.TrivialEncryptAndTypeByte] = byte(zone), byte(fhe.Uint32)
+		second := randomHash()
+		second[types.SecurityZoneByte], second[types.TrivialEncryptAndTypeByte] = byte(zone), byte(fhe.Uint32)|types.TrivialEncryptFlag
+
+		ct := randomCiphertext()
+		ct.Placeholder = true
+		ct.Data = make([]byte, 10)
+		assert.NoError(t, backend.PutCt(first, (*types.FheEncrypted)(ct)))
+		assert.Equal(t, types.Usage{SecurityZone: zone, UintType: fhe.Uint32, Count: 1, Bytes: 10, Placeholders: 1}, usage(zone, fhe.Uint32))
+
+		// Resolving the placeholder replaces its size instead of adding to it
+		ct.Placeholder = false
+		ct.Data = make([]byte, 100)
+		assert.NoError(t, backend.PutCt(first, (*types.FheEncrypted)(ct)))
+		assert.NoError(t, backend.PutCt(second, (*types.FheEncrypted)(ct)))
+		assert.Equal(t, types.Usage{SecurityZone: zone, UintType: fhe.Uint32, Count: 2, Bytes: 200}, usage(zone, fhe.Uint32))
+
+		assert.NoError(t, backend.DeleteCt(first))
+		assert.NoError(t, backend.DeleteCt(first))
+		assert.Equal(t, types.Usage{SecurityZone: zone, UintType: fhe.Uint32, Count: 1, Bytes: 100}, usage(zone, fhe.Uint32))
+
+		assert.NoError(t, backend.DeleteCt(second))
+		assert.Equal(t, types.Usage{SecurityZone: zone, UintType: fhe.Uint32}, usage(zone, fhe.Uint32))
+	})
+
+	t.Run("Version", func(t *testing.T) {
+		assert.NoError(t, backend.PutVersion(42))
+		version, err := backend.GetVersion()
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(42), version)
+	})
+
+	t.Run("RefCounts", func(t *testing.T) {
+		hash := randomHash()
+		rc := types.RefCount{Count: 3, ZeroSince: 7}
+
+		_, err := backend.GetRefCount(hash)
+		assert.Error(t, err)
+
+		assert.NoError(t, backend.PutRefCount(hash, rc))
+		retrieved, err := backend.GetRefCount(hash)
+		assert.NoError(t, err)
+		assert.Equal(t, rc, retrieved)
+
+		found := false
+		assert.NoError(t, backend.IterateRefCounts(func(h types.Hash, iterated types.RefCount) bool {
+			if h == hash {
+				found = true
+				assert.Equal(t, rc, iterated)
+			}
+			return true
+		}))
+		assert.True(t, found)
+
+		assert.NoError(t, backend.DeleteRefCount(hash))
+		_, err = backend.GetRefCount(hash)
+		assert.Error(t, err)
+	})
+
+	t.Run("Namespaces", func(t *testing.T) {
+		prefix := randomHash()
+		key := func(suffix byte) []byte {
+			return append(append([]byte{}, prefix[:]...), suffix)
+		}
+
+		assert.NoError(t, backend.Put(types.NamespaceIndexes, key(2), []byte{2}))
+		assert.NoError(t, backend.Put(types.NamespaceIndexes, key(1), []byte{1}))
+		assert.NoError(t, backend.Put(types.NamespaceJournal, key(3), []byte{3}))
+
+		val, err := backend.Get(types.NamespaceIndexes, key(1))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{1}, val)
+
+		_, err = backend.Get(types.NamespaceJournal, key(1))
+		assert.Error(t, err, "namespaces must not share keys")
+
+		var iterated [][]byte
+		assert.NoError(t, backend.IteratePrefix(types.NamespaceIndexes, prefix[:], func(k []byte, v []byte) bool {
+			iterated = append(iterated, append([]byte{}, k...))
+			return true
+		}))
+		assert.Equal(t, [][]byte{key(1), key(2)}, iterated, "keys should be iterated in order")
+
+		iterated = nil
+		assert.NoError(t, backend.IteratePrefix(types.NamespaceIndexes, prefix[:], func(k []byte, v []byte) bool {
+			iterated = append(iterated, k)
+			return false
+		}))
+		assert.Len(t, iterated, 1, "iteration should stop when fn returns false")
+
+		assert.NoError(t, backend.Delete(types.NamespaceIndexes, key(1)))
+		_, err = backend.Get(types.NamespaceIndexes, key(1))
+		assert.Error(t, err)
+	})
+}
+
+func TestStorageIndexMigrations(t *testing.T) {
+	storage, err := newTestStorage(t)
+	if err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	// A ciphertext stored by version 1002, which had no index
+	var h types.Hash
+	h[0], h[types.TrivialEncryptAndTypeByte], h[types.SecurityZoneByte] = 142, byte(fhe.Uint32), 7
+	record, err := codec.EncodeCt(&types.FheEncrypted{Data: make([]byte, 50), UintType: fhe.Uint32}, codec.NoCompression)
+	assert.NoError(t, err)
+	assert.NoError(t, storage.Put(types.NamespaceCiphertexts, h[:], record))
+	assert.NoError(t, storage.PutVersion(1002))
+
+	indexed := func() (types.CtMetadata, bool) {
+		var found types.CtMetadata
+		ok := false
+		assert.NoError(t, storage.IterateCts(types.CtFilter{}, func(m types.CtMetadata) bool {
+			if m.Hash == h {
+				found, ok = m, true
+			}
+			return true
+		}))
+		return found, ok
+	}
+
+	// 1003 only indexes the ciphertext
+	_, err = storage.Migrate(storage2.Migrations, 1003, false)
+	assert.NoError(t, err)
+	m, ok := indexed()
+	assert.True(t, ok)
+	assert.Zero(t, m.Size)
+	zoneUsage, err := storage.ZoneUsage(7)
+	assert.NoError(t, err)
+	assert.Zero(t, zoneUsage.Count)
+
+	// and 1004 adds its size and usage
+	_, err = storage.Migrate(storage2.Migrations, 1004, false)
+	assert.NoError(t, err)
+	m, ok = indexed()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(50), m.Size)
+	zoneUsage, err = storage.ZoneUsage(7)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), zoneUsage.Count)
+	assert.Equal(t, uint64(50), zoneUsage.Bytes)
+}
+
+func TestStoragePayloadMigration(t *testing.T) {
+	storage, err := newTestStorage(t)
+	if err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	// A resolved placeholder as version 1004 stored it: the payload in the ciphertext namespace under its content
+	// hash, and no index entry for the placeholder
+	var placeholder, content types.Hash
+	placeholder[0], placeholder[types.TrivialEncryptAndTypeByte], placeholder[types.SecurityZoneByte] = 143, byte(fhe.Uint32), 7
+	content[0], content[types.TrivialEncryptAndTypeByte], content[types.SecurityZoneByte] = 144, 0xaa, 0xbb
+	assert.NoError(t, storage.PutCt(content, &types.FheEncrypted{Data: make([]byte, 50), UintType: fhe.Uint32}))
+	assert.NoError(t, storage.Put(types.NamespaceIndexes, append(append([]byte("alias/c/"), content[:]...), placeholder[:]...), nil))
+	assert.NoError(t, storage.Put(types.NamespaceIndexes, append([]byte("alias/p/"), placeholder[:]...), content[:]))
+	assert.NoError(t, storage.PutVersion(1004))
+
+	for i := 0; i < 2; i++ {
+		// Rerunning the step finds the payload already moved
+		assert.NoError(t, storage.PutVersion(1004))
+		_, err = storage.Migrate(storage2.Migrations, 1005, false)
+		assert.NoError(t, err)
+
+		assert.True(t, storage.HasPayload(content))
+		ct, err := storage.GetCt(placeholder)
+		if assert.NoError(t, err) {
+			assert.Len(t, ct.Data, 50)
+		}
+
+		var indexed []types.CtMetadata
+		assert.NoError(t, storage.IterateCts(types.CtFilter{}, func(m types.CtMetadata) bool {
+			indexed = append(indexed, m)
+			return true
+		}))
+		if assert.Len(t, indexed, 1) {
+			assert.Equal(t, placeholder, indexed[0].Hash)
+			assert.Equal(t, uint64(50), indexed[0].Size)
+		}
+
+		usage, err := storage.ZoneUsage(7)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1), usage.Count)
+		assert.Equal(t, uint64(50), usage.Bytes)
+		usage, err = storage.ZoneUsage(0xbb)
+		assert.NoError(t, err)
+		assert.Zero(t, usage.Count)
+	}
+}
+
+func TestBackendConformance(t *testing.T) {
+	for _, name := range storage2.Backends() {
+		t.Run(name, func(t *testing.T) {
+			backend, err := storage2.NewBackend(name, storage2.BackendConfig{Path: t.TempDir()})
+			if err != nil {
+				t.Fatalf("Failed to create %s backend: %v", name, err)
+			}
+			defer backend.Close()
+
+			testBackendConformance(t, backend)
+		})
+	}
+}
+
+func TestStorageIndependentInstances(t *testing.T) {
+	first, err := newTestStorage(t)
+	if err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+	second, err := newTestStorage(t)
+	if err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	ct := randomCiphertext()
+	hash := randomHash()
+	if err := first.PutCt(hash, (*types.FheEncrypted)(ct)); err != nil {
+		t.Fatalf("Failed to put ciphertext: %v", err)
+	}
+
+	assert.True(t, first.HasCt(hash))
+	assert.False(t, second.HasCt(hash), "storages opened at different paths must not share data")
+}
+
+func TestRestoreCheckpoint(t *testing.T) {
+	store, err := newTestStorage(t)
+	if err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	hash := randomHash()
+	assert.NoError(t, store.PutCt(hash, (*types.FheEncrypted)(randomCiphertext())))
+
+	dir := t.TempDir()
+	_, err = store.Checkpoint(dir)
+	assert.NoError(t, err)
+
+	// Backups are pebble dbs, other backends can't open them
+	t.Setenv("FHEOS_DB_BACKEND", "fs")
+	path := t.TempDir()
+	_, err = storage2.RestoreCheckpoint(dir, path, 1004)
+	assert.Error(t, err)
+
+	t.Setenv("FHEOS_DB_BACKEND", "pebble")
+	_, err = storage2.RestoreCheckpoint(dir, path, 1004)
+	assert.NoError(t, err)
+
+	restored, err := storage2.NewStorage("pebble", storage2.BackendConfig{Path: path})
+	if err != nil {
+		t.Fatalf("Failed to open restored storage: %v", err)
+	}
+	defer restored.Close()
+	assert.True(t, restored.HasCt(hash))
+}
@@ -1,51 +1,30 @@
 package storage
 
 import (
+	"errors"
+	"fmt"
+
 	"github.com/fhenixprotocol/fheos/precompiles/types"
+	"github.com/fhenixprotocol/fheos/storage/oracledb"
 )
 
-type FheosStorage struct {
-}
+// The replay binary has no disk, so the only backend is the preimage oracle
+var preimageOracle oracledb.Oracle
 
-type IFheosStorage interface {
-	//Put(t types.DataType, key []byte, val []byte) error
-	//Get(t types.DataType, key []byte) ([]byte, error)
-	GetVersion() (uint64, error)
-	PutVersion(v uint64) error
-	PutCt(h types.Hash, cipher *types.FheEncrypted) error
-	GetCt(h types.Hash) (*types.FheEncrypted, error)
+// SetPreimageOracle sets the oracle that stored ciphertexts are resolved from. It must be called before the fheos
+// state is initialized
+func SetPreimageOracle(oracle oracledb.Oracle) {
+	preimageOracle = oracle
 }
 
 func InitStorage(_ string) (*FheosStorage, error) {
-	return &FheosStorage{}, nil
-}
-
-//func (store WasmStorage) Put(_ types.DataType, _ []byte, _ []byte) error {
-//	return nil
-//}
-//
-//func (store WasmStorage) Get(t types.DataType, key []byte) ([]byte, error) {
-//	return nil, nil
-//}
-
-func (store FheosStorage) GetVersion() (uint64, error) {
-	return 0, nil
-}
+	if preimageOracle == nil {
+		return nil, errors.New("no preimage oracle set for fheos storage")
+	}
 
-func (store FheosStorage) PutVersion(v uint64) error {
-	return nil
+	return newFheosStorage(oracledb.New(preimageOracle)), nil
 }
 
-func (store FheosStorage) PutCt(h types.Hash, cipher *types.CipherTextRepresentation) error {
-	return nil
+func RestoreCheckpoint(_ string, _ string, _ uint64) (types.BackupManifest, error) {
+	return types.BackupManifest{}, fmt.Errorf("%w in the replay binary", ErrCheckpointUnsupported)
 }
-
-func (store FheosStorage) GetCt(h types.Hash) (*types.CipherTextRepresentation, error) {
-	return nil, nil
-}
-
-func (store FheosStorage) DeleteCt(h types.Hash) error {
-	return nil
-}
-
-func (store FheosStorage) Size() uint64 { return 0 }
@@ -0,0 +1,158 @@
+package tiered
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+)
+
+// ArchiveDir is where a checkpoint keeps its copy of the cold archive, next to the checkpoint of the hot backend
+const ArchiveDir = "cold"
+
+var ErrCheckpointUnsupported = errors.New("hot backend does not support checkpoints")
+
+type checkpointer interface {
+	Checkpoint(dir string) (types.BackupManifest, error)
+}
+
+// Checkpoint writes a checkpoint of the hot backend to dir and a copy of the cold archive to dir/ArchiveDir. Archive
+// files are content addressed and never change, so they are hard linked where possible. Prune is held off until the
+// copy is done, so every record archived in the hot checkpoint is in it. If it fails dir is left empty
+func (s *Store) Checkpoint(dir string) (manifest types.BackupManifest, err error) {
+	hot, ok := s.Storage.(checkpointer)
+	if !ok {
+		return manifest, ErrCheckpointUnsupported
+	}
+
+	s.archiveLock.RLock()
+	defer s.archiveLock.RUnlock()
+
+	manifest, err = hot.Checkpoint(dir)
+	if err != nil {
+		return manifest, err
+	}
+
+	if err := copyArchive(s.opts.Dir, filepath.Join(dir, ArchiveDir)); err != nil {
+		clearDir(dir)
+		return manifest, fmt.Errorf("failed to copy the cold archive: %w", err)
+	}
+	return manifest, nil
+}
+
+// RestoreArchive copies the cold archive of the checkpoint in dir, if it has one, into archive
+func RestoreArchive(dir string, archive string) error {
+	src := filepath.Join(dir, ArchiveDir)
+	if _, err := os.Stat(src); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return copyArchive(src, archive)
+}
+
+// HasArchive returns true if the checkpoint in dir has archived records
+func HasArchive(dir string) bool {
+	entries, err := os.ReadDir(filepath.Join(dir, ArchiveDir))
+	return err == nil && len(entries) > 0
+}
+
+func copyArchive(src string, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Base(path)[0] == '.' {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if _, err := os.Stat(target); err == nil {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		if err := os.Link(path, target); err == nil {
+			return nil
+		}
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src string, dst string) error {
+	val, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return writeFile(dst, val)
+}
+
+// clearDir removes everything in dir
+func clearDir(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		_ = os.RemoveAll(filepath.Join(dir, entry.Name()))
+	}
+}
+
+// IterateArchived calls fn with the handle and record of every archived ciphertext, or with the error that kept the
+// record from being read: a missing file, or one that doesn't match its digest
+func (s *Store) IterateArchived(fn func(h types.Hash, record []byte, err error) bool) error {
+	return s.iterateArchived(ciphertexts, fn)
+}
+
+// IterateArchivedPayloads is IterateArchived for the shared payloads, which are passed with their content hash
+func (s *Store) IterateArchivedPayloads(fn func(h types.Hash, record []byte, err error) bool) error {
+	return s.iterateArchived(payloads, fn)
+}
+
+func (s *Store) iterateArchived(k recordKind, fn func(h types.Hash, record []byte, err error) bool) error {
+	s.archiveLock.RLock()
+	defer s.archiveLock.RUnlock()
+
+	type pointer struct {
+		hash   types.Hash
+		digest []byte
+	}
+	var pointers []pointer
+	err := s.Storage.IteratePrefix(types.NamespaceMetadata, k.cold, func(key []byte, val []byte) bool {
+		if len(key) != len(k.cold)+len(types.Hash{}) {
+			return true
+		}
+
+		var p pointer
+		copy(p.hash[:], key[len(k.cold):])
+		p.digest = append([]byte{}, val...)
+		pointers = append(pointers, p)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, p := range pointers {
+		record, err := os.ReadFile(s.archivePath(p.digest))
+		if err != nil {
+			// Promoted (and possibly pruned) since it was listed
+			if !s.isArchived(k, p.hash) {
+				continue
+			}
+		} else if sum := sha256.Sum256(record); !bytes.Equal(sum[:], p.digest) {
+			err = fmt.Errorf("%w: %x", ErrArchiveCorrupt, p.hash[:])
+		}
+
+		if !fn(p.hash, record, err) {
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+//go:build amd64 || arm64
+
+package tiered
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+	"github.com/fhenixprotocol/fheos/storage/pebble"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTieredCheckpoint(t *testing.T) {
+	hot, err := pebble.NewStorage(t.TempDir(), pebble.Options{})
+	if err != nil {
+		t.Fatalf("Failed to create hot backend: %v", err)
+	}
+
+	store, err := New(hot, Options{Dir: t.TempDir(), ColdAfter: time.Hour})
+	if err != nil {
+		t.Fatalf("Failed to create tiered storage: %v", err)
+	}
+	defer store.Close()
+
+	archived, warm := types.Hash{1}, types.Hash{2}
+	assert.NoError(t, store.PutCt(archived, &types.FheEncrypted{Data: []byte{1}}))
+	_, err = store.Demote(time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.NoError(t, store.PutCt(warm, &types.FheEncrypted{Data: []byte{2}}))
+
+	dir := t.TempDir()
+	_, err = store.Checkpoint(dir)
+	assert.NoError(t, err)
+	assert.True(t, HasArchive(dir))
+	assert.Len(t, archiveFiles(t, filepath.Join(dir, ArchiveDir)), 1)
+
+	// Pruning the live archive doesn't touch the checkpoint's copy
+	_, err = store.GetCt(archived)
+	assert.NoError(t, err)
+	pruned, err := store.Prune()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pruned)
+
+	path, coldDir := t.TempDir(), t.TempDir()
+	_, err = pebble.Restore(dir, path, func(types.BackupManifest) error { return nil })
+	assert.NoError(t, err)
+	assert.NoError(t, RestoreArchive(dir, coldDir))
+
+	restoredHot, err := pebble.NewStorage(path, pebble.Options{})
+	if err != nil {
+		t.Fatalf("Failed to open restored backend: %v", err)
+	}
+	restored, err := New(restoredHot, Options{Dir: coldDir, ColdAfter: time.Hour})
+	if err != nil {
+		t.Fatalf("Failed to create tiered storage: %v", err)
+	}
+	defer restored.Close()
+
+	for _, h := range []types.Hash{archived, warm} {
+		ct, err := restored.GetCt(h)
+		if assert.NoError(t, err) {
+			assert.Equal(t, []byte{h[0]}, ct.Data)
+		}
+	}
+
+	t.Run("IterateArchived", func(t *testing.T) {
+		_, err := restored.Demote(time.Now().Add(time.Hour))
+		assert.NoError(t, err)
+		for _, file := range archiveFiles(t, coldDir) {
+			assert.NoError(t, os.WriteFile(file, []byte("garbage"), 0644))
+		}
+
+		seen := 0
+		assert.NoError(t, restored.IterateArchived(func(h types.Hash, record []byte, err error) bool {
+			seen++
+			assert.ErrorIs(t, err, ErrArchiveCorrupt)
+			return true
+		}))
+		assert.Equal(t, 2, seen)
+	})
+}
@@ -0,0 +1,584 @@
+// Package tiered keeps recently accessed ciphertexts in the hot backend and moves the ones that weren't accessed for a
+// while to a cold archive directory, from which they are promoted back when read
+package tiered
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+	"github.com/fhenixprotocol/fheos/storage/codec"
+)
+
+// Metadata keys kept in the hot backend, for ciphertexts and for the shared payloads of NamespacePayloads:
+//
+//	last access:   NamespaceMetadata | "access/" | hash          ->  unix nanoseconds
+//	cold pointer:  NamespaceMetadata | "cold/" | hash            ->  sha256 of the archived record
+//	               NamespaceMetadata | "payload-access/" | hash  ->  unix nanoseconds
+//	               NamespaceMetadata | "payload-cold/" | hash    ->  sha256 of the archived record
+var (
+	accessPrefix        = []byte("access/")
+	coldPrefix          = []byte("cold/")
+	payloadAccessPrefix = []byte("payload-access/")
+	payloadColdPrefix   = []byte("payload-cold/")
+)
+
+// recordKind is the namespace a kind of record is kept in while hot, and the prefixes of its metadata keys
+type recordKind struct {
+	namespace types.DataType
+	access    []byte
+	cold      []byte
+}
+
+var (
+	ciphertexts = recordKind{namespace: types.NamespaceCiphertexts, access: accessPrefix, cold: coldPrefix}
+	payloads    = recordKind{namespace: types.NamespacePayloads, access: payloadAccessPrefix, cold: payloadColdPrefix}
+)
+
+// accessGranularity limits how often the last access of a ciphertext is rewritten
+const accessGranularity = time.Hour
+
+var ErrArchiveCorrupt = errors.New("archived ciphertext does not match its address")
+
+type Options struct {
+	// Dir is the cold archive. Records are stored snappy compressed under Dir/<first byte>/<sha256>
+	Dir string
+	// ColdAfter is how long a ciphertext must go unaccessed before it is archived
+	ColdAfter time.Duration
+	// Interval is how often the archiver runs, 0 disables it
+	Interval time.Duration
+	// Compression is applied to the shared payloads written to a hot backend that doesn't store them itself
+	Compression codec.Compression
+}
+
+// Store is a types.Storage whose ciphertext records and shared payloads are split between the hot backend and the cold
+// archive. The ciphertext index and usage counters stay in the hot backend for archived ciphertexts too
+type Store struct {
+	types.Storage
+	opts Options
+
+	// lock serializes moving records between the tiers with writes to them
+	lock sync.Mutex
+	// archiveLock keeps Prune from deleting archive files while they are read by a checkpoint or a scrub
+	archiveLock sync.RWMutex
+	stop        chan struct{}
+	wg          sync.WaitGroup
+}
+
+func New(hot types.Storage, opts Options) (*Store, error) {
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &Store{Storage: hot, opts: opts}
+	if opts.Interval > 0 {
+		s.start()
+	}
+	return s, nil
+}
+
+func metaKey(prefix []byte, h types.Hash) []byte {
+	return append(append([]byte{}, prefix...), h[:]...)
+}
+
+func (s *Store) archivePath(digest []byte) string {
+	name := hex.EncodeToString(digest)
+	return filepath.Join(s.opts.Dir, name[:2], name)
+}
+
+// accessTime returns when h was last accessed, or ok=false if no access was recorded since it was written
+func (s *Store) accessTime(k recordKind, h types.Hash) (time.Time, bool) {
+	val, err := s.Storage.Get(types.NamespaceMetadata, metaKey(k.access, h))
+	if err != nil || len(val) != 8 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(val))), true
+}
+
+func (s *Store) touch(k recordKind, h types.Hash, now time.Time) {
+	if last, ok := s.accessTime(k, h); ok && now.Sub(last) < accessGranularity {
+		return
+	}
+
+	val := binary.BigEndian.AppendUint64(nil, uint64(now.UnixNano()))
+	if err := s.Storage.Put(types.NamespaceMetadata, metaKey(k.access, h), val); err != nil {
+		log.Warn("failed to record ciphertext access", "hash", hex.EncodeToString(h[:]), "err", err)
+	}
+}
+
+func (s *Store) lastAccess(m types.CtMetadata) time.Time {
+	if last, ok := s.accessTime(ciphertexts, m.Hash); ok {
+		return last
+	}
+	return m.CreatedAt
+}
+
+func (s *Store) isArchived(k recordKind, h types.Hash) bool {
+	_, err := s.Storage.Get(types.NamespaceMetadata, metaKey(k.cold, h))
+	return err == nil
+}
+
+func (s *Store) PutCt(h types.Hash, cipher *types.FheEncrypted) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.Storage.PutCt(h, cipher); err != nil {
+		return err
+	}
+
+	// The new record supersedes any archived one
+	if err := s.Storage.Delete(types.NamespaceMetadata, metaKey(coldPrefix, h)); err != nil {
+		return err
+	}
+	s.touch(ciphertexts, h, time.Now())
+	return nil
+}
+
+func (s *Store) GetCt(h types.Hash) (*types.FheEncrypted, error) {
+	ct, err := s.Storage.GetCt(h)
+	if err == nil {
+		s.touch(ciphertexts, h, time.Now())
+		return ct, nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// It may have been promoted while we waited for the lock
+	if ct, hotErr := s.Storage.GetCt(h); hotErr == nil {
+		return ct, nil
+	}
+
+	if !s.isArchived(ciphertexts, h) {
+		return nil, err
+	}
+	return s.promote(ciphertexts, h)
+}
+
+func (s *Store) HasCt(h types.Hash) bool {
+	return s.Storage.HasCt(h) || s.isArchived(ciphertexts, h)
+}
+
+func (s *Store) DeleteCt(h types.Hash) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.Storage.DeleteCt(h); err != nil {
+		return err
+	}
+	if err := s.Storage.Delete(types.NamespaceMetadata, metaKey(accessPrefix, h)); err != nil {
+		return err
+	}
+
+	// The archived record itself is removed by the next prune
+	return s.Storage.Delete(types.NamespaceMetadata, metaKey(coldPrefix, h))
+}
+
+// The shared payloads are written to the hot backend through its own PayloadStorage, so it can cache them, or as raw
+// records in NamespacePayloads if it has none
+func (s *Store) putHotPayload(h types.Hash, cipher *types.FheEncrypted) error {
+	if hot, ok := s.Storage.(types.PayloadStorage); ok {
+		return hot.PutPayload(h, cipher)
+	}
+
+	record, err := codec.EncodeCt(cipher, s.opts.Compression)
+	if err != nil {
+		return err
+	}
+	return s.Storage.Put(types.NamespacePayloads, h[:], record)
+}
+
+func (s *Store) getHotPayload(h types.Hash) (*types.FheEncrypted, error) {
+	if hot, ok := s.Storage.(types.PayloadStorage); ok {
+		return hot.GetPayload(h)
+	}
+
+	record, err := s.Storage.Get(types.NamespacePayloads, h[:])
+	if err != nil {
+		return nil, err
+	}
+	ct, err := codec.DecodeCt(record)
+	if err != nil {
+		return nil, fmt.Errorf("payload %x: %w", h[:], err)
+	}
+	return ct, nil
+}
+
+func (s *Store) hasHotPayload(h types.Hash) bool {
+	if hot, ok := s.Storage.(types.PayloadStorage); ok {
+		return hot.HasPayload(h)
+	}
+
+	_, err := s.Storage.Get(types.NamespacePayloads, h[:])
+	return err == nil
+}
+
+func (s *Store) PutPayload(h types.Hash, cipher *types.FheEncrypted) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.putHotPayload(h, cipher); err != nil {
+		return err
+	}
+
+	if err := s.Storage.Delete(types.NamespaceMetadata, metaKey(payloadColdPrefix, h)); err != nil {
+		return err
+	}
+	s.touch(payloads, h, time.Now())
+	return nil
+}
+
+func (s *Store) GetPayload(h types.Hash) (*types.FheEncrypted, error) {
+	ct, err := s.getHotPayload(h)
+	if err == nil {
+		s.touch(payloads, h, time.Now())
+		return ct, nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if ct, hotErr := s.getHotPayload(h); hotErr == nil {
+		return ct, nil
+	}
+
+	if !s.isArchived(payloads, h) {
+		return nil, err
+	}
+	return s.promote(payloads, h)
+}
+
+func (s *Store) HasPayload(h types.Hash) bool {
+	return s.hasHotPayload(h) || s.isArchived(payloads, h)
+}
+
+func (s *Store) DeletePayload(h types.Hash) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var err error
+	if hot, ok := s.Storage.(types.PayloadStorage); ok {
+		err = hot.DeletePayload(h)
+	} else {
+		err = s.Storage.Delete(types.NamespacePayloads, h[:])
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := s.Storage.Delete(types.NamespaceMetadata, metaKey(payloadAccessPrefix, h)); err != nil {
+		return err
+	}
+	return s.Storage.Delete(types.NamespaceMetadata, metaKey(payloadColdPrefix, h))
+}
+
+// Batch runs fn on a tiered view of a batch of the hot backend, so that the tier metadata of what fn writes is
+// applied with it. Records aren't moved between the tiers until it is done. A hot backend without batches gets the
+// writes one by one
+func (s *Store) Batch(fn func(st types.Storage) error) error {
+	hot, ok := s.Storage.(types.BatchStorage)
+	if !ok {
+		return fn(s)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return hot.Batch(func(batch types.Storage) error {
+		return fn(&Store{Storage: batch, opts: s.opts})
+	})
+}
+
+// promote moves the archived record of h back into the hot backend. Must be called with the lock held
+func (s *Store) promote(k recordKind, h types.Hash) (*types.FheEncrypted, error) {
+	digest, err := s.Storage.Get(types.NamespaceMetadata, metaKey(k.cold, h))
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := os.ReadFile(s.archivePath(digest))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archived ciphertext %x: %w", h[:], err)
+	}
+
+	if sum := sha256.Sum256(record); !bytes.Equal(sum[:], digest) {
+		return nil, fmt.Errorf("%w: %x", ErrArchiveCorrupt, h[:])
+	}
+
+	ct, err := codec.DecodeCt(record)
+	if err != nil {
+		return nil, fmt.Errorf("archived ciphertext %x: %w", h[:], err)
+	}
+
+	// The record is written back as is, the index entry never left the hot backend
+	if err := s.Storage.Put(k.namespace, h[:], record); err != nil {
+		return nil, err
+	}
+	if err := s.Storage.Delete(types.NamespaceMetadata, metaKey(k.cold, h)); err != nil {
+		return nil, err
+	}
+	s.touch(k, h, time.Now())
+
+	if metrics.Enabled {
+		metrics.GetOrRegisterCounter("fheos/db/tier/promotions", nil).Inc(1)
+	}
+	return ct, nil
+}
+
+// archive moves the record of h to the cold archive. Must be called with the lock held
+func (s *Store) archive(k recordKind, h types.Hash) (bool, error) {
+	record, err := s.Storage.Get(k.namespace, h[:])
+	if err != nil {
+		// Already archived, deleted, or a backend that doesn't keep records in the ciphertext namespace
+		return false, nil
+	}
+
+	ct, err := codec.DecodeCt(record)
+	if err != nil {
+		return false, fmt.Errorf("ciphertext %x: %w", h[:], err)
+	}
+
+	record, err = codec.EncodeCt(ct, codec.SnappyCompression)
+	if err != nil {
+		return false, err
+	}
+
+	digest := sha256.Sum256(record)
+	if err := writeFile(s.archivePath(digest[:]), record); err != nil {
+		return false, err
+	}
+
+	if err := s.Storage.Put(types.NamespaceMetadata, metaKey(k.cold, h), digest[:]); err != nil {
+		return false, err
+	}
+	if err := s.Storage.Delete(k.namespace, h[:]); err != nil {
+		return false, err
+	}
+
+	return true, s.Storage.Delete(types.NamespaceMetadata, metaKey(k.access, h))
+}
+
+// writeFile writes an archive file atomically. Archive files are content addressed, so an existing one is kept
+func writeFile(path string, val []byte) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(val); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Demote archives every resolved ciphertext and shared payload that wasn't accessed since cutoff and returns how many
+// were moved
+func (s *Store) Demote(cutoff time.Time) (int, error) {
+	var stale, stalePayloads []types.Hash
+	resolved := false
+	err := s.Storage.IterateCts(types.CtFilter{Placeholder: &resolved}, func(m types.CtMetadata) bool {
+		if s.lastAccess(m).Before(cutoff) {
+			stale = append(stale, m.Hash)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Payloads aren't in the ciphertext index, their access is recorded when they are written
+	err = s.Storage.IteratePrefix(types.NamespacePayloads, nil, func(key []byte, _ []byte) bool {
+		var h types.Hash
+		copy(h[:], key)
+		if last, ok := s.accessTime(payloads, h); !ok || last.Before(cutoff) {
+			stalePayloads = append(stalePayloads, h)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	demoted := 0
+	demote := func(k recordKind, hashes []types.Hash) error {
+		for _, h := range hashes {
+			// It may have been accessed since it was listed
+			if last, ok := s.accessTime(k, h); ok && !last.Before(cutoff) {
+				continue
+			}
+
+			archived, err := s.archive(k, h)
+			if err != nil {
+				return err
+			}
+			if archived {
+				demoted++
+			}
+		}
+		return nil
+	}
+	if err := demote(ciphertexts, stale); err != nil {
+		return demoted, err
+	}
+	if err := demote(payloads, stalePayloads); err != nil {
+		return demoted, err
+	}
+
+	if metrics.Enabled {
+		metrics.GetOrRegisterCounter("fheos/db/tier/demotions", nil).Inc(int64(demoted))
+	}
+	return demoted, nil
+}
+
+// Prune deletes the archive files no ciphertext or payload points to anymore and returns how many were deleted
+func (s *Store) Prune() (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.archiveLock.Lock()
+	defer s.archiveLock.Unlock()
+
+	referenced := map[string]struct{}{}
+	for _, prefix := range [][]byte{coldPrefix, payloadColdPrefix} {
+		err := s.Storage.IteratePrefix(types.NamespaceMetadata, prefix, func(key []byte, val []byte) bool {
+			referenced[hex.EncodeToString(val)] = struct{}{}
+			return true
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	pruned := 0
+	var coldBytes int64
+	err := filepath.WalkDir(s.opts.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		if _, ok := referenced[d.Name()]; ok {
+			if info, err := d.Info(); err == nil {
+				coldBytes += info.Size()
+			}
+			return nil
+		}
+
+		pruned++
+		return os.Remove(path)
+	})
+
+	if metrics.Enabled {
+		metrics.GetOrRegisterGauge("fheos/db/tier/cold/count", nil).Update(int64(len(referenced)))
+		metrics.GetOrRegisterGauge("fheos/db/tier/cold/bytes", nil).Update(coldBytes)
+	}
+	return pruned, err
+}
+
+// Sizes returns how many ciphertexts are in the hot backend and in the archive
+func (s *Store) Sizes() (hot int, cold int, err error) {
+	err = s.Storage.IteratePrefix(types.NamespaceMetadata, coldPrefix, func(key []byte, val []byte) bool {
+		cold++
+		return true
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = s.Storage.IterateCts(types.CtFilter{}, func(m types.CtMetadata) bool {
+		hot++
+		return true
+	})
+	return hot - cold, cold, err
+}
+
+func (s *Store) run() {
+	demoted, err := s.Demote(time.Now().Add(-s.opts.ColdAfter))
+	if err != nil {
+		log.Error("fheos ciphertext archiving failed", "err", err)
+	}
+
+	pruned, err := s.Prune()
+	if err != nil {
+		log.Error("fheos archive pruning failed", "err", err)
+	}
+
+	hot, cold, err := s.Sizes()
+	if err == nil && metrics.Enabled {
+		metrics.GetOrRegisterGauge("fheos/db/tier/hot/count", nil).Update(int64(hot))
+	}
+
+	if demoted > 0 || pruned > 0 {
+		log.Info("fheos ciphertext archiving", "archived", demoted, "pruned", pruned, "hot", hot, "cold", cold)
+	}
+}
+
+func (s *Store) start() {
+	s.stop = make(chan struct{})
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(s.opts.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				s.run()
+			}
+		}
+	}()
+}
+
+// Close stops the archiver and closes the hot backend
+func (s *Store) Close() error {
+	if s.stop != nil {
+		close(s.stop)
+		s.wg.Wait()
+		s.stop = nil
+	}
+
+	return s.Storage.Close()
+}
+
+type flatLayoutMigrator interface {
+	MigrateFlatLayout() (int, error)
+}
+
+// MigrateFlatLayout forwards the flat layout migration to the hot backend, if it has one
+func (s *Store) MigrateFlatLayout() (int, error) {
+	migrator, ok := s.Storage.(flatLayoutMigrator)
+	if !ok {
+		return 0, nil
+	}
+	return migrator.MigrateFlatLayout()
+}
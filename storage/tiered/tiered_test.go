@@ -0,0 +1,98 @@
+package tiered
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fhenixprotocol/fheos/precompiles/types"
+	"github.com/fhenixprotocol/fheos/storage/codec"
+	"github.com/fhenixprotocol/fheos/storage/fsdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func archiveFiles(t *testing.T, dir string) []string {
+	var files []string
+	assert.NoError(t, filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+		return err
+	}))
+	return files
+}
+
+func TestTieredStorage(t *testing.T) {
+	hot, err := fsdb.New(t.TempDir(), codec.NoCompression)
+	if err != nil {
+		t.Fatalf("Failed to create hot backend: %v", err)
+	}
+
+	coldDir := t.TempDir()
+	store, err := New(hot, Options{Dir: coldDir, ColdAfter: time.Hour})
+	if err != nil {
+		t.Fatalf("Failed to create tiered storage: %v", err)
+	}
+	defer store.Close()
+
+	cold, warm, placeholder := types.Hash{1}, types.Hash{2}, types.Hash{3}
+	for _, h := range []types.Hash{cold, warm, placeholder} {
+		assert.NoError(t, store.PutCt(h, &types.FheEncrypted{Data: append(make([]byte, 64), h[0]), Placeholder: h == placeholder}))
+	}
+
+	// Everything was accessed just now, so nothing is stale yet
+	demoted, err := store.Demote(time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Zero(t, demoted)
+
+	demoted, err = store.Demote(time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, demoted, "placeholders stay hot")
+	assert.Len(t, archiveFiles(t, coldDir), 2)
+
+	_, err = hot.Get(types.NamespaceCiphertexts, cold[:])
+	assert.Error(t, err, "archived record should leave the hot backend")
+	assert.True(t, store.HasCt(cold))
+
+	hotCount, coldCount, err := store.Sizes()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, hotCount)
+	assert.Equal(t, 2, coldCount)
+
+	// Reading promotes it back
+	ct, err := store.GetCt(warm)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(2), ct.Data[64])
+	_, err = hot.Get(types.NamespaceCiphertexts, warm[:])
+	assert.NoError(t, err)
+
+	// The archived copy of a promoted ciphertext is pruned
+	pruned, err := store.Prune()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pruned)
+
+	// Deleting an archived ciphertext removes it from both tiers
+	assert.NoError(t, store.DeleteCt(cold))
+	assert.False(t, store.HasCt(cold))
+	_, err = store.GetCt(cold)
+	assert.Error(t, err)
+	pruned, err = store.Prune()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pruned)
+	assert.Empty(t, archiveFiles(t, coldDir))
+
+	t.Run("DetectsCorruptArchive", func(t *testing.T) {
+		h := types.Hash{4}
+		assert.NoError(t, store.PutCt(h, &types.FheEncrypted{Data: []byte{4}}))
+		_, err := store.Demote(time.Now().Add(time.Hour))
+		assert.NoError(t, err)
+
+		digest, err := hot.Get(types.NamespaceMetadata, metaKey(coldPrefix, h))
+		assert.NoError(t, err)
+		assert.NoError(t, os.WriteFile(store.archivePath(digest), []byte("garbage"), 0644))
+
+		_, err = store.GetCt(h)
+		assert.ErrorIs(t, err, ErrArchiveCorrupt)
+	})
+}